@@ -2,154 +2,401 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+
+	"github.com/alanwang67/distributed_registers/abd/server"
+	"github.com/alanwang67/distributed_registers/errs"
 )
 
+// ErrNoQuorum is returned when fewer than a quorum of servers respond to an operation.
+var ErrNoQuorum = errs.ErrNoQuorum
+
+// ErrReplicasDisagree is returned by ReadAll when some server doesn't hold the latest value even
+// after it was written back to every server.
+var ErrReplicasDisagree = errors.New("replicas disagree after write-back")
+
 // Client represents a single client in the distributed system.
 // Each client communicates with a set of servers to perform read and write operations
 // following the ABD algorithm for quorum-based consistency.
 type Client struct {
 	ID      int                      // Unique ID of the client
 	Servers []map[string]interface{} // List of server configurations
+
+	// AllowStaleOnQuorumFailure makes reads that cannot reach a quorum return the freshest
+	// value received from the servers that did respond, flagged as stale, instead of failing.
+	AllowStaleOnQuorumFailure bool
+
+	// Epoch is the membership epoch Servers belongs to. The client moves to a newer membership
+	// as soon as a server reports one.
+	Epoch int
+	// OldServers is the configuration being replaced while a membership change is in progress.
+	// Operations then need a quorum of both Servers and OldServers.
+	OldServers []map[string]interface{}
 }
 
 // Read performs the ABD read operation in two phases:
 // 1. Get Phase: Contacts all servers to fetch the highest version and value.
 // 2. Set Phase: Writes back the highest version and value to all servers to ensure atomicity.
-func (c *Client) Read() (int, int) {
-	maxVersion := 0
-	var latestValue int
-	quorum := len(c.Servers)/2 + 1
-	responses := 0
-
-	for _, server := range c.Servers {
-		conn, err := net.Dial("tcp", server["address"].(string))
-		if err != nil {
-			log.Printf("Failed to connect to server %v: %v", server, err)
+// The returned stale flag is set when AllowStaleOnQuorumFailure let a read without a quorum succeed.
+func (c *Client) Read() (int, int, bool, error) {
+	for {
+		responses := c.broadcast(map[string]interface{}{"type": "read"})
+		if c.adoptNewerMembership(responses) {
 			continue
 		}
 
-		request := map[string]interface{}{"type": "read"}
-		if err := json.NewEncoder(conn).Encode(request); err != nil {
-			log.Printf("Failed to send read request to server %v: %v", server, err)
-			conn.Close()
-			continue
+		latestValue, maxVersion := latest(responses)
+
+		if !c.hasQuorum(responses, nil) {
+			if c.AllowStaleOnQuorumFailure && len(responses) > 0 {
+				log.Printf("Read returning stale value from %d of %d servers: Value=%d, Version=%d", len(responses), len(c.members()), latestValue, maxVersion)
+				return latestValue, maxVersion, true, nil
+			}
+			log.Printf("Read failed: insufficient responses to achieve quorum.")
+			err := fmt.Errorf("read got %d of %d responses, needed %s: %w", len(responses), len(c.members()), c.quorumSize(), ErrNoQuorum)
+			if len(responses) == 0 {
+				err = fmt.Errorf("%w: %w", errs.ErrNoServerAvailable, err)
+			}
+			return latestValue, maxVersion, false, err
 		}
 
-		var response map[string]interface{}
-		if err := json.NewDecoder(conn).Decode(&response); err != nil {
-			log.Printf("Failed to decode read response from server %v: %v", server, err)
-			conn.Close()
+		log.Printf("Read successful: Value=%d, Version=%d", latestValue, maxVersion)
+		return latestValue, maxVersion, false, nil
+	}
+}
+
+// ReadAll is a diagnostic strong read. It reads every server rather than a quorum, writes the
+// latest value back to all of them, and reads them all again to check the write-back took. It
+// fails with ErrReplicasDisagree, naming the servers, if any still holds an older version or a
+// different value at the same version, and with errs.ErrUnreachable if any server doesn't respond.
+// On disagreement it still returns the latest value and version it found.
+func (c *Client) ReadAll() (int, int, error) {
+	for {
+		responses := c.broadcast(map[string]interface{}{"type": "read"})
+		if c.adoptNewerMembership(responses) {
 			continue
 		}
+		members := c.members()
+		if len(responses) < len(members) {
+			return 0, 0, fmt.Errorf("read all: %d of %d servers responded: %w", len(responses), len(members), errs.ErrUnreachable)
+		}
+		value, version := latest(responses)
 
-		conn.Close()
+		acks := c.broadcast(map[string]interface{}{"type": "write", "value": value, "version": version})
+		if c.adoptNewerMembership(acks) {
+			continue
+		}
+		for _, server := range members {
+			if ack, ok := acks[server["address"].(string)]; !ok || !statusOK(ack) {
+				return value, version, fmt.Errorf("read all: write-back of version %d to %v failed: %w", version, server["address"], errs.ErrUnreachable)
+			}
+		}
 
-		version := int(response["version"].(float64))
-		value := int(response["value"].(float64))
-		if version > maxVersion {
-			maxVersion = version
-			latestValue = value
+		// A newer version is a write that completed meanwhile, not a lost write-back.
+		checks := c.broadcast(map[string]interface{}{"type": "read"})
+		var behind []string
+		for _, server := range members {
+			address := server["address"].(string)
+			check, ok := checks[address]
+			if !ok {
+				return value, version, fmt.Errorf("read all: %s did not respond after the write-back: %w", address, errs.ErrUnreachable)
+			}
+			v, val := int(check["version"].(float64)), int(check["value"].(float64))
+			if v < version || (v == version && val != value) {
+				behind = append(behind, address)
+			}
+		}
+		if len(behind) > 0 {
+			log.Printf("ReadAll found %d of %d servers disagreeing after write-back: %v", len(behind), len(members), behind)
+			return value, version, fmt.Errorf("read all: %v do not hold value %d at version %d after write-back: %w", behind, value, version, ErrReplicasDisagree)
 		}
-		responses++
-	}
 
-	if responses < quorum {
-		log.Printf("Read failed: insufficient responses to achieve quorum.")
-		return latestValue, maxVersion
+		log.Printf("ReadAll successful: all %d servers hold Value=%d, Version=%d", len(members), value, version)
+		return value, version, nil
 	}
+}
 
-	log.Printf("Read successful: Value=%d, Version=%d", latestValue, maxVersion)
-	return latestValue, maxVersion
+// latest returns the value and version of the response with the highest version.
+func latest(responses map[string]map[string]interface{}) (value int, version int) {
+	for _, response := range responses {
+		if v := int(response["version"].(float64)); v > version {
+			version = v
+			value = int(response["value"].(float64))
+		}
+	}
+	return value, version
 }
 
 // Write performs the ABD write operation in two phases:
 // 1. Fetch the current state (optional for generating unique version numbers).
 // 2. Broadcast the new (value, version) pair to all servers.
 func (c *Client) Write(value int) (bool, int) {
-	quorum := len(c.Servers)/2 + 1
-	maxVersion := 0
-	responses := 0
-
-	// Phase 1: Fetch current version from servers
-	for _, server := range c.Servers {
-		conn, err := net.Dial("tcp", server["address"].(string))
-		if err != nil {
-			log.Printf("Failed to connect to server %v: %v", server, err)
+	for {
+		// Phase 1: Fetch current version from servers
+		responses := c.broadcast(map[string]interface{}{"type": "read"})
+		if c.adoptNewerMembership(responses) {
 			continue
 		}
 
-		request := map[string]interface{}{"type": "read"}
-		if err := json.NewEncoder(conn).Encode(request); err != nil {
-			log.Printf("Failed to send read request to server %v: %v", server, err)
-			conn.Close()
-			continue
+		maxVersion := 0
+		for _, response := range responses {
+			version := int(response["version"].(float64))
+			if version > maxVersion {
+				maxVersion = version
+			}
+		}
+
+		if !c.hasQuorum(responses, nil) {
+			log.Printf("Write aborted: insufficient responses during version fetch.")
+			return false, maxVersion
 		}
 
-		var response map[string]interface{}
-		if err := json.NewDecoder(conn).Decode(&response); err != nil {
-			log.Printf("Failed to decode read response from server %v: %v", server, err)
-			conn.Close()
+		// Phase 2: Write the new value with incremented version
+		newVersion := maxVersion + 1
+		responses = c.broadcast(map[string]interface{}{
+			"type":    "write",
+			"value":   value,
+			"version": newVersion,
+		})
+		if c.adoptNewerMembership(responses) {
 			continue
 		}
 
-		conn.Close()
+		if c.hasQuorum(responses, statusOK) {
+			log.Printf("Write successful: Value=%d, Version=%d", value, newVersion)
+			return true, newVersion
+		}
+
+		log.Printf("Write failed to achieve quorum: Value=%d, Version=%d", value, maxVersion)
+		return false, maxVersion
+	}
+}
+
+// Reconfigure changes the servers that make up the register to servers while it stays online.
+// The change is committed in two steps, each written to a quorum of both the old and the new
+// servers: first a joint membership that operations must reach quorums of both configurations
+// under, and then, once the latest value has been copied to the new servers, the new membership
+// alone. A client still using the old configuration reaches a server that knows of the change
+// in any old quorum, so it switches over before completing an operation. If a change fails
+// partway, calling Reconfigure again with the same servers completes it.
+func (c *Client) Reconfigure(servers []map[string]interface{}) error {
+	// Learn the latest membership, so the change builds on it.
+	if _, _, stale, err := c.Read(); err != nil {
+		return fmt.Errorf("reconfigure: could not read the current membership: %w", err)
+	} else if stale {
+		return fmt.Errorf("reconfigure: could not read the current membership: %w", ErrNoQuorum)
+	}
 
-		version := int(response["version"].(float64))
-		if version > maxVersion {
-			maxVersion = version
+	if len(c.OldServers) == 0 {
+		joint := server.Membership{Epoch: c.Epoch + 1, Servers: toConfigs(servers), Old: toConfigs(c.Servers)}
+		c.setMembership(joint)
+		if err := c.install(joint); err != nil {
+			return err
 		}
-		responses++
+	} else if !sameServers(c.Servers, servers) {
+		return fmt.Errorf("reconfigure: a change to %v is already in progress", c.Servers)
 	}
 
-	if responses < quorum {
-		log.Printf("Write aborted: insufficient responses during version fetch.")
-		return false, maxVersion
+	// A joint read needs an old quorum, so it sees every write completed on the old servers.
+	value, version, stale, err := c.Read()
+	if err != nil {
+		return fmt.Errorf("reconfigure: could not read the latest value: %w", err)
+	} else if stale {
+		return fmt.Errorf("reconfigure: could not read the latest value: %w", ErrNoQuorum)
+	}
+	responses := c.broadcast(map[string]interface{}{"type": "write", "value": value, "version": version})
+	if !c.hasQuorum(responses, statusOK) {
+		return fmt.Errorf("reconfigure: could not copy version %d to the new servers: %w", version, ErrNoQuorum)
 	}
 
-	// Phase 2: Write the new value with incremented version
-	successfulWrites := 0
-	newVersion := maxVersion + 1
+	final := server.Membership{Epoch: c.Epoch + 1, Servers: toConfigs(c.Servers)}
+	if err := c.install(final); err != nil {
+		return err
+	}
+	c.setMembership(final)
+	log.Printf("Reconfigure successful: %d servers at epoch %d", len(c.Servers), c.Epoch)
+	return nil
+}
 
-	for _, server := range c.Servers {
-		conn, err := net.Dial("tcp", server["address"].(string))
-		if err != nil {
-			log.Printf("Failed to connect to server %v: %v", server, err)
-			continue
+// install sends membership to every server the client knows of and requires a quorum of each
+// of the client's configurations to accept it.
+func (c *Client) install(membership server.Membership) error {
+	responses := c.broadcast(map[string]interface{}{"type": "reconfigure", "membership": membership})
+	accepted := func(response map[string]interface{}) bool {
+		return statusOK(response) && epochOf(response) == membership.Epoch
+	}
+	if !c.hasQuorum(responses, accepted) {
+		return fmt.Errorf("reconfigure: membership epoch %d did not reach a quorum: %w", membership.Epoch, ErrNoQuorum)
+	}
+	return nil
+}
+
+// call sends request to a single server and returns its response.
+func (c *Client) call(server map[string]interface{}, request map[string]interface{}) (map[string]interface{}, error) {
+	conn, err := net.Dial("tcp", server["address"].(string))
+	if err != nil {
+		log.Printf("Failed to connect to server %v: %v", server, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		log.Printf("Failed to send %v request to server %v: %v", request["type"], server, err)
+		return nil, err
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		log.Printf("Failed to decode %v response from server %v: %v", request["type"], server, err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// broadcast sends request to every server in the client's configurations and returns the
+// responses keyed by server address.
+func (c *Client) broadcast(request map[string]interface{}) map[string]map[string]interface{} {
+	responses := make(map[string]map[string]interface{})
+	for _, server := range c.members() {
+		if response, err := c.call(server, request); err == nil {
+			responses[server["address"].(string)] = response
 		}
+	}
+	return responses
+}
 
-		request := map[string]interface{}{
-			"type":    "write",
-			"value":   value,
-			"version": newVersion,
+// members returns the servers of all the client's configurations, each once.
+func (c *Client) members() []map[string]interface{} {
+	seen := make(map[string]bool)
+	var members []map[string]interface{}
+	for _, config := range c.configurations() {
+		for _, server := range config {
+			if address := server["address"].(string); !seen[address] {
+				seen[address] = true
+				members = append(members, server)
+			}
 		}
+	}
+	return members
+}
 
-		if err := json.NewEncoder(conn).Encode(request); err != nil {
-			log.Printf("Failed to send write request to server %v: %v", server, err)
-			conn.Close()
-			continue
+// configurations returns the server sets an operation needs a quorum of.
+func (c *Client) configurations() [][]map[string]interface{} {
+	if len(c.OldServers) == 0 {
+		return [][]map[string]interface{}{c.Servers}
+	}
+	return [][]map[string]interface{}{c.Servers, c.OldServers}
+}
+
+// quorumSize describes the responses hasQuorum needs: a majority of every configuration.
+func (c *Client) quorumSize() string {
+	configs := c.configurations()
+	if len(configs) == 1 {
+		return fmt.Sprintf("%d", len(configs[0])/2+1)
+	}
+	return fmt.Sprintf("%d of the %d servers and %d of the %d old servers", len(configs[0])/2+1, len(configs[0]), len(configs[1])/2+1, len(configs[1]))
+}
+
+// hasQuorum reports whether a quorum of every configuration responded, counting only
+// responses ok accepts, or all of them if ok is nil.
+func (c *Client) hasQuorum(responses map[string]map[string]interface{}, ok func(map[string]interface{}) bool) bool {
+	for _, config := range c.configurations() {
+		count := 0
+		for _, server := range config {
+			if response, found := responses[server["address"].(string)]; found && (ok == nil || ok(response)) {
+				count++
+			}
+		}
+		if count < len(config)/2+1 {
+			return false
 		}
+	}
+	return true
+}
 
-		var response map[string]interface{}
-		if err := json.NewDecoder(conn).Decode(&response); err != nil {
-			log.Printf("Failed to decode response from server %v: %v", server, err)
-			conn.Close()
-			continue
+// adoptNewerMembership switches the client to the membership of the server reporting the
+// highest epoch, if that is newer than the client's, and reports whether it did.
+func (c *Client) adoptNewerMembership(responses map[string]map[string]interface{}) bool {
+	newest, address := c.Epoch, ""
+	for a, response := range responses {
+		if epoch := epochOf(response); epoch > newest {
+			newest, address = epoch, a
 		}
+	}
+	if address == "" {
+		return false
+	}
 
-		conn.Close()
+	response, err := c.call(map[string]interface{}{"address": address}, map[string]interface{}{"type": "membership"})
+	if err != nil {
+		return false
+	}
+	var membership server.Membership
+	data, err := json.Marshal(response["membership"])
+	if err != nil || json.Unmarshal(data, &membership) != nil || membership.Epoch <= c.Epoch {
+		return false
+	}
+
+	log.Printf("Client %d moving from membership epoch %d to %d", c.ID, c.Epoch, membership.Epoch)
+	c.setMembership(membership)
+	return true
+}
+
+func (c *Client) setMembership(membership server.Membership) {
+	c.Epoch = membership.Epoch
+	c.Servers = fromConfigs(membership.Servers)
+	c.OldServers = fromConfigs(membership.Old)
+}
 
-		if response["status"] == "ok" {
-			successfulWrites++
+func statusOK(response map[string]interface{}) bool {
+	return response["status"] == "ok"
+}
+
+// epochOf returns the membership epoch a server reported, treating servers that don't report
+// one as still on the static configuration.
+func epochOf(response map[string]interface{}) int {
+	epoch, _ := response["epoch"].(float64)
+	return int(epoch)
+}
+
+func toConfigs(servers []map[string]interface{}) []*server.ServerConfig {
+	configs := make([]*server.ServerConfig, len(servers))
+	for i, s := range servers {
+		config := &server.ServerConfig{Address: s["address"].(string)}
+		switch id := s["id"].(type) {
+		case int:
+			config.ID = id
+		case float64:
+			config.ID = int(id)
 		}
+		config.Network, _ = s["network"].(string)
+		configs[i] = config
 	}
+	return configs
+}
 
-	if successfulWrites >= quorum {
-		log.Printf("Write successful: Value=%d, Version=%d", value, newVersion)
-		return true, newVersion
+func fromConfigs(configs []*server.ServerConfig) []map[string]interface{} {
+	if len(configs) == 0 {
+		return nil
 	}
+	servers := make([]map[string]interface{}, len(configs))
+	for i, config := range configs {
+		servers[i] = map[string]interface{}{"id": config.ID, "network": config.Network, "address": config.Address}
+	}
+	return servers
+}
 
-	log.Printf("Write failed to achieve quorum: Value=%d, Version=%d", value, maxVersion)
-	return false, maxVersion
+func sameServers(a, b []map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i]["address"] != b[i]["address"] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,262 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/abd/server"
+	"github.com/alanwang67/distributed_registers/errs"
+)
+
+// freeAddr reserves an ephemeral local port and releases it for a server to bind.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newCluster starts the first up of n servers and returns a client configured with all n addresses.
+func newCluster(t *testing.T, n, up int) *Client {
+	t.Helper()
+	servers := make([]map[string]interface{}, n)
+	for i := range servers {
+		address := freeAddr(t)
+		servers[i] = map[string]interface{}{"id": i, "network": "tcp", "address": address}
+		if i < up {
+			startServer(t, i, address)
+		}
+	}
+	return &Client{ID: 0, Servers: servers}
+}
+
+// startServer starts a server at address and stops it when the test ends.
+func startServer(t *testing.T, id int, address string) *server.Server {
+	t.Helper()
+	s := server.NewServer(id, address, nil)
+	go s.Start()
+	waitReachable(t, address)
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func waitReachable(t *testing.T, address string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s never became reachable", address)
+}
+
+func TestReadWithoutQuorum(t *testing.T) {
+	c := newCluster(t, 3, 1)
+
+	// Seed the one live server directly, since a write cannot reach a quorum either.
+	live := &Client{Servers: c.Servers[:1]}
+	if ok, _ := live.Write(11); !ok {
+		t.Fatalf("seeding write failed")
+	}
+
+	if _, _, _, err := c.Read(); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Read() error = %v; want ErrNoQuorum", err)
+	}
+
+	c.AllowStaleOnQuorumFailure = true
+	value, version, stale, err := c.Read()
+	if err != nil || !stale || value != 11 || version != 1 {
+		t.Errorf("Read() = %d, %d, %v, %v; want stale 11 at version 1", value, version, stale, err)
+	}
+}
+
+func TestReadWithNoServers(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	c.AllowStaleOnQuorumFailure = true
+
+	_, _, _, err := c.Read()
+	if !errors.Is(err, errs.ErrNoServerAvailable) || !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Read() error = %v; want ErrNoServerAvailable and ErrNoQuorum", err)
+	}
+}
+
+func TestReadWithoutJointQuorum(t *testing.T) {
+	c := newCluster(t, 5, 0)
+	c.OldServers = c.Servers[2:]
+
+	_, _, _, err := c.Read()
+	if want := "needed 3 of the 5 servers and 2 of the 3 old servers"; !errors.Is(err, ErrNoQuorum) || !strings.Contains(err.Error(), want) {
+		t.Errorf("Read() during a joint membership: error %v; want ErrNoQuorum saying %q", err, want)
+	}
+}
+
+func TestReadWithQuorumIsNotStale(t *testing.T) {
+	c := newCluster(t, 3, 2)
+	c.AllowStaleOnQuorumFailure = true
+
+	if ok, _ := c.Write(4); !ok {
+		t.Fatalf("write failed")
+	}
+
+	value, _, stale, err := c.Read()
+	if err != nil || stale || value != 4 {
+		t.Errorf("Read() = %d, %v, %v; want a fresh 4", value, stale, err)
+	}
+}
+
+func TestReconfigureAddsServerOnline(t *testing.T) {
+	servers := make([]map[string]interface{}, 5)
+	handles := make([]*server.Server, 5)
+	for i := range servers {
+		address := freeAddr(t)
+		servers[i] = map[string]interface{}{"id": i, "network": "tcp", "address": address}
+		handles[i] = startServer(t, i, address)
+	}
+
+	// The writer and reader keep using the four-server configuration they started with.
+	admin := &Client{ID: 0, Servers: servers[:4]}
+	writer := &Client{ID: 1, Servers: servers[:4]}
+	reader := &Client{ID: 2, Servers: servers[:4]}
+	var acked atomic.Int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for value := 1; ; value++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if ok, _ := writer.Write(value); !ok {
+				t.Errorf("Write(%d) failed during reconfiguration", value)
+				return
+			}
+			acked.Store(int64(value))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		last := 0
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			floor := int(acked.Load())
+			value, _, _, err := reader.Read()
+			if err != nil {
+				t.Errorf("Read() failed during reconfiguration: %v", err)
+				return
+			}
+			if value < floor || value < last {
+				t.Errorf("Read() = %d after acknowledged write %d and earlier read %d", value, floor, last)
+				return
+			}
+			last = value
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	err := admin.Reconfigure(servers)
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+	// Epoch 1 is the joint membership and epoch 2 the new one.
+	if admin.Epoch != 2 || len(admin.Servers) != 5 || len(admin.OldServers) != 0 {
+		t.Fatalf("after Reconfigure client has epoch %d, %d servers, old %v; want epoch 2 with 5 servers", admin.Epoch, len(admin.Servers), admin.OldServers)
+	}
+	if writer.Epoch == 0 || reader.Epoch == 0 {
+		t.Errorf("writer at epoch %d and reader at epoch %d; want both to have moved off the static configuration", writer.Epoch, reader.Epoch)
+	}
+
+	// Losing two of the original servers leaves the old configuration without a quorum, but the
+	// new one still has three of five, including the added server.
+	handles[0].Stop()
+	handles[1].Stop()
+	final := int(acked.Load())
+	value, _, _, err := (&Client{ID: 3, Servers: servers}).Read()
+	if err != nil || value != final {
+		t.Errorf("Read() on the new configuration = %d, %v; want %d", value, err, final)
+	}
+}
+
+// startForgetfulServer serves the ABD protocol at address like a server that never got any
+// write: it acknowledges writes but drops them, and always reads as version 0.
+func startForgetfulServer(t *testing.T, address string) {
+	t.Helper()
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var request map[string]interface{}
+			if json.NewDecoder(conn).Decode(&request) == nil {
+				json.NewEncoder(conn).Encode(map[string]interface{}{"status": "ok", "value": 0, "version": 0, "epoch": 0})
+			}
+			conn.Close()
+		}
+	}()
+}
+
+func TestReadAllDetectsLostWriteBack(t *testing.T) {
+	c := newCluster(t, 3, 2)
+	startForgetfulServer(t, c.Servers[2]["address"].(string))
+
+	if ok, _ := c.Write(5); !ok {
+		t.Fatalf("write failed")
+	}
+	if value, _, stale, err := c.Read(); err != nil || stale || value != 5 {
+		t.Errorf("Read() = %d, %v, %v; want 5 from a quorum, unaware of the lagging server", value, stale, err)
+	}
+
+	value, version, err := c.ReadAll()
+	if !errors.Is(err, ErrReplicasDisagree) {
+		t.Fatalf("ReadAll() error = %v; want ErrReplicasDisagree", err)
+	}
+	if value != 5 || version != 1 {
+		t.Errorf("ReadAll() = %d at version %d; want the latest value 5 at version 1", value, version)
+	}
+}
+
+func TestReadAllAgrees(t *testing.T) {
+	c := newCluster(t, 3, 3)
+	// Only a quorum gets the write; ReadAll brings the third server up to date.
+	quorum := &Client{Servers: c.Servers[:2]}
+	if ok, _ := quorum.Write(8); !ok {
+		t.Fatalf("write failed")
+	}
+
+	if value, version, err := c.ReadAll(); err != nil || value != 8 || version != 1 {
+		t.Errorf("ReadAll() = %d, %d, %v; want 8 at version 1", value, version, err)
+	}
+
+	down := newCluster(t, 3, 2)
+	if _, _, err := down.ReadAll(); !errors.Is(err, errs.ErrUnreachable) {
+		t.Errorf("ReadAll() with a server down: error = %v; want ErrUnreachable", err)
+	}
+}
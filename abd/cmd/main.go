@@ -10,6 +10,7 @@ import (
 
 	"github.com/alanwang67/distributed_registers/abd/client"
 	"github.com/alanwang67/distributed_registers/abd/server"
+	clusterconfig "github.com/alanwang67/distributed_registers/config"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -51,6 +52,9 @@ func main() {
 	if err := json.Unmarshal(configData, &config); err != nil {
 		log.Fatalf("Error parsing config file: %v\n", err)
 	}
+	if _, err := clusterconfig.Parse(configData); err != nil {
+		log.Fatalf("Invalid config file: %v\n", err)
+	}
 
 	switch role {
 	case "server":
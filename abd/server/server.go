@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -16,14 +17,26 @@ type ServerConfig struct {
 	Address string `json:"address"`
 }
 
+// Membership is a numbered configuration of the servers that make up the register. While the
+// membership is changing, Old holds the configuration being replaced and operations need a
+// quorum of both.
+type Membership struct {
+	Epoch   int             `json:"epoch"`
+	Servers []*ServerConfig `json:"servers"`
+	Old     []*ServerConfig `json:"old,omitempty"`
+}
+
 // Server represents a single server in the distributed system.
 type Server struct {
-	ID      int
-	Address string
-	Value   int
-	Version int
-	Peers   []*ServerConfig // Peer servers
-	mu      sync.Mutex
+	ID         int
+	Address    string
+	Value      int
+	Version    int
+	Peers      []*ServerConfig // Peer servers
+	Membership Membership      // Latest membership this server has been told about; epoch 0 is the static config
+	mu         sync.Mutex
+
+	listener net.Listener
 }
 
 // NewServer creates a new server instance.
@@ -48,8 +61,15 @@ func (s *Server) Start() error {
 	}
 	log.Printf("Server %d listening on %s", s.ID, s.Address)
 
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Println("Connection error:", err)
 			continue
@@ -58,6 +78,16 @@ func (s *Server) Start() error {
 	}
 }
 
+// Stop closes the server's listener, making Start return.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
 // handleConnection handles incoming client requests.
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
@@ -78,6 +108,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 		s.mu.Lock()
 		response["value"] = s.Value
 		response["version"] = s.Version
+		response["epoch"] = s.Membership.Epoch
 		s.mu.Unlock()
 		log.Printf("Server %d handled read: value=%d, version=%d", s.ID, s.Value, s.Version)
 	case "write":
@@ -97,6 +128,28 @@ func (s *Server) handleConnection(conn net.Conn) {
 		} else {
 			log.Printf("Server %d ignored write with outdated version: %d", s.ID, int(version))
 		}
+		response["epoch"] = s.Membership.Epoch
+		s.mu.Unlock()
+		response["status"] = "ok"
+	case "membership":
+		s.mu.Lock()
+		response["membership"] = s.Membership
+		s.mu.Unlock()
+	case "reconfigure":
+		// Clients only switch to a membership once a quorum of the old and new servers has it,
+		// so any later operation on the old configuration reaches a server that knows better.
+		var membership Membership
+		if err := decodeField(request["membership"], &membership); err != nil {
+			response["error"] = "Invalid reconfigure request"
+			log.Printf("Server %d received invalid reconfigure request: %v", s.ID, request)
+			break
+		}
+		s.mu.Lock()
+		if membership.Epoch > s.Membership.Epoch {
+			s.Membership = membership
+			log.Printf("Server %d installed membership epoch %d: %d servers", s.ID, membership.Epoch, len(membership.Servers))
+		}
+		response["epoch"] = s.Membership.Epoch
 		s.mu.Unlock()
 		response["status"] = "ok"
 	default:
@@ -110,6 +163,18 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
+// decodeField converts a field of a decoded JSON request into v.
+func decodeField(field interface{}, v interface{}) error {
+	if field == nil {
+		return errors.New("missing field")
+	}
+	data, err := json.Marshal(field)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
 // periodicLog periodically logs server state and peer connections.
 func (s *Server) periodicLog() {
 	ticker := time.NewTicker(30 * time.Second)
@@ -0,0 +1,80 @@
+// Package config checks the cluster layout in the harnesses' config.json files before anything
+// is started from it.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Cluster is the part of a config.json the harnesses share. Fields a harness doesn't use are
+// simply empty.
+type Cluster struct {
+	Servers    []Node   `json:"servers"`
+	Sequencers []Node   `json:"sequencer"` // paxos only
+	Clients    []Client `json:"clients"`
+}
+
+// Node is a server or sequencer.
+type Node struct {
+	ID      uint64 `json:"id"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// Client lists the servers, by ID, a client talks to.
+type Client struct {
+	ID      uint64   `json:"id"`
+	Servers []uint64 `json:"servers"`
+}
+
+// Parse reads the cluster layout from the contents of a config.json and validates it.
+func Parse(data []byte) (Cluster, error) {
+	var cluster Cluster
+	if err := json.Unmarshal(data, &cluster); err != nil {
+		return Cluster{}, fmt.Errorf("parsing config: %w", err)
+	}
+	return cluster, cluster.Validate()
+}
+
+// Validate reports every pair of nodes sharing an address, which would fail to bind or gossip
+// to itself, and every pair of servers or of sequencers sharing an ID. A client listing a server
+// ID that doesn't exist is only logged, since harnesses that don't use the client lists still
+// run.
+func (c Cluster) Validate() error {
+	var errs []error
+	addresses := make(map[string]string)
+	for _, group := range []struct {
+		kind  string
+		nodes []Node
+	}{{"server", c.Servers}, {"sequencer", c.Sequencers}} {
+		ids := make(map[uint64]bool)
+		for _, n := range group.nodes {
+			node := fmt.Sprintf("%s %d", group.kind, n.ID)
+			if ids[n.ID] {
+				errs = append(errs, fmt.Errorf("more than one %s has ID %d", group.kind, n.ID))
+			}
+			ids[n.ID] = true
+			if other, ok := addresses[n.Address]; ok {
+				errs = append(errs, fmt.Errorf("%s and %s share address %q", other, node, n.Address))
+			} else {
+				addresses[n.Address] = node
+			}
+		}
+	}
+
+	ids := make(map[uint64]bool)
+	for _, s := range c.Servers {
+		ids[s.ID] = true
+	}
+	for _, client := range c.Clients {
+		for _, id := range client.Servers {
+			if !ids[id] {
+				log.Printf("[WARN] client %d lists server %d, but no server has that ID", client.ID, id)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateAddress(t *testing.T) {
+	_, err := Parse([]byte(`{"servers": [
+		{"id": 0, "network": "tcp", "address": "127.0.0.1:10000"},
+		{"id": 1, "network": "tcp", "address": "127.0.0.1:10000"}
+	]}`))
+	if err == nil || !strings.Contains(err.Error(), `server 0 and server 1 share address "127.0.0.1:10000"`) {
+		t.Errorf("Parse() of two servers on one address: error %v; want it to name both servers and the address", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cluster Cluster
+		want    string // Substring of the error, or "" if valid
+	}{
+		{"valid", Cluster{
+			Servers:    []Node{{ID: 0, Address: "a"}, {ID: 1, Address: "b"}},
+			Sequencers: []Node{{ID: 0, Address: "c"}},
+			Clients:    []Client{{ID: 0, Servers: []uint64{0, 1, 2}}},
+		}, ""},
+		{"duplicate server ID", Cluster{Servers: []Node{{ID: 1, Address: "a"}, {ID: 1, Address: "b"}}}, "more than one server has ID 1"},
+		{"sequencer on a server's address", Cluster{
+			Servers:    []Node{{ID: 0, Address: "a"}},
+			Sequencers: []Node{{ID: 0, Address: "a"}},
+		}, `server 0 and sequencer 0 share address "a"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cluster.Validate()
+			if tc.want == "" && err != nil {
+				t.Errorf("Validate() = %v; want nil", err)
+			}
+			if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+				t.Errorf("Validate() = %v; want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestHarnessConfigsAreValid(t *testing.T) {
+	for _, harness := range []string{"abd", "paxos", "session_semantics"} {
+		data, err := os.ReadFile(filepath.Join("..", harness, "cmd", "config.json"))
+		if err != nil {
+			t.Fatalf("reading %s config: %v", harness, err)
+		}
+		if _, err := Parse(data); err != nil {
+			t.Errorf("%s config: %v", harness, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package errs defines the failure categories shared by the register clients. Clients wrap these
+// with details of the failed operation, so callers should match them with errors.Is.
+package errs
+
+import "errors"
+
+var (
+	// ErrTimeout is returned when an operation gives up waiting for servers to respond.
+	ErrTimeout = errors.New("operation timed out")
+
+	// ErrNoQuorum is returned when fewer than a quorum of servers respond to an operation.
+	ErrNoQuorum = errors.New("insufficient responses to achieve quorum")
+
+	// ErrDependencyNotMet is returned when servers respond but none has yet seen the operations
+	// the client's session depends on.
+	ErrDependencyNotMet = errors.New("no server satisfies the session's dependencies")
+
+	// ErrNoServerAvailable is returned when no server could be reached at all.
+	ErrNoServerAvailable = errors.New("no server available")
+
+	// ErrUnreachable is returned when a connection to a server can't be established.
+	ErrUnreachable = errors.New("server unreachable")
+
+	// ErrConnectionLost is returned when a server closes or resets the connection before it
+	// replies, e.g. because it crashed. The request may or may not have been applied.
+	ErrConnectionLost = errors.New("connection to server lost")
+
+	// ErrRemote is returned when a server handled a request but reported an error for it.
+	ErrRemote = errors.New("server returned an error")
+)
@@ -0,0 +1,124 @@
+// Package logging controls how much the registers log. Most packages log through the standard
+// library's log package, tagging each message with a level such as "[DEBUG]" or "[WARN]"; the
+// session servers also log through charmbracelet/log. SetLevel filters both by level, and Off
+// discards everything without formatting it, so benchmarks don't pay for logging at all.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"strings"
+	"sync"
+
+	charmlog "github.com/charmbracelet/log"
+)
+
+// Level is the least severe level of the messages that are logged.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	// Off logs nothing.
+	Off
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < Debug || l > Off {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level from its name, e.g. "debug" or "off". Matching is case-insensitive.
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(l), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return Warn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	mu     sync.Mutex
+	level            = Debug
+	output io.Writer = os.Stderr
+)
+
+// SetLevel logs only messages at level or above from then on. Messages from the standard
+// library's log package without a level tag count as Info.
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+	install()
+}
+
+// SetOutput sends the messages that pass the level to w from then on. It replaces the output of
+// both the standard library's log package and charmbracelet/log.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+	install()
+}
+
+// install points both loggers at output filtered by level. mu must be held.
+func install() {
+	switch level {
+	case Off:
+		// The standard logger skips formatting altogether when its output is io.Discard.
+		stdlog.SetOutput(io.Discard)
+		charmlog.SetOutput(io.Discard)
+		charmlog.SetLevel(charmlog.FatalLevel)
+		return
+	case Debug:
+		stdlog.SetOutput(output)
+	default:
+		stdlog.SetOutput(filter{w: output, level: level})
+	}
+	charmlog.SetOutput(output)
+	charmlog.SetLevel([]charmlog.Level{charmlog.DebugLevel, charmlog.InfoLevel, charmlog.WarnLevel, charmlog.ErrorLevel}[level])
+}
+
+// filter drops the standard logger's messages below level. The logger hands it one whole message
+// per Write.
+type filter struct {
+	w     io.Writer
+	level Level
+}
+
+var tags = [][]byte{[]byte("[DEBUG]"), []byte("[INFO]"), []byte("[WARN]"), []byte("[ERROR]")}
+
+func (f filter) Write(p []byte) (int, error) {
+	if messageLevel(p) < f.level {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// messageLevel returns the level of the tag at the first "[" in message, which follows the
+// logger's timestamp, or Info if there is no tag there.
+func messageLevel(message []byte) Level {
+	i := bytes.IndexByte(message, '[')
+	if i < 0 {
+		return Info
+	}
+	for l, tag := range tags {
+		if bytes.HasPrefix(message[i:], tag) {
+			return Level(l)
+		}
+	}
+	return Info
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	stdlog "log"
+	"os"
+	"strings"
+	"testing"
+
+	charmlog "github.com/charmbracelet/log"
+)
+
+// capture sends log output to a buffer at level for the rest of the test.
+func capture(t testing.TB, l Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(l)
+	t.Cleanup(func() {
+		SetOutput(os.Stderr)
+		SetLevel(Debug)
+	})
+	return &buf
+}
+
+func logEveryLevel() {
+	stdlog.Printf("[DEBUG] debug message")
+	stdlog.Printf("[INFO] info message")
+	stdlog.Printf("untagged message")
+	stdlog.Printf("[WARN] warn message")
+	stdlog.Printf("[ERROR] error message")
+	charmlog.Debug("charm debug message")
+	charmlog.Warn("charm warn message")
+}
+
+func TestLevelOffLogsNothing(t *testing.T) {
+	buf := capture(t, Off)
+	logEveryLevel()
+	if buf.Len() != 0 {
+		t.Errorf("logged %q at level off; want nothing", buf)
+	}
+}
+
+func TestLevelFiltersMessages(t *testing.T) {
+	buf := capture(t, Warn)
+	logEveryLevel()
+	out := buf.String()
+	for _, kept := range []string{"warn message", "error message", "charm warn message"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("level warn dropped %q from %q", kept, out)
+		}
+	}
+	for _, dropped := range []string{"debug message", "info message", "untagged message"} {
+		if strings.Contains(out, dropped) {
+			t.Errorf("level warn logged %q in %q", dropped, out)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error, Off} {
+		if parsed, err := ParseLevel(strings.ToUpper(l.String())); err != nil || parsed != l {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", strings.ToUpper(l.String()), parsed, err, l)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel accepted an unknown level")
+	}
+}
+
+// BenchmarkLogging logs a typical debug message at each level, to a sink that discards it. At
+// level off the message isn't even formatted.
+func BenchmarkLogging(b *testing.B) {
+	for _, l := range []Level{Debug, Warn, Off} {
+		b.Run(l.String(), func(b *testing.B) {
+			SetOutput(discard{})
+			SetLevel(l)
+			b.Cleanup(func() {
+				SetOutput(os.Stderr)
+				SetLevel(Debug)
+			})
+			for i := range b.N {
+				stdlog.Printf("[DEBUG] Server %d accepted proposal %d with value %d", 1, i, i*7)
+			}
+		})
+	}
+}
+
+// discard is a sink like io.Discard that the standard logger can't recognize and skip.
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return io.Discard.Write(p) }
@@ -1,23 +1,55 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/alanwang67/distributed_registers/errs"
 	"github.com/alanwang67/distributed_registers/paxos/protocol"
 	"github.com/alanwang67/distributed_registers/paxos/sequencer"
 	"github.com/alanwang67/distributed_registers/paxos/server"
 )
 
+// ErrNoQuorum is returned when fewer than a majority of servers respond to a read.
+var ErrNoQuorum = errs.ErrNoQuorum
+
+// ErrNotStabilized is returned when a majority responds to a read but still disagrees after the
+// allowed stabilization writes.
+var ErrNotStabilized = errors.New("no stable majority after stabilization")
+
+// ErrNoLeader is returned when a write can't find a leader willing to commit it.
+var ErrNoLeader = errors.New("no leader accepted the proposal")
+
+// ErrPreempted is returned when a consensus round loses to a concurrent proposal, either because
+// too many servers have promised a higher proposal number or because the accept phase was refused.
+var ErrPreempted = errors.New("consensus round preempted by a concurrent proposal")
+
+const (
+	defaultMaxStabilizationAttempts = 2
+
+	// linearizableReadAttempts bounds the consensus rounds a single linearizable read may run.
+	linearizableReadAttempts = 3
+)
+
 type Client struct {
 	Id         uint64
 	Servers    []*protocol.Connection
 	Sequencers []*protocol.Connection
 
+	// MaxStabilizationAttempts bounds the stabilization writes a single read may issue.
+	MaxStabilizationAttempts int
+	// StabilizationAttempts counts the stabilization writes issued across all reads.
+	StabilizationAttempts uint64
+	// LinearizableRead makes Read run a consensus round that re-proposes the current value instead
+	// of reading what each server last accepted, so the read reflects a chosen value.
+	LinearizableRead bool
+
 	chosen    bool
 	chosenVal uint64
+	leader    uint64
 }
 
 func New(id uint64, servers []*protocol.Connection, sequencers []*protocol.Connection) *Client {
@@ -26,8 +58,11 @@ func New(id uint64, servers []*protocol.Connection, sequencers []*protocol.Conne
 		Id:         id,
 		Servers:    servers,
 		Sequencers: sequencers,
-		chosen:     false,
-		chosenVal:  0,
+
+		MaxStabilizationAttempts: defaultMaxStabilizationAttempts,
+
+		chosen:    false,
+		chosenVal: 0,
 	}
 }
 
@@ -52,21 +87,10 @@ func (c *Client) Start() error {
 	const valueToWrite = 42 // Always write the same value
 
 	for i := 0; i < maxWrites && !c.chosen; i++ {
-		req := sequencer.ReqProposalNum{}
-		rep := sequencer.ReplyProposalNum{}
-
-		getPropStart := time.Now()
-		err := invokeSafe(*c.Sequencers[0], "Sequencer.GetProposalNumber", &req, &rep)
-		log.Printf("[DEBUG] Client %d: GetProposalNumber took %v", c.Id, time.Since(getPropStart))
-		if err != nil || rep.Count == 0 {
-			log.Printf("[ERROR] failed to get valid proposal number, retrying...")
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-
-		log.Printf("[INFO] Client %d attempting write with proposal %d, value %d", c.Id, rep.Count, valueToWrite)
+		log.Printf("[INFO] Client %d attempting write with value %d", c.Id, valueToWrite)
 		writeStart := time.Now()
-		if !c.writeOperation(rep.Count, valueToWrite) {
+		chosenVal, ok := c.proposeToLeader(valueToWrite)
+		if !ok {
 			log.Printf("[WARN] Client %d: writeOperation failed, took %v", c.Id, time.Since(writeStart))
 			retries++
 			if retries >= 3 {
@@ -82,20 +106,23 @@ func (c *Client) Start() error {
 		// Write succeeded
 		retries = 0
 		c.chosen = true
-		c.chosenVal = valueToWrite
+		c.chosenVal = chosenVal
 		log.Printf("[INFO] Client %d: Value %d chosen!", c.Id, c.chosenVal)
 
 		// Perform a few reads to check the stable majority
 		for j := 0; j < 3; j++ {
 			readStart := time.Now()
-			val := c.readOperation()
-			log.Printf("[INFO] Client %d read quorum value: %d (took %v)", c.Id, val, time.Since(readStart))
+			val, responses, hadMajority, err := c.readOperation()
+			log.Printf("[INFO] Client %d read quorum value: %d from %d responses, majority %v (took %v)",
+				c.Id, val, responses, hadMajority, time.Since(readStart))
+			if err != nil {
+				log.Printf("[WARN] Client %d: read failed: %v", c.Id, err)
+			}
 			fmt.Printf("value read: %d\n", val)
 			time.Sleep(200 * time.Millisecond)
 		}
 
 		break
-		time.Sleep(100 * time.Millisecond)
 	}
 
 	// Keep running to allow observation
@@ -104,31 +131,111 @@ func (c *Client) Start() error {
 	}
 }
 
+// Write proposes value through the leader and returns the value the register holds afterwards,
+// which differs from value if another proposal was chosen first.
+func (c *Client) Write(value uint64) (uint64, error) {
+	chosen, ok := c.proposeToLeader(value)
+	if !ok {
+		return 0, ErrNoLeader
+	}
+	return chosen, nil
+}
+
+// Read returns the value chosen by a majority of servers, as described for readOperation, or by
+// linearizableRead when LinearizableRead is set.
+func (c *Client) Read() (value uint64, responses int, hadMajority bool, err error) {
+	if c.LinearizableRead {
+		return c.linearizableRead()
+	}
+	return c.readOperation()
+}
+
+// proposeToLeader forwards a write to the leader, following LeaderHint redirects and moving on to
+// the next server when the presumed leader is unreachable. It returns the value that was chosen.
+func (c *Client) proposeToLeader(value uint64) (uint64, bool) {
+	req := server.ProposeRequest{Value: value}
+
+	for attempt := 0; attempt < 2*len(c.Servers); attempt++ {
+		rep := server.ProposeReply{}
+		err := invokeSafe(*c.Servers[c.leader], "Server.Propose", &req, &rep)
+		if err != nil {
+			c.leader = (c.leader + 1) % uint64(len(c.Servers))
+			continue
+		}
+		if rep.Succeeded {
+			log.Printf("[DEBUG] Client %d: leader %d committed value %d (prepared: %v)", c.Id, c.leader, rep.Value, rep.Prepared)
+			return rep.Value, true
+		}
+		if rep.LeaderHint != c.leader {
+			log.Printf("[DEBUG] Client %d: server %d redirected to leader %d", c.Id, c.leader, rep.LeaderHint)
+			c.leader = rep.LeaderHint
+		}
+	}
+
+	return 0, false
+}
+
+// writeOperation runs a full prepare and accept round for proposal ProposalNumber. It proposes the
+// highest-numbered value a prepare majority has already accepted, or value if they have accepted
+// nothing, and reports whether a majority accepted the proposal.
 func (c *Client) writeOperation(ProposalNumber uint64, value uint64) bool {
-	req := server.PrepareRequest{ProposalNumber: ProposalNumber}
+	log.Printf("[DEBUG] Client %d: Starting writeOperation with ProposalNumber=%d, Value=%d", c.Id, ProposalNumber, value)
+	prepareStart := time.Now()
+
+	accepted, found, _, err := c.prepare(ProposalNumber)
+	if err != nil {
+		log.Printf("[ERROR] writeOperation: prepare phase for proposal %d failed: %v", ProposalNumber, err)
+		return false
+	}
+	if found {
+		value = accepted
+	}
+	log.Printf("[DEBUG] writeOperation: prepare majority reached for proposal %d, proposing value %d (prepare took %v)",
+		ProposalNumber, value, time.Since(prepareStart))
+
+	acceptStart := time.Now()
+	if !c.accept(ProposalNumber, value) {
+		log.Printf("[ERROR] writeOperation: no majority in accept phase for proposal %d", ProposalNumber)
+		return false
+	}
+
+	log.Printf("[DEBUG] writeOperation: accept majority reached for proposal %d (accept took %v)", ProposalNumber, time.Since(acceptStart))
+	return true
+}
+
+// prepare runs the prepare phase for proposal n and waits until a majority has promised or a second
+// has passed. It returns the value of the highest-numbered proposal accepted by any server that
+// promised, whether one was found and how many servers responded. Once so many servers have
+// refused that a majority can no longer promise, it gives up early with ErrPreempted, since the
+// proposal is bound to fail; without a majority of responses it returns ErrNoQuorum.
+func (c *Client) prepare(n uint64) (value uint64, found bool, responses int, err error) {
+	req := server.PrepareRequest{ProposalNumber: n}
 	majority := (len(c.Servers) / 2) + 1
 
+	replied := 0
 	voted := 0
-	latestAcceptedProposalNumber := uint64(0)
-	latestAcceptedProposalData := value
+	refused := 0
+	latestNumber := uint64(0)
+	latestValue := uint64(0)
 	var l sync.Mutex
 	cond := sync.NewCond(&l)
 
-	log.Printf("[DEBUG] Client %d: Starting writeOperation with ProposalNumber=%d, Value=%d", c.Id, ProposalNumber, value)
-	prepareStart := time.Now()
-
-	// Prepare phase
 	for i := range c.Servers {
 		i := i
 		go func() {
 			rep := server.PrepareReply{}
 			err := invokeSafe(*c.Servers[i], "Server.PrepareRequest", &req, &rep)
 			l.Lock()
-			if err == nil {
+			replied++
+			switch {
+			case err != nil:
+			case !rep.Promised:
+				refused++
+			default:
 				voted++
-				if rep.LatestAcceptedProposalNumber > latestAcceptedProposalNumber {
-					latestAcceptedProposalNumber = rep.LatestAcceptedProposalNumber
-					latestAcceptedProposalData = rep.LatestAcceptedProposalData
+				if rep.LatestAcceptedProposalNumber > latestNumber {
+					latestNumber = rep.LatestAcceptedProposalNumber
+					latestValue = rep.LatestAcceptedProposalData
 				}
 			}
 			l.Unlock()
@@ -136,29 +243,39 @@ func (c *Client) writeOperation(ProposalNumber uint64, value uint64) bool {
 		}()
 	}
 
+	// Wake the wait below at the deadline even if no more replies arrive.
+	timer := time.AfterFunc(1*time.Second, cond.Broadcast)
+	defer timer.Stop()
+
 	l.Lock()
+	defer l.Unlock()
 	deadline := time.Now().Add(1 * time.Second)
-	for voted < majority {
-		remaining := time.Until(deadline)
-		if remaining <= 0 {
-			l.Unlock()
-			log.Printf("[ERROR] writeOperation timed out waiting for prepare majority (proposal %d)", ProposalNumber)
-			return false
-		}
+	for voted < majority && refused <= len(c.Servers)-majority && replied < len(c.Servers) && time.Until(deadline) > 0 {
 		cond.Wait()
 	}
-	l.Unlock()
 
-	if voted < majority {
-		log.Printf("[ERROR] writeOperation: no majority in prepare phase for proposal %d", ProposalNumber)
-		return false
+	responses = voted + refused
+	switch {
+	case voted >= majority:
+		return latestValue, latestNumber > 0, responses, nil
+	case refused > len(c.Servers)-majority:
+		return 0, false, responses, fmt.Errorf("%d of %d servers refused to promise proposal %d: %w", refused, len(c.Servers), n, ErrPreempted)
 	}
-	log.Printf("[DEBUG] writeOperation: prepare majority reached for proposal %d, proposing value %d (prepare took %v)",
-		ProposalNumber, latestAcceptedProposalData, time.Since(prepareStart))
+	err = fmt.Errorf("prepare for proposal %d got %d of %d promises, needed %d: %w", n, voted, len(c.Servers), majority, ErrNoQuorum)
+	if replied < len(c.Servers) {
+		err = fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+	} else if responses == 0 {
+		err = fmt.Errorf("%w: %w", errs.ErrNoServerAvailable, err)
+	}
+	return 0, false, responses, err
+}
+
+// accept runs the accept phase for proposal n with the given value against every server and reports
+// whether a majority accepted it.
+func (c *Client) accept(n uint64, value uint64) bool {
+	req := server.AcceptRequest{ProposalNumber: n, Value: value}
+	majority := (len(c.Servers) / 2) + 1
 
-	// Accept phase
-	acceptStart := time.Now()
-	acceptReq := server.AcceptRequest{ProposalNumber: ProposalNumber, Value: latestAcceptedProposalData}
 	acceptCount := 0
 	var wg sync.WaitGroup
 	var mu sync.Mutex
@@ -168,40 +285,43 @@ func (c *Client) writeOperation(ProposalNumber uint64, value uint64) bool {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			accRep := server.AcceptReply{}
-			err := invokeSafe(*c.Servers[i], "Server.AcceptProposal", &acceptReq, &accRep)
-			if err == nil && accRep.Succeeded {
+			rep := server.AcceptReply{}
+			err := invokeSafe(*c.Servers[i], "Server.AcceptProposal", &req, &rep)
+			if err == nil && rep.Succeeded {
 				mu.Lock()
 				acceptCount++
 				mu.Unlock()
 			}
 		}()
 	}
-
 	wg.Wait()
-	if acceptCount < majority {
-		log.Printf("[ERROR] writeOperation: no majority in accept phase for proposal %d (needed %d got %d)",
-			ProposalNumber, majority, acceptCount)
-		return false
-	}
 
-	log.Printf("[DEBUG] writeOperation: accept majority reached for proposal %d (accept took %v)", ProposalNumber, time.Since(acceptStart))
-	return true
+	return acceptCount >= majority
+}
+
+// nextProposalNumber fetches a fresh proposal number from the sequencer.
+func (c *Client) nextProposalNumber() (uint64, error) {
+	req := sequencer.ReqProposalNum{}
+	rep := sequencer.ReplyProposalNum{}
+	err := invokeSafe(*c.Sequencers[0], "Sequencer.GetProposalNumber", &req, &rep)
+	return rep.Count, err
 }
 
+// determineMajority reports whether some proposal number occurs at least total times in arr.
 func determineMajority(arr []uint64, total uint64) bool {
 	m := make(map[uint64]uint64)
 	for _, v := range arr {
 		m[v]++
 	}
-	for k, v := range m {
-		if k != 0 && v >= total {
+	for _, v := range m {
+		if v >= total {
 			return true
 		}
 	}
 	return false
 }
 
+// getMajority returns the most common proposal number in arr.
 func getMajority(arr []uint64) uint64 {
 	m := make(map[uint64]uint64)
 	for _, v := range arr {
@@ -211,7 +331,7 @@ func getMajority(arr []uint64) uint64 {
 	var result uint64
 	var occurrences uint64
 	for k, v := range m {
-		if v >= occurrences && k != 0 {
+		if v > occurrences || (v == occurrences && k > result) {
 			result = k
 			occurrences = v
 		}
@@ -219,16 +339,113 @@ func getMajority(arr []uint64) uint64 {
 	return result
 }
 
-func (c *Client) readOperation() uint64 {
+// readOperation reads the register from a quorum of servers. Besides the value it reports how many
+// servers responded and whether a majority of them agreed on the latest accepted proposal. When a
+// majority responds but disagrees, it writes back the most common value to stabilize the register
+// and reads again, at most MaxStabilizationAttempts times, after which it returns that best-effort
+// value with ErrNotStabilized. Without enough responses it returns ErrNoQuorum.
+func (c *Client) readOperation() (value uint64, responses int, hadMajority bool, err error) {
 	readStart := time.Now()
 	majority := (len(c.Servers) / 2) + 1
+
+	log.Printf("[DEBUG] Client %d: Starting readOperation", c.Id)
+	for attempt := 0; ; attempt++ {
+		var timedOut bool
+		value, responses, hadMajority, timedOut = c.readRound(majority)
+		if hadMajority {
+			log.Printf("[DEBUG] readOperation: stable majority read with value %d (took %v)", value, time.Since(readStart))
+			return value, responses, true, nil
+		}
+		if responses < majority {
+			log.Printf("[ERROR] readOperation: no majority among %d of %d responses (took %v)", responses, len(c.Servers), time.Since(readStart))
+			err := fmt.Errorf("read got %d of %d responses, needed %d in agreement: %w", responses, len(c.Servers), majority, ErrNoQuorum)
+			if timedOut {
+				err = fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+			} else if responses == 0 {
+				err = fmt.Errorf("%w: %w", errs.ErrNoServerAvailable, err)
+			}
+			return value, responses, false, err
+		}
+		if attempt >= c.MaxStabilizationAttempts {
+			log.Printf("[ERROR] readOperation: still no stable majority after %d stabilization attempts, returning %d (took %v)",
+				attempt, value, time.Since(readStart))
+			return value, responses, false, fmt.Errorf("read found no stable majority after %d stabilization attempts: %w", attempt, ErrNotStabilized)
+		}
+
+		// No stable majority: attempt stabilization
+		log.Printf("[DEBUG] readOperation: no stable majority found, attempting stabilization write with value %d (read took %v so far)",
+			value, time.Since(readStart))
+		c.StabilizationAttempts++
+		n, err := c.nextProposalNumber()
+		if err == nil {
+			stabStart := time.Now()
+			if !c.writeOperation(n, value) {
+				log.Printf("[ERROR] readOperation: stabilization write failed (attempted after %v total read time)", time.Since(readStart))
+			} else {
+				log.Printf("[DEBUG] readOperation: stabilization write succeeded (stabilization took %v, total read time %v)",
+					time.Since(stabStart), time.Since(readStart))
+			}
+		} else {
+			log.Printf("[ERROR] readOperation: failed to get new proposal number for stabilization: %v", err)
+		}
+	}
+}
+
+// linearizableRead reads the register through the log: it prepares a fresh proposal and, if a
+// majority has accepted a value, proposes that same value again so that the value it returns has
+// been chosen. A majority that has accepted nothing means nothing has been chosen yet, so the read
+// returns 0 without proposing, leaving the register open to writes. A round preempted by a
+// concurrent proposal, in either phase, is retried with a new, higher number, at most
+// linearizableReadAttempts times.
+func (c *Client) linearizableRead() (value uint64, responses int, hadMajority bool, err error) {
+	readStart := time.Now()
+
+	log.Printf("[DEBUG] Client %d: Starting linearizableRead", c.Id)
+	for attempt := 0; attempt < linearizableReadAttempts; attempt++ {
+		n, err := c.nextProposalNumber()
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("linearizable read: get proposal number: %w", err)
+		}
+
+		var found bool
+		value, found, responses, err = c.prepare(n)
+		if errors.Is(err, ErrPreempted) {
+			log.Printf("[WARN] linearizableRead: %v, retrying", err)
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] linearizableRead: prepare phase failed (took %v): %v", time.Since(readStart), err)
+			return 0, responses, false, fmt.Errorf("linearizable read: %w", err)
+		}
+		if !found {
+			log.Printf("[DEBUG] linearizableRead: nothing accepted by a majority, read 0 (took %v)", time.Since(readStart))
+			return 0, responses, true, nil
+		}
+		if c.accept(n, value) {
+			log.Printf("[DEBUG] linearizableRead: value %d chosen under proposal %d (took %v)", value, n, time.Since(readStart))
+			return value, responses, true, nil
+		}
+		log.Printf("[WARN] linearizableRead: proposal %d was preempted, retrying", n)
+	}
+
+	log.Printf("[ERROR] linearizableRead: preempted in all %d rounds (took %v)", linearizableReadAttempts, time.Since(readStart))
+	return 0, responses, false, fmt.Errorf("linearizable read after %d rounds: %w", linearizableReadAttempts, ErrPreempted)
+}
+
+// readRound asks every server for its latest accepted proposal and waits until a majority agrees,
+// every server has answered or a second has passed. It returns the most common value among the
+// responses, how many servers responded, whether a majority agreed and whether it stopped waiting
+// at the deadline. A majority that has never accepted anything agrees that the register is
+// unwritten and reads as 0.
+func (c *Client) readRound(majority int) (value uint64, responses int, agreed bool, timedOut bool) {
 	ct := 0
+	replied := 0
+	unaccepted := 0
 	values := make([]uint64, 0)
 	m := make(map[uint64]uint64)
 	var l sync.Mutex
 	cond := sync.NewCond(&l)
 
-	log.Printf("[DEBUG] Client %d: Starting readOperation", c.Id)
 	for i := range c.Servers {
 		i := i
 		go func() {
@@ -236,57 +453,41 @@ func (c *Client) readOperation() uint64 {
 			rep := server.ReadReply{}
 			err := invokeSafe(*c.Servers[i], "Server.QuorumRead", &req, &rep)
 			l.Lock()
+			replied++
 			if err == nil {
 				ct++
-				values = append(values, rep.ProposalNumber)
-				m[rep.ProposalNumber] = rep.Value
+				if rep.Accepted {
+					values = append(values, rep.ProposalNumber)
+					m[rep.ProposalNumber] = rep.Value
+				} else {
+					unaccepted++
+				}
 			}
 			l.Unlock()
 			cond.Broadcast()
 		}()
 	}
 
+	// Wake the wait below at the deadline even if no more replies arrive.
+	timer := time.AfterFunc(1*time.Second, cond.Broadcast)
+	defer timer.Stop()
+
 	l.Lock()
+	defer l.Unlock()
 	deadline := time.Now().Add(1 * time.Second)
 	for {
-		if ct >= majority && determineMajority(values, uint64(majority)) {
-			break
+		if unaccepted >= majority {
+			return 0, ct, true, false
 		}
-		remaining := time.Until(deadline)
-		if remaining <= 0 {
-			l.Unlock()
-			log.Printf("[ERROR] readOperation: timed out waiting for majority read (took %v)", time.Since(readStart))
-			return 0
+		// A majority agreeing settles the read as soon as it is reached, without waiting for
+		// the remaining servers or stabilizing.
+		agreed = determineMajority(values, uint64(majority))
+		if agreed || replied == len(c.Servers) {
+			return m[getMajority(values)], ct, agreed, false
 		}
-		cond.Wait()
-	}
-
-	r := getMajority(values)
-	retValue := m[r]
-	b := determineMajority(values, uint64(majority))
-	l.Unlock()
-
-	if !b {
-		// No stable majority: attempt stabilization
-		log.Printf("[DEBUG] readOperation: no stable majority found, attempting stabilization write with value %d (read took %v so far)",
-			retValue, time.Since(readStart))
-		req := sequencer.ReqProposalNum{}
-		rep := sequencer.ReplyProposalNum{}
-		err := invokeSafe(*c.Sequencers[0], "Sequencer.GetProposalNumber", &req, &rep)
-		if err == nil {
-			stabStart := time.Now()
-			if !c.writeOperation(rep.Count, retValue) {
-				log.Printf("[ERROR] readOperation: stabilization write failed (attempted after %v total read time)", time.Since(readStart))
-			} else {
-				log.Printf("[DEBUG] readOperation: stabilization write succeeded (stabilization took %v, total read time %v)",
-					time.Since(stabStart), time.Since(readStart))
-			}
-		} else {
-			log.Printf("[ERROR] readOperation: failed to get new proposal number for stabilization: %v", err)
+		if time.Until(deadline) <= 0 {
+			return m[getMajority(values)], ct, false, true
 		}
-	} else {
-		log.Printf("[DEBUG] readOperation: stable majority read with value %d (took %v)", retValue, time.Since(readStart))
+		cond.Wait()
 	}
-
-	return retValue
 }
@@ -0,0 +1,336 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/errs"
+	"github.com/alanwang67/distributed_registers/paxos/protocol"
+	"github.com/alanwang67/distributed_registers/paxos/sequencer"
+	"github.com/alanwang67/distributed_registers/paxos/server"
+)
+
+// freeAddr reserves an ephemeral local port and releases it for a server to bind.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newCluster starts a sequencer and the first up of n servers and returns a client configured with
+// all n addresses.
+func newCluster(t *testing.T, n, up int) *Client {
+	t.Helper()
+	seqs := []*protocol.Connection{serve(t, "Sequencer", sequencer.New(nil))}
+	conns := make([]*protocol.Connection, n)
+	for i := range conns {
+		conns[i] = &protocol.Connection{Network: "tcp", Address: freeAddr(t)}
+	}
+	for i := 0; i < up; i++ {
+		s := server.New(uint64(i), conns[i], conns, seqs)
+		go s.Start()
+		t.Cleanup(func() { s.Stop() })
+		waitReachable(t, conns[i])
+	}
+	return New(0, conns, seqs)
+}
+
+// seed makes the first up servers accept value under proposal 1.
+func seed(t *testing.T, c *Client, up int, value uint64) {
+	t.Helper()
+	for i := 0; i < up; i++ {
+		req := server.AcceptRequest{ProposalNumber: 1, Value: value}
+		if err := protocol.Invoke(*c.Servers[i], "Server.AcceptProposal", &req, &server.AcceptReply{}); err != nil {
+			t.Fatalf("seed server %d: %v", i, err)
+		}
+	}
+}
+
+func waitReachable(t *testing.T, conn *protocol.Connection) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if protocol.Invoke(*conn, "Server.Ping", &server.PingRequest{}, &server.PingReply{}) == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s never became reachable", conn.Address)
+}
+
+func TestReadWithoutMajority(t *testing.T) {
+	c := newCluster(t, 3, 1)
+	seed(t, c, 1, 8)
+
+	start := time.Now()
+	value, responses, hadMajority, err := c.readOperation()
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("readOperation() error = %v; want ErrNoQuorum", err)
+	}
+	if value != 8 || responses != 1 || hadMajority {
+		t.Errorf("readOperation() = %d, %d, %v; want the partial 8 from 1 response without a majority", value, responses, hadMajority)
+	}
+	// Every unreachable server fails fast, so the read shouldn't wait out its deadline.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("readOperation() took %v after every server had answered", elapsed)
+	}
+}
+
+// slowServer answers reads only after a delay longer than a read waits.
+type slowServer struct{}
+
+func (slowServer) QuorumRead(request *server.ReadRequest, reply *server.ReadReply) error {
+	time.Sleep(2 * time.Second)
+	return nil
+}
+
+func TestReadErrors(t *testing.T) {
+	if _, _, _, err := newCluster(t, 3, 0).readOperation(); !errors.Is(err, errs.ErrNoServerAvailable) || !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("readOperation() with every server down: error %v; want ErrNoServerAvailable and ErrNoQuorum", err)
+	}
+
+	slow := serve(t, "Server", slowServer{})
+	c := New(0, []*protocol.Connection{slow, slow, slow}, nil)
+	if _, _, _, err := c.readOperation(); !errors.Is(err, errs.ErrTimeout) || !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("readOperation() with unresponsive servers: error %v; want ErrTimeout and ErrNoQuorum", err)
+	}
+}
+
+func TestReadWithMajority(t *testing.T) {
+	c := newCluster(t, 3, 2)
+	seed(t, c, 2, 8)
+
+	value, responses, hadMajority, err := c.readOperation()
+	if err != nil || value != 8 || responses < 2 || !hadMajority {
+		t.Errorf("readOperation() = %d, %d, %v, %v; want 8 from a majority", value, responses, hadMajority, err)
+	}
+}
+
+func TestUnanimousReadReturnsEarly(t *testing.T) {
+	c := newCluster(t, 3, 2)
+	seed(t, c, 2, 8)
+	c.Servers[2] = serve(t, "Server", slowServer{})
+
+	start := time.Now()
+	value, responses, hadMajority, err := c.readOperation()
+	if err != nil || value != 8 || responses != 2 || !hadMajority {
+		t.Errorf("readOperation() = %d, %d, %v, %v; want 8 from the 2 agreeing servers", value, responses, hadMajority, err)
+	}
+	// The agreeing majority settles the read, so it neither waits for the slow server nor
+	// stabilizes.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("readOperation() took %v after a majority agreed", elapsed)
+	}
+	if c.StabilizationAttempts != 0 {
+		t.Errorf("readOperation() issued %d stabilization writes for a unanimous read", c.StabilizationAttempts)
+	}
+}
+
+// splitServer always reports its own accepted proposal and ignores accepts, like a server that
+// never converges with the rest of the cluster.
+type splitServer struct {
+	mu       sync.Mutex
+	proposal uint64
+	accepts  int
+}
+
+func (s *splitServer) QuorumRead(request *server.ReadRequest, reply *server.ReadReply) error {
+	reply.ProposalNumber = s.proposal
+	reply.Value = s.proposal * 10
+	reply.Accepted = true
+	return nil
+}
+
+func (s *splitServer) PrepareRequest(request *server.PrepareRequest, reply *server.PrepareReply) error {
+	reply.Promised = true
+	return nil
+}
+
+func (s *splitServer) AcceptProposal(request *server.AcceptRequest, reply *server.AcceptReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accepts++
+	reply.Succeeded = true
+	return nil
+}
+
+// serve registers rcvr under name on an ephemeral port.
+func serve(t *testing.T, name string, rcvr any) *protocol.Connection {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(name, rcvr); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	go srv.Accept(l)
+	return &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestReadStabilizationIsBounded(t *testing.T) {
+	split := []*splitServer{{proposal: 1}, {proposal: 2}, {proposal: 3}}
+	conns := make([]*protocol.Connection, len(split))
+	for i, s := range split {
+		conns[i] = serve(t, "Server", s)
+	}
+	seq := serve(t, "Sequencer", sequencer.New(nil))
+
+	c := New(0, conns, []*protocol.Connection{seq})
+	c.MaxStabilizationAttempts = 3
+
+	done := make(chan struct{})
+	var responses int
+	var hadMajority bool
+	var err error
+	go func() {
+		defer close(done)
+		_, responses, hadMajority, err = c.readOperation()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("readOperation kept stabilizing a persistently split cluster")
+	}
+
+	if !errors.Is(err, ErrNotStabilized) || hadMajority || responses != 3 {
+		t.Errorf("readOperation() = %d responses, majority %v, error %v; want 3 responses without a majority and ErrNotStabilized", responses, hadMajority, err)
+	}
+	if c.StabilizationAttempts != 3 {
+		t.Errorf("StabilizationAttempts = %d; want 3", c.StabilizationAttempts)
+	}
+	for i, s := range split {
+		if s.accepts != 3 {
+			t.Errorf("server %d received %d stabilization accepts; want 3", i, s.accepts)
+		}
+	}
+}
+
+func TestReadChosenZero(t *testing.T) {
+	c := newCluster(t, 3, 3)
+	seed(t, c, 3, 0)
+
+	rep := server.ReadReply{}
+	if err := protocol.Invoke(*c.Servers[0], "Server.QuorumRead", &server.ReadRequest{}, &rep); err != nil {
+		t.Fatalf("QuorumRead: %v", err)
+	}
+	if !rep.Accepted || rep.Value != 0 || rep.ProposalNumber != 1 {
+		t.Errorf("QuorumRead() = %+v; want the accepted value 0 under proposal 1", rep)
+	}
+
+	value, _, hadMajority, err := c.readOperation()
+	if err != nil || value != 0 || !hadMajority {
+		t.Errorf("readOperation() = %d, majority %v, error %v; want a stable 0", value, hadMajority, err)
+	}
+	if c.StabilizationAttempts != 0 {
+		t.Errorf("reading a chosen 0 issued %d stabilization writes", c.StabilizationAttempts)
+	}
+}
+
+func TestReadUnwrittenRegister(t *testing.T) {
+	c := newCluster(t, 3, 3)
+
+	value, _, hadMajority, err := c.readOperation()
+	if err != nil || value != 0 || !hadMajority {
+		t.Errorf("readOperation() = %d, majority %v, error %v; want 0 from a majority that accepted nothing", value, hadMajority, err)
+	}
+}
+
+func TestLinearizableReadDuringConcurrentWrites(t *testing.T) {
+	c := newCluster(t, 3, 3)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		writer := New(uint64(w+1), c.Servers, c.Sequencers)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if n, err := writer.nextProposalNumber(); err == nil {
+					writer.writeOperation(n, uint64(10*(w+1)+i))
+				}
+			}
+		}()
+	}
+
+	reads := make([][]uint64, 3)
+	for r := range reads {
+		reader := New(uint64(r+4), c.Servers, c.Sequencers)
+		reader.LinearizableRead = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if value, _, _, err := reader.Read(); err == nil {
+					reads[r] = append(reads[r], value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The racing proposals may all have been preempted, so settle the register with one more write,
+	// which keeps any value chosen already.
+	chosen, err := c.Write(99)
+	if err != nil {
+		t.Fatalf("Write(99) after the racing writes: %v", err)
+	}
+	c.LinearizableRead = true
+	if value, _, _, err := c.Read(); err != nil || value != chosen {
+		t.Fatalf("Read() after the writes = %d, %v; want the chosen %d", value, err, chosen)
+	}
+	for r, values := range reads {
+		seen := false
+		for _, value := range values {
+			switch {
+			case value != 0 && value != chosen:
+				t.Errorf("reader %d read %d, which was never chosen; the register settled on %d", r, value, chosen)
+			case value == 0 && seen:
+				t.Errorf("reader %d read the unwritten 0 after reading %d", r, chosen)
+			}
+			seen = seen || value != 0
+		}
+	}
+}
+
+func TestStaleProposalRetriedWithHigherNumber(t *testing.T) {
+	c := newCluster(t, 3, 3)
+
+	// Every server promises proposal 1, so the sequencer's first number is stale from then on.
+	for i, conn := range c.Servers {
+		for _, want := range []bool{true, false} {
+			rep := server.PrepareReply{}
+			if err := protocol.Invoke(*conn, "Server.PrepareRequest", &server.PrepareRequest{ProposalNumber: 1}, &rep); err != nil {
+				t.Fatalf("prepare server %d: %v", i, err)
+			}
+			if rep.Promised != want {
+				t.Fatalf("server %d replied Promised = %v to proposal 1; want %v", i, rep.Promised, want)
+			}
+		}
+	}
+
+	if _, _, _, err := c.prepare(1); !errors.Is(err, ErrPreempted) {
+		t.Errorf("prepare(1) error = %v; want ErrPreempted", err)
+	}
+
+	c.LinearizableRead = true
+	value, responses, hadMajority, err := c.Read()
+	if err != nil || value != 0 || responses < 2 || !hadMajority {
+		t.Errorf("Read() = %d, %d, %v, %v; want 0 from a majority after retrying", value, responses, hadMajority, err)
+	}
+	// The read drew the stale 1, abandoned it and succeeded with 2.
+	if n, err := c.nextProposalNumber(); err != nil || n != 3 {
+		t.Errorf("next proposal number = %d, %v; want 3 after the read used 1 and 2", n, err)
+	}
+}
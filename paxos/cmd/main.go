@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 
+	clusterconfig "github.com/alanwang67/distributed_registers/config"
 	"github.com/alanwang67/distributed_registers/paxos/client"
 	"github.com/alanwang67/distributed_registers/paxos/protocol"
 	"github.com/alanwang67/distributed_registers/paxos/sequencer"
@@ -27,6 +28,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("[ERROR] can't unmarshal JSON: %s", err)
 	}
+	if _, err := clusterconfig.Parse(config); err != nil {
+		log.Fatalf("[ERROR] invalid config: %s", err)
+	}
 
 	serversData, ok := data["servers"].([]interface{})
 	if !ok {
@@ -89,7 +93,7 @@ func main() {
 			log.Fatalf("[ERROR] Invalid server ID: %d", id)
 		}
 		log.Printf("[INFO] Starting server %d at %s", id, servers[id].Address)
-		err := server.New(id, servers[id], servers).Start()
+		err := server.New(id, servers[id], servers, sequencers).Start()
 		if err != nil {
 			log.Printf("[ERROR] Server %d failed: %v", id, err)
 		}
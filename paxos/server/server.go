@@ -6,27 +6,55 @@ import (
 	"net"
 	"net/rpc"
 	"sync"
+	"time"
 
 	"github.com/alanwang67/distributed_registers/paxos/protocol"
+	"github.com/alanwang67/distributed_registers/paxos/sequencer"
 )
 
 type Server struct {
 	Id                           uint64
 	Self                         *protocol.Connection
 	Peers                        []*protocol.Connection
+	Sequencers                   []*protocol.Connection
 	Accepted                     bool
 	LowestN                      uint64
 	LatestAcceptedProposalNumber uint64
 	LatestAcceptedProposalData   uint64
+	LeaderId                     uint64
+	Epoch                        uint64
+	LeaderLease                  time.Duration
 	mu                           sync.Mutex
+
+	// State used while this server is the leader. The leader prepares once per epoch with
+	// leaderN and then only runs accept phases for leaderValue.
+	proposeMu      sync.Mutex
+	prepared       bool
+	preparedEpoch  uint64
+	leaderN        uint64
+	leaderValue    uint64
+	leaderValueSet bool
+
+	lastHeartbeat time.Time
+	listener      net.Listener
+	done          chan struct{}
 }
 
+const (
+	defaultLeaderLease = 300 * time.Millisecond
+
+	// missedHeartbeats is how many heartbeat intervals fit in a lease; a follower that hears
+	// nothing for that long considers the leader dead.
+	missedHeartbeats = 3
+)
+
 type PrepareRequest struct {
 	ProposalNumber uint64
 }
 
 type PrepareReply struct {
 	ServerId                     uint64
+	Promised                     bool // false if the server had already promised this proposal number or a higher one
 	LatestAcceptedProposalNumber uint64
 	LatestAcceptedProposalData   uint64
 }
@@ -40,24 +68,58 @@ type AcceptReply struct {
 	Succeeded bool
 }
 
+type ProposeRequest struct {
+	Value uint64
+}
+
+type ProposeReply struct {
+	Succeeded  bool
+	Value      uint64
+	Prepared   bool
+	LeaderHint uint64
+}
+
+type HeartbeatRequest struct {
+	LeaderId uint64
+	Epoch    uint64
+}
+
+type HeartbeatReply struct {
+	Accepted bool
+	LeaderId uint64
+	Epoch    uint64
+}
+
+type PingRequest struct {
+}
+
+type PingReply struct {
+	ServerId uint64
+}
+
 type ReadRequest struct {
 }
 
 type ReadReply struct {
 	Value          uint64
 	ProposalNumber uint64
+	Accepted       bool // false if the server has never accepted a proposal, in which case Value is meaningless
 }
 
-// New creates and initializes a new Server instance with the given ID, self connection, and peer connections.
-func New(id uint64, self *protocol.Connection, peers []*protocol.Connection) *Server {
+// New creates and initializes a new Server instance with the given ID, self connection, peer connections
+// and the sequencers the server draws proposal numbers from while it is the leader.
+func New(id uint64, self *protocol.Connection, peers []*protocol.Connection, sequencers []*protocol.Connection) *Server {
 	s := &Server{
 		Id:                           id,
 		Self:                         self,
 		Peers:                        peers,
+		Sequencers:                   sequencers,
 		Accepted:                     false,
 		LowestN:                      0,
 		LatestAcceptedProposalNumber: 0,
 		LatestAcceptedProposalData:   0,
+		LeaderLease:                  defaultLeaderLease,
+		done:                         make(chan struct{}),
 	}
 	return s
 }
@@ -74,13 +136,19 @@ func (s *Server) HandleClientRequest(req *protocol.ClientRequest, reply *protoco
 	return nil
 }
 
+// PrepareRequest promises to accept no proposal numbered below request.ProposalNumber, provided the
+// server hasn't already promised that number or a higher one. Without a promise, Promised is false
+// and the proposer should back off and retry with a higher number.
 func (s *Server) PrepareRequest(request *PrepareRequest, reply *PrepareReply) error {
 	s.mu.Lock()
-	if s.LowestN < request.ProposalNumber {
-		s.LowestN = request.ProposalNumber
-	}
-
 	reply.ServerId = s.Id
+	if request.ProposalNumber <= s.LowestN {
+		log.Printf("[DEBUG] Server %d refused to promise proposal %d, having promised %d", s.Id, request.ProposalNumber, s.LowestN)
+		s.mu.Unlock()
+		return nil
+	}
+	s.LowestN = request.ProposalNumber
+	reply.Promised = true
 
 	if s.Accepted {
 		reply.LatestAcceptedProposalNumber = s.LatestAcceptedProposalNumber
@@ -91,26 +159,265 @@ func (s *Server) PrepareRequest(request *PrepareRequest, reply *PrepareReply) er
 	return nil
 }
 
+// AcceptProposal accepts the proposal unless the server has promised a higher proposal number, in
+// which case it replies without Succeeded and keeps what it had accepted before.
 func (s *Server) AcceptProposal(request *AcceptRequest, reply *AcceptReply) error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	log.Printf("[DEBUG] Server %d received AcceptProposal (N=%d, value=%d)", s.Id, request.ProposalNumber, request.Value)
-	if s.LowestN <= request.ProposalNumber {
-		s.LatestAcceptedProposalNumber = request.ProposalNumber
-		s.LatestAcceptedProposalData = request.Value
-		s.LowestN = max(s.LowestN, request.ProposalNumber)
-		s.Accepted = true
-		reply.Succeeded = true
+	if request.ProposalNumber < s.LowestN {
+		log.Printf("[DEBUG] Server %d rejected proposal %d, having promised %d", s.Id, request.ProposalNumber, s.LowestN)
+		reply.Succeeded = false
+		return nil
 	}
-	s.mu.Unlock()
+
+	s.LatestAcceptedProposalNumber = request.ProposalNumber
+	s.LatestAcceptedProposalData = request.Value
+	s.LowestN = request.ProposalNumber
+	s.Accepted = true
+	reply.Succeeded = true
 	log.Printf("[DEBUG] Server %d accepted proposal %d with value %d", s.Id, request.ProposalNumber, request.Value)
 	return nil
 }
 
+// Ping lets peers check that this server is alive.
+func (s *Server) Ping(request *PingRequest, reply *PingReply) error {
+	reply.ServerId = s.Id
+	return nil
+}
+
+// Heartbeat is sent by the leader to renew its lease on followers. A heartbeat from a higher epoch,
+// or from a lower-ID leader in the same epoch, is accepted and makes the sender this server's leader.
+func (s *Server) Heartbeat(request *HeartbeatRequest, reply *HeartbeatReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if request.Epoch > s.Epoch || (request.Epoch == s.Epoch && request.LeaderId <= s.LeaderId) {
+		if s.LeaderId != request.LeaderId {
+			log.Printf("[INFO] server %d now follows leader %d in epoch %d", s.Id, request.LeaderId, request.Epoch)
+		}
+		s.Epoch = request.Epoch
+		s.LeaderId = request.LeaderId
+		s.lastHeartbeat = time.Now()
+		reply.Accepted = true
+	}
+
+	reply.LeaderId = s.LeaderId
+	reply.Epoch = s.Epoch
+	return nil
+}
+
+// monitorLeader runs until the server is stopped. While leader, the server sends heartbeats to its
+// followers; as a follower, it contests leadership once the leader has missed a full lease.
+func (s *Server) monitorLeader() {
+	interval := s.LeaderLease / missedHeartbeats
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		isLeader := s.LeaderId == s.Id
+		expired := time.Since(s.lastHeartbeat) > s.LeaderLease
+		s.mu.Unlock()
+
+		if isLeader {
+			s.sendHeartbeats()
+		} else if expired {
+			s.electLeader()
+		}
+	}
+}
+
+// sendHeartbeats renews the leader's lease on every follower, stepping down if a follower
+// reports a newer leader.
+func (s *Server) sendHeartbeats() {
+	s.mu.Lock()
+	req := HeartbeatRequest{LeaderId: s.Id, Epoch: s.Epoch}
+	s.mu.Unlock()
+
+	for i := range s.Peers {
+		if uint64(i) == s.Id {
+			continue
+		}
+		rep := HeartbeatReply{}
+		if protocol.Invoke(*s.Peers[i], "Server.Heartbeat", &req, &rep) != nil || rep.Accepted {
+			continue
+		}
+
+		s.mu.Lock()
+		if rep.Epoch > s.Epoch || (rep.Epoch == s.Epoch && rep.LeaderId < s.LeaderId) {
+			log.Printf("[INFO] server %d steps down for leader %d in epoch %d", s.Id, rep.LeaderId, rep.Epoch)
+			s.Epoch = rep.Epoch
+			s.LeaderId = rep.LeaderId
+			s.lastHeartbeat = time.Now()
+		}
+		s.mu.Unlock()
+		return
+	}
+}
+
+// electLeader bumps the server's epoch and elects the lowest-ID server that answers a ping.
+func (s *Server) electLeader() {
+	leader := s.Id
+	for i := 0; i < int(s.Id) && i < len(s.Peers); i++ {
+		req := PingRequest{}
+		rep := PingReply{}
+		if protocol.Invoke(*s.Peers[i], "Server.Ping", &req, &rep) == nil {
+			leader = uint64(i)
+			break
+		}
+	}
+
+	s.mu.Lock()
+	s.Epoch++
+	log.Printf("[INFO] server %d lost leader %d, electing %d in epoch %d", s.Id, s.LeaderId, leader, s.Epoch)
+	s.LeaderId = leader
+	s.lastHeartbeat = time.Now()
+	s.mu.Unlock()
+}
+
+// Propose is called by clients to write a value through the leader. Non-leaders reply with a
+// LeaderHint instead. The leader runs a prepare phase only once per epoch; later proposals
+// reuse the prepared proposal number and only run the accept phase.
+func (s *Server) Propose(request *ProposeRequest, reply *ProposeReply) error {
+	s.proposeMu.Lock()
+	defer s.proposeMu.Unlock()
+
+	s.mu.Lock()
+	leader, epoch := s.LeaderId, s.Epoch
+	s.mu.Unlock()
+
+	reply.LeaderHint = leader
+	if leader != s.Id {
+		return nil
+	}
+	if s.preparedEpoch != epoch {
+		s.prepared = false
+		s.preparedEpoch = epoch
+	}
+
+	if !s.prepared {
+		n, err := s.nextProposalNumber()
+		if err != nil {
+			log.Printf("[ERROR] server %d failed to get a proposal number: %v", s.Id, err)
+			return nil
+		}
+		value, found, ok := s.prepare(n)
+		if !ok {
+			log.Printf("[ERROR] server %d: no majority in prepare phase for proposal %d", s.Id, n)
+			return nil
+		}
+		s.prepared = true
+		s.leaderN = n
+		s.leaderValue = value
+		s.leaderValueSet = found
+		reply.Prepared = true
+	}
+
+	if !s.leaderValueSet {
+		s.leaderValue = request.Value
+		s.leaderValueSet = true
+	}
+
+	if !s.accept(s.leaderN, s.leaderValue) {
+		log.Printf("[ERROR] server %d: no majority in accept phase for proposal %d", s.Id, s.leaderN)
+		s.prepared = false
+		return nil
+	}
+
+	reply.Succeeded = true
+	reply.Value = s.leaderValue
+	return nil
+}
+
+// nextProposalNumber fetches a fresh proposal number from the sequencer.
+func (s *Server) nextProposalNumber() (uint64, error) {
+	req := sequencer.ReqProposalNum{}
+	rep := sequencer.ReplyProposalNum{}
+	err := protocol.Invoke(*s.Sequencers[0], "Sequencer.GetProposalNumber", &req, &rep)
+	return rep.Count, err
+}
+
+// prepare runs the prepare phase for proposal n against all peers. It returns the value of the
+// highest-numbered proposal accepted by any peer that promised, whether one was found, and whether
+// a majority promised.
+func (s *Server) prepare(n uint64) (uint64, bool, bool) {
+	req := PrepareRequest{ProposalNumber: n}
+	majority := (len(s.Peers) / 2) + 1
+
+	voted := 0
+	found := false
+	latestNumber := uint64(0)
+	latestValue := uint64(0)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := range s.Peers {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rep := PrepareReply{}
+			err := protocol.Invoke(*s.Peers[i], "Server.PrepareRequest", &req, &rep)
+			if err != nil || !rep.Promised {
+				return
+			}
+			mu.Lock()
+			voted++
+			if rep.LatestAcceptedProposalNumber > latestNumber {
+				found = true
+				latestNumber = rep.LatestAcceptedProposalNumber
+				latestValue = rep.LatestAcceptedProposalData
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return latestValue, found, voted >= majority
+}
+
+// accept runs the accept phase for proposal n with the given value against all peers and reports
+// whether a majority accepted it.
+func (s *Server) accept(n uint64, value uint64) bool {
+	req := AcceptRequest{ProposalNumber: n, Value: value}
+	majority := (len(s.Peers) / 2) + 1
+
+	acceptCount := 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := range s.Peers {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rep := AcceptReply{}
+			err := protocol.Invoke(*s.Peers[i], "Server.AcceptProposal", &req, &rep)
+			if err == nil && rep.Succeeded {
+				mu.Lock()
+				acceptCount++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return acceptCount >= majority
+}
+
 func (s *Server) QuorumRead(request *ReadRequest, reply *ReadReply) error {
 	s.mu.Lock()
-	if s.LatestAcceptedProposalData > 0 {
+	if s.Accepted {
 		reply.Value = s.LatestAcceptedProposalData
 		reply.ProposalNumber = s.LatestAcceptedProposalNumber
+		reply.Accepted = true
 	}
 	s.mu.Unlock()
 
@@ -127,10 +434,32 @@ func (s *Server) Start() error {
 	defer l.Close()
 	log.Printf("[DEBUG] server %d listening on %s", s.Id, s.Self.Address)
 
-	rpc.Register(s)
+	s.mu.Lock()
+	s.listener = l
+	s.lastHeartbeat = time.Now()
+	s.mu.Unlock()
+	go s.monitorLeader()
 
-	for {
-		rpc.Accept(l)
-		// some other stuff goes here...
+	srv := rpc.NewServer()
+	if err := srv.Register(s); err != nil {
+		return err
+	}
+
+	// Accept returns once the listener is closed by Stop.
+	srv.Accept(l)
+	return nil
+}
+
+// Stop closes the server's listener, making it unreachable to clients and peers, and stops
+// its heartbeats.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
 	}
+	close(s.done)
+	err := s.listener.Close()
+	s.listener = nil
+	return err
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/paxos/protocol"
+	"github.com/alanwang67/distributed_registers/paxos/sequencer"
+)
+
+const testLeaderLease = 150 * time.Millisecond
+
+// freeAddr reserves an ephemeral local port and releases it for a server to bind.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startCluster starts a sequencer and n servers on local ports and stops them when the test ends.
+func startCluster(t *testing.T, n int) ([]*Server, []*protocol.Connection) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	seqConn := &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+	seqServer := rpc.NewServer()
+	if err := seqServer.Register(sequencer.New(seqConn)); err != nil {
+		t.Fatalf("register sequencer: %v", err)
+	}
+	go seqServer.Accept(l)
+
+	conns := make([]*protocol.Connection, n)
+	for i := range conns {
+		conns[i] = &protocol.Connection{Network: "tcp", Address: freeAddr(t)}
+	}
+
+	servers := make([]*Server, n)
+	for i := range servers {
+		servers[i] = New(uint64(i), conns[i], conns, []*protocol.Connection{seqConn})
+		servers[i].LeaderLease = testLeaderLease
+		go servers[i].Start()
+		t.Cleanup(func() { servers[i].Stop() })
+	}
+
+	for _, conn := range conns {
+		waitReachable(t, conn)
+	}
+	return servers, conns
+}
+
+func waitReachable(t *testing.T, conn *protocol.Connection) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if protocol.Invoke(*conn, "Server.Ping", &PingRequest{}, &PingReply{}) == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s never became reachable", conn.Address)
+}
+
+func propose(t *testing.T, conn *protocol.Connection, value uint64) ProposeReply {
+	t.Helper()
+	reply := ProposeReply{}
+	if err := protocol.Invoke(*conn, "Server.Propose", &ProposeRequest{Value: value}, &reply); err != nil {
+		t.Fatalf("propose to %s: %v", conn.Address, err)
+	}
+	return reply
+}
+
+func TestLeaderSkipsPrepareAfterElection(t *testing.T) {
+	_, conns := startCluster(t, 3)
+
+	// A non-leader redirects to the lowest live server.
+	if reply := propose(t, conns[2], 42); reply.Succeeded || reply.LeaderHint != 0 {
+		t.Fatalf("non-leader reply = %+v; want a redirect to server 0", reply)
+	}
+
+	first := propose(t, conns[0], 42)
+	if !first.Succeeded || !first.Prepared || first.Value != 42 {
+		t.Fatalf("first proposal = %+v; want a prepared commit of 42", first)
+	}
+
+	second := propose(t, conns[0], 42)
+	if !second.Succeeded || second.Prepared {
+		t.Fatalf("second proposal = %+v; want a commit with only an accept phase", second)
+	}
+}
+
+func TestLeaderFailureTriggersReelection(t *testing.T) {
+	servers, conns := startCluster(t, 3)
+
+	if reply := propose(t, conns[0], 7); !reply.Succeeded {
+		t.Fatalf("proposal to initial leader failed: %+v", reply)
+	}
+
+	servers[0].Stop()
+	stopped := time.Now()
+
+	// Followers keep redirecting to the dead leader until its lease runs out, after which
+	// server 1 must take over within a few heartbeat intervals.
+	var reply ProposeReply
+	for {
+		reply = propose(t, conns[1], 7)
+		if reply.Succeeded {
+			break
+		}
+		if time.Since(stopped) > 5*testLeaderLease {
+			t.Fatalf("no new leader within %v of the leader failing: %+v", 5*testLeaderLease, reply)
+		}
+		time.Sleep(testLeaderLease / missedHeartbeats)
+	}
+
+	if reply.LeaderHint != 1 {
+		t.Errorf("new leader = %d; want 1", reply.LeaderHint)
+	}
+	if !reply.Prepared {
+		t.Errorf("new leader committed without preparing its own proposal number")
+	}
+	if reply.Value != 7 {
+		t.Errorf("new leader chose %d; want the previously chosen 7", reply.Value)
+	}
+
+	// Server 2 learns of the new leader from its heartbeats.
+	time.Sleep(testLeaderLease)
+	if reply := propose(t, conns[2], 7); reply.Succeeded || reply.LeaderHint != 1 {
+		t.Errorf("server 2 reply = %+v; want a redirect to server 1", reply)
+	}
+}
+
+func TestHeartbeatFromStaleEpochRejected(t *testing.T) {
+	s := New(1, nil, nil, nil)
+	s.Epoch = 3
+	s.LeaderId = 2
+
+	reply := HeartbeatReply{}
+	s.Heartbeat(&HeartbeatRequest{LeaderId: 0, Epoch: 2}, &reply)
+	if reply.Accepted || s.LeaderId != 2 {
+		t.Errorf("stale heartbeat accepted: reply %+v, leader %d", reply, s.LeaderId)
+	}
+
+	s.Heartbeat(&HeartbeatRequest{LeaderId: 2, Epoch: 4}, &reply)
+	if !reply.Accepted || s.Epoch != 4 {
+		t.Errorf("newer heartbeat rejected: reply %+v, epoch %d", reply, s.Epoch)
+	}
+}
+
+func TestAcceptRejectsProposalBelowPromise(t *testing.T) {
+	s := New(0, nil, nil, nil)
+	s.PrepareRequest(&PrepareRequest{ProposalNumber: 5}, &PrepareReply{})
+
+	reply := AcceptReply{}
+	s.AcceptProposal(&AcceptRequest{ProposalNumber: 3, Value: 7}, &reply)
+	if reply.Succeeded || s.Accepted {
+		t.Fatalf("proposal 3 accepted after promising 5: reply %+v, accepted %v", reply, s.Accepted)
+	}
+	read := ReadReply{}
+	s.QuorumRead(&ReadRequest{}, &read)
+	if read.Accepted {
+		t.Errorf("QuorumRead() = %+v after a rejected accept; want nothing accepted", read)
+	}
+
+	s.AcceptProposal(&AcceptRequest{ProposalNumber: 5, Value: 8}, &reply)
+	if !reply.Succeeded || s.LatestAcceptedProposalNumber != 5 || s.LatestAcceptedProposalData != 8 {
+		t.Errorf("promised proposal 5 not accepted: reply %+v, accepted %d with %d", reply, s.LatestAcceptedProposalNumber, s.LatestAcceptedProposalData)
+	}
+
+	s.AcceptProposal(&AcceptRequest{ProposalNumber: 4, Value: 9}, &reply)
+	if reply.Succeeded || s.LatestAcceptedProposalData != 8 {
+		t.Errorf("proposal 4 replaced the accepted proposal 5: reply %+v, value %d", reply, s.LatestAcceptedProposalData)
+	}
+}
+
+func TestPrepareRefusesStaleProposal(t *testing.T) {
+	s := New(0, nil, nil, nil)
+
+	for _, step := range []struct {
+		n        uint64
+		promised bool
+	}{{5, true}, {5, false}, {3, false}, {6, true}} {
+		reply := PrepareReply{}
+		s.PrepareRequest(&PrepareRequest{ProposalNumber: step.n}, &reply)
+		if reply.Promised != step.promised {
+			t.Errorf("PrepareRequest(%d) Promised = %v; want %v", step.n, reply.Promised, step.promised)
+		}
+	}
+	if s.LowestN != 6 {
+		t.Errorf("LowestN = %d; want 6", s.LowestN)
+	}
+}
@@ -0,0 +1,38 @@
+package register
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alanwang67/distributed_registers/abd/client"
+)
+
+// abdRegister adapts the ABD client.
+type abdRegister struct {
+	client *client.Client
+}
+
+func newABDRegister(cfg Config) *abdRegister {
+	servers := make([]map[string]interface{}, len(cfg.Servers))
+	for i, e := range cfg.Servers {
+		servers[i] = map[string]interface{}{"id": i, "network": e.Network, "address": e.Address}
+	}
+	return &abdRegister{client: &client.Client{ID: int(cfg.ClientId), Servers: servers}}
+}
+
+func (r *abdRegister) Read(ctx context.Context) (uint64, error) {
+	return run(ctx, func() (uint64, error) {
+		value, _, _, err := r.client.Read()
+		return uint64(value), err
+	})
+}
+
+func (r *abdRegister) Write(ctx context.Context, value uint64) error {
+	_, err := run(ctx, func() (struct{}, error) {
+		if ok, _ := r.client.Write(int(value)); !ok {
+			return struct{}{}, fmt.Errorf("abd write failed: %w", client.ErrNoQuorum)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
@@ -0,0 +1,126 @@
+// Package memregister runs a session-semantics cluster inside the process, so applications can
+// test against a Register without TCP listeners. The replicas are real session-semantics servers
+// and the registers real clients, connected by in-memory RPC, so session guarantees hold exactly
+// as they do against a deployed cluster.
+package memregister
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/register"
+	"github.com/alanwang67/distributed_registers/session_semantics/client"
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+var _ register.Register = (*Register)(nil)
+
+// Store is an in-memory cluster of replicas. It is safe for concurrent use.
+type Store struct {
+	servers []*server.Server
+	conns   []*protocol.Connection
+	rpc     map[string]*rpc.Server
+}
+
+// New starts a store of replicas servers. Replicas gossip their writes to each other every
+// staleness, so a replica may lag up to about that long behind a write made on another. With a
+// staleness of 0 replicas never gossip on their own: they stay apart until Sync is called, which
+// makes staleness deterministic in tests.
+func New(replicas int, staleness time.Duration) (*Store, error) {
+	st := &Store{rpc: make(map[string]*rpc.Server)}
+	st.conns = make([]*protocol.Connection, replicas)
+	for i := range st.conns {
+		st.conns[i] = &protocol.Connection{Network: "mem", Address: fmt.Sprintf("replica-%d", i)}
+	}
+
+	for i, conn := range st.conns {
+		config := server.Config{ClusterSize: replicas, Transport: st, GossipInterval: staleness}
+		if staleness == 0 {
+			// Stop would reject clients as well, so the loop is kept idle instead.
+			config.GossipInterval = time.Hour
+		}
+		s, err := server.NewWithConfig(uint64(i), conn, st.conns, config)
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("Server", s); err != nil {
+			st.Close()
+			return nil, err
+		}
+		st.servers = append(st.servers, s)
+		st.rpc[conn.Address] = srv
+	}
+	return st, nil
+}
+
+// Invoke carries an RPC to a replica over an in-memory connection, encoded as it would be on
+// the network, so replicas and clients never share memory.
+func (st *Store) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	srv, ok := st.rpc[conn.Address]
+	if !ok {
+		return fmt.Errorf("no replica at %s", conn.Address)
+	}
+	clientEnd, serverEnd := net.Pipe()
+	go srv.ServeConn(serverEnd)
+	c := rpc.NewClient(clientEnd)
+	defer c.Close()
+	return c.Call(method, args, reply)
+}
+
+// Sync makes every replica gossip its writes to every other, so all of them have every write
+// made so far.
+func (st *Store) Sync() {
+	for _, s := range st.servers {
+		s.Gossip()
+	}
+}
+
+// Close stops the replicas.
+func (st *Store) Close() {
+	for _, s := range st.servers {
+		s.Stop()
+	}
+}
+
+// Register is a client of the store that issues every operation under one session type.
+type Register struct {
+	store   *Store
+	client  *client.Client
+	session server.SessionType
+}
+
+// Register returns a new client of the store with its own session. Its operations go to any of
+// the given replicas, or to any replica if none are given.
+func (st *Store) Register(id uint64, session server.SessionType, replicas ...int) *Register {
+	r := &Register{store: st, client: client.New(id, st.conns), session: session}
+	r.client.Transport = st
+	if len(replicas) > 0 {
+		r.Pin(replicas...)
+	}
+	return r
+}
+
+// Pin restricts the register's operations to the given replicas, e.g. to move a session onto a
+// replica that has fallen behind it. It must not be called while an operation is in progress.
+func (r *Register) Pin(replicas ...int) {
+	servers := make([]*protocol.Connection, len(replicas))
+	for i, replica := range replicas {
+		servers[i] = r.store.conns[replica]
+	}
+	r.client.Servers = servers
+}
+
+func (r *Register) Read(ctx context.Context) (uint64, error) {
+	return r.client.ReadContext(ctx, r.session)
+}
+
+func (r *Register) Write(ctx context.Context, value uint64) error {
+	_, err := r.client.WriteContext(ctx, value, r.session)
+	return err
+}
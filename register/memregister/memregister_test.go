@@ -0,0 +1,82 @@
+package memregister
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/errs"
+	"github.com/alanwang67/distributed_registers/register"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+func newStore(t *testing.T, replicas int, staleness time.Duration) *Store {
+	t.Helper()
+	st, err := New(replicas, staleness)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
+
+func TestRegister(t *testing.T) {
+	st := newStore(t, 3, 0)
+	var r register.Register = st.Register(0, server.Causal)
+	ctx := context.Background()
+
+	if err := r.Write(ctx, 7); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if value, err := r.Read(ctx); err != nil || value != 7 {
+		t.Errorf("Read() = %d, %v; want 7", value, err)
+	}
+}
+
+func TestCausalReadNeedsDependency(t *testing.T) {
+	st := newStore(t, 2, 0)
+	ctx := context.Background()
+	r := st.Register(0, server.Causal, 0)
+	if err := r.Write(ctx, 5); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Replica 1 hasn't seen the session's write.
+	r.Pin(1)
+	if _, err := r.Read(ctx); !errors.Is(err, errs.ErrDependencyNotMet) {
+		t.Fatalf("Read() from a replica without the session's write: error %v; want ErrDependencyNotMet", err)
+	}
+	if value, err := st.Register(1, server.Eventual, 1).Read(ctx); err != nil || value != 0 {
+		t.Errorf("eventual Read() from the stale replica = %d, %v; want the stale 0", value, err)
+	}
+
+	st.Sync()
+	if value, err := r.Read(ctx); err != nil || value != 5 {
+		t.Errorf("Read() after Sync = %d, %v; want 5", value, err)
+	}
+}
+
+func TestStaleness(t *testing.T) {
+	st := newStore(t, 2, 10*time.Millisecond)
+	ctx := context.Background()
+	if err := st.Register(0, server.Causal, 0).Write(ctx, 9); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reader := st.Register(1, server.Eventual, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		value, err := reader.Read(ctx)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if value == 9 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica 1 still reads %d; want the write of 9 to have been gossiped", value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,51 @@
+package register
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alanwang67/distributed_registers/paxos/client"
+	"github.com/alanwang67/distributed_registers/paxos/protocol"
+)
+
+// paxosRegister adapts the paxos client. Paxos chooses a single value, so a write after a
+// different value was chosen fails.
+type paxosRegister struct {
+	client *client.Client
+	mu     sync.Mutex
+}
+
+func newPaxosRegister(cfg Config) *paxosRegister {
+	return &paxosRegister{client: client.New(cfg.ClientId, paxosConnections(cfg.Servers), paxosConnections(cfg.Sequencers))}
+}
+
+func paxosConnections(endpoints []Endpoint) []*protocol.Connection {
+	conns := make([]*protocol.Connection, len(endpoints))
+	for i, e := range endpoints {
+		conns[i] = &protocol.Connection{Network: e.Network, Address: e.Address}
+	}
+	return conns
+}
+
+func (r *paxosRegister) Read(ctx context.Context) (uint64, error) {
+	return run(ctx, func() (uint64, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		value, _, _, err := r.client.Read()
+		return value, err
+	})
+}
+
+func (r *paxosRegister) Write(ctx context.Context, value uint64) error {
+	_, err := run(ctx, func() (struct{}, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		chosen, err := r.client.Write(value)
+		if err == nil && chosen != value {
+			err = fmt.Errorf("paxos register already holds %d", chosen)
+		}
+		return struct{}{}, err
+	})
+	return err
+}
@@ -0,0 +1,86 @@
+// Package register puts the session-semantics, ABD and paxos clients behind one Register
+// interface, so applications and experiments can switch backends through configuration.
+package register
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alanwang67/distributed_registers/errs"
+)
+
+// Register is a single replicated value.
+type Register interface {
+	Read(ctx context.Context) (uint64, error)
+	Write(ctx context.Context, value uint64) error
+}
+
+// Endpoint is the network address of a server or sequencer.
+type Endpoint struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// Config describes the cluster a Register talks to. Fields a backend doesn't use are ignored.
+type Config struct {
+	ClientId   uint64     `json:"client_id"`
+	Servers    []Endpoint `json:"servers"`
+	Sequencers []Endpoint `json:"sequencers"` // paxos only
+	Session    string     `json:"session"`    // session semantics only; defaults to Causal
+}
+
+// NewRegister returns a Register backed by the protocol named by kind: "session", "abd" or "paxos".
+func NewRegister(kind string, cfg Config) (Register, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("%s register needs at least one server", kind)
+	}
+
+	switch kind {
+	case "session":
+		return newSessionRegister(cfg)
+	case "abd":
+		return newABDRegister(cfg), nil
+	case "paxos":
+		if len(cfg.Sequencers) == 0 {
+			return nil, fmt.Errorf("paxos register needs at least one sequencer")
+		}
+		return newPaxosRegister(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown register kind %q", kind)
+	}
+}
+
+// run calls op and waits for it or for ctx to be done. The protocol clients can't be interrupted,
+// so an abandoned op keeps running in the background and its result is discarded.
+func run[T any](ctx context.Context, op func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, contextError(err)
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := op()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, contextError(ctx.Err())
+	}
+}
+
+// contextError reports an expired deadline as errs.ErrTimeout, like the clients' own timeouts.
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+	}
+	return err
+}
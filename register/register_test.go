@@ -0,0 +1,168 @@
+package register
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	abdserver "github.com/alanwang67/distributed_registers/abd/server"
+	"github.com/alanwang67/distributed_registers/errs"
+	paxosprotocol "github.com/alanwang67/distributed_registers/paxos/protocol"
+	"github.com/alanwang67/distributed_registers/paxos/sequencer"
+	paxosserver "github.com/alanwang67/distributed_registers/paxos/server"
+	sessionprotocol "github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	sessionserver "github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+var (
+	_ Register = (*sessionRegister)(nil)
+	_ Register = (*abdRegister)(nil)
+	_ Register = (*paxosRegister)(nil)
+)
+
+// freeEndpoints reserves n ephemeral local ports and releases them for servers to bind.
+func freeEndpoints(t *testing.T, n int) []Endpoint {
+	t.Helper()
+	endpoints := make([]Endpoint, n)
+	for i := range endpoints {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		endpoints[i] = Endpoint{Network: "tcp", Address: l.Addr().String()}
+		l.Close()
+	}
+	return endpoints
+}
+
+func waitReachable(t *testing.T, e Endpoint) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial(e.Network, e.Address); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s never became reachable", e.Address)
+}
+
+func startSessionCluster(t *testing.T, n int) Config {
+	t.Helper()
+	cfg := Config{Servers: freeEndpoints(t, n)}
+	conns := make([]*sessionprotocol.Connection, n)
+	for i, e := range cfg.Servers {
+		conns[i] = &sessionprotocol.Connection{Network: e.Network, Address: e.Address}
+	}
+	for i := range conns {
+		s := sessionserver.New(uint64(i), conns[i], conns)
+		go s.Start()
+		t.Cleanup(func() { s.Stop() })
+		waitReachable(t, cfg.Servers[i])
+	}
+	return cfg
+}
+
+func startABDCluster(t *testing.T, n int) Config {
+	t.Helper()
+	cfg := Config{Servers: freeEndpoints(t, n)}
+	for i, e := range cfg.Servers {
+		go abdserver.NewServer(i, e.Address, nil).Start()
+		waitReachable(t, e)
+	}
+	return cfg
+}
+
+func startPaxosCluster(t *testing.T, n int) Config {
+	t.Helper()
+	cfg := Config{Servers: freeEndpoints(t, n), Sequencers: freeEndpoints(t, 1)}
+
+	seqConn := &paxosprotocol.Connection{Network: cfg.Sequencers[0].Network, Address: cfg.Sequencers[0].Address}
+	l, err := net.Listen(seqConn.Network, seqConn.Address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	seqServer := rpc.NewServer()
+	if err := seqServer.Register(sequencer.New(seqConn)); err != nil {
+		t.Fatalf("register sequencer: %v", err)
+	}
+	go seqServer.Accept(l)
+
+	conns := paxosConnections(cfg.Servers)
+	for i := range conns {
+		s := paxosserver.New(uint64(i), conns[i], conns, []*paxosprotocol.Connection{seqConn})
+		go s.Start()
+		t.Cleanup(func() { s.Stop() })
+		waitReachable(t, cfg.Servers[i])
+	}
+	return cfg
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		kind  string
+		start func(*testing.T, int) Config
+	}{
+		{"session", startSessionCluster},
+		{"abd", startABDCluster},
+		{"paxos", startPaxosCluster},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			r, err := NewRegister(tc.kind, tc.start(t, 3))
+			if err != nil {
+				t.Fatalf("NewRegister(%q): %v", tc.kind, err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := r.Write(ctx, 17); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if value, err := r.Read(ctx); err != nil || value != 17 {
+				t.Errorf("Read() = %d, %v; want 17", value, err)
+			}
+		})
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	// A server that accepts connections but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	r, err := NewRegister("session", Config{Servers: []Endpoint{{Network: "tcp", Address: l.Addr().String()}}})
+	if err != nil {
+		t.Fatalf("NewRegister: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Read(ctx); !errors.Is(err, errs.ErrTimeout) {
+		t.Errorf("Read() error = %v; want ErrTimeout", err)
+	}
+}
+
+func TestNewRegisterRejectsBadConfig(t *testing.T) {
+	servers := []Endpoint{{Network: "tcp", Address: "127.0.0.1:1"}}
+	for _, tc := range []struct {
+		kind string
+		cfg  Config
+	}{
+		{"linearizable", Config{Servers: servers}},
+		{"abd", Config{}},
+		{"paxos", Config{Servers: servers}},
+		{"session", Config{Servers: servers, Session: "strong"}},
+	} {
+		if _, err := NewRegister(tc.kind, tc.cfg); err == nil {
+			t.Errorf("NewRegister(%q, %+v) succeeded; want an error", tc.kind, tc.cfg)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package register
+
+import (
+	"context"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/client"
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+// sessionRegister adapts the session-semantics client, issuing every operation under one session type.
+type sessionRegister struct {
+	client  *client.Client
+	session server.SessionType
+}
+
+func newSessionRegister(cfg Config) (*sessionRegister, error) {
+	session := server.Causal
+	if cfg.Session != "" {
+		var err error
+		if session, err = server.ParseSessionType(cfg.Session); err != nil {
+			return nil, err
+		}
+	}
+
+	servers := make([]*protocol.Connection, len(cfg.Servers))
+	for i, e := range cfg.Servers {
+		servers[i] = &protocol.Connection{Network: e.Network, Address: e.Address}
+	}
+	return &sessionRegister{client: client.New(cfg.ClientId, servers), session: session}, nil
+}
+
+func (r *sessionRegister) Read(ctx context.Context) (uint64, error) {
+	return r.client.ReadContext(ctx, r.session)
+}
+
+func (r *sessionRegister) Write(ctx context.Context, value uint64) error {
+	_, err := r.client.WriteContext(ctx, value, r.session)
+	return err
+}
@@ -1,26 +1,99 @@
 package client
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"math/rand"
 	"os"
+	"slices"
 	"time"
 
+	"github.com/alanwang67/distributed_registers/errs"
 	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
 	"github.com/alanwang67/distributed_registers/session_semantics/server"
+	"github.com/alanwang67/distributed_registers/session_semantics/vectorclock"
 )
 
+// ErrInFlightLimit is returned, with FailFastInFlight set, when an operation would exceed the
+// client's MaxInFlight RPCs.
+var ErrInFlightLimit = errors.New("too many requests in flight")
+
+// defaultVirtualNodes is the number of points each server gets on the consistent hashing ring
+// when VirtualNodes isn't set.
+const defaultVirtualNodes = 100
+
+// readUntilMinBackoff and readUntilMaxBackoff bound the pause between the reads of ReadUntil.
+const (
+	readUntilMinBackoff = 5 * time.Millisecond
+	readUntilMaxBackoff = 100 * time.Millisecond
+)
+
+// flushPollInterval is how often Flush asks the servers for their clocks.
+const flushPollInterval = 10 * time.Millisecond
+
 // New creates and initializes a new Client instance.
 func New(id uint64, servers []*protocol.Connection) *Client {
 	log.Printf("[DEBUG] client %d created", id)
+	protocol.RegisterTypes()
 	return &Client{
-		Id:          id,
-		Servers:     servers,
-		ReadVector:  make([]uint64, len(servers)),
-		WriteVector: make([]uint64, len(servers)),
+		Id:                 id,
+		Servers:            servers,
+		ReadVector:         make([]uint64, len(servers)),
+		WriteVector:        make([]uint64, len(servers)),
+		Transport:          protocol.DefaultTransport,
+		DefaultSessionType: server.Causal,
+	}
+}
+
+// NewFromSeed creates a client like New, learning the servers of the cluster from seed, a single
+// server known to be part of it.
+func NewFromSeed(id uint64, seed *protocol.Connection) (*Client, error) {
+	servers, err := listPeers(protocol.DefaultTransport, seed)
+	if err != nil {
+		return nil, err
+	}
+	return New(id, servers), nil
+}
+
+// seedTimeout bounds how long SeedCluster waits for the cluster to converge.
+const seedTimeout = time.Minute
+
+// SeedCluster writes data to the cluster of servers and waits until every server has applied it,
+// so the cluster starts from a known value, the same at every server, before clients connect. It
+// fails if the write fails or the servers don't all converge within a minute.
+func SeedCluster(servers []*protocol.Connection, data uint64) error {
+	c := New(0, servers)
+	if _, err := c.Write(data, server.Causal); err != nil {
+		return fmt.Errorf("seeding cluster: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), seedTimeout)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		return fmt.Errorf("seeding cluster: %w", err)
+	}
+	return nil
+}
+
+// listPeers asks the server at conn for the cluster's membership.
+func listPeers(transport protocol.Transport, conn *protocol.Connection) ([]*protocol.Connection, error) {
+	protocol.RegisterTypes()
+	reply := server.ListPeersReply{}
+	if err := transport.Invoke(*conn, "Server.ListPeers", &server.ListPeersRequest{}, &reply); err != nil {
+		return nil, fmt.Errorf("listing peers of %s: %w", conn.Address, err)
+	}
+	for i, s := range reply.Servers {
+		if s == nil {
+			return nil, fmt.Errorf("listing peers of %s: no server with ID %d", conn.Address, i)
+		}
+	}
+	if len(reply.Servers) == 0 {
+		return nil, fmt.Errorf("listing peers of %s: empty membership", conn.Address)
 	}
+	return reply.Servers, nil
 }
 
 // Start executes client operations defined in the workload configuration file.
@@ -34,40 +107,77 @@ func (c *Client) Start(configPath string) error {
 		return err
 	}
 
+	if config.DefaultSessionType != "" {
+		c.DefaultSessionType, err = server.ParseSessionType(config.DefaultSessionType)
+		if err != nil {
+			log.Printf("[ERROR] Invalid default session type: %v", err)
+			return err
+		}
+	}
+
 	// Execute workload operations
-	for _, op := range config.Workloads {
-		c.mu.Lock()
+	if err := c.runWorkload(config.Workloads); err != nil {
+		return err
+	}
+
+	// Pause and then fetch operations from servers
+	time.Sleep(500 * time.Millisecond)
+	for i := range c.Servers {
+		clientReq := server.ClientRequest{}
+		clientReply := server.ClientReply{}
+		c.Transport.Invoke(*c.Servers[i], "Server.PrintOperations", &clientReq, &clientReply)
+		fmt.Printf("Client %d fetched operations from server %d\n", c.Id, i)
+	}
+
+	// Keep the client running indefinitely
+	for {
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// runWorkload performs the workload operations in order, each under its own session type or
+// the client's default.
+func (c *Client) runWorkload(workload []WorkloadOperation) error {
+	for _, op := range workload {
+		session, err := c.sessionFor(op)
+		if err != nil {
+			log.Printf("[ERROR] Invalid session type for %s operation: %v", op.Type, err)
+			return err
+		}
+
 		switch op.Type {
 		case "read":
-			resp := c.ReadFromServer(server.Causal)
+			resp := c.ReadFromServer(session)
 			fmt.Printf("Client %d performed read operation: Response = %v\n", c.Id, resp)
 		case "write":
-			resp := c.WriteToServer(op.Value, server.Causal)
+			resp := c.WriteToServer(op.Value, session)
 			fmt.Printf("Client %d performed write operation with value %d: Response = %v\n", c.Id, op.Value, resp)
 		default:
 			log.Printf("[WARN] Unknown operation type: %s", op.Type)
 		}
-		c.mu.Unlock()
 
 		// Apply delay if specified
 		if op.Delay > 0 {
-			time.Sleep(time.Duration(op.Delay) * time.Millisecond)
+			c.clock().Sleep(time.Duration(op.Delay) * time.Millisecond)
 		}
 	}
+	return nil
+}
 
-	// Pause and then fetch operations from servers
-	time.Sleep(500 * time.Millisecond)
-	for i := range c.Servers {
-		clientReq := server.ClientRequest{}
-		clientReply := server.ClientReply{}
-		protocol.Invoke(*c.Servers[i], "Server.PrintOperations", &clientReq, &clientReply)
-		fmt.Printf("Client %d fetched operations from server %d\n", c.Id, i)
+// clock returns the client's clock, or protocol.DefaultClock if it has none.
+func (c *Client) clock() protocol.Clock {
+	if c.Clock == nil {
+		return protocol.DefaultClock
 	}
+	return c.Clock
+}
 
-	// Keep the client running indefinitely
-	for {
-		time.Sleep(100 * time.Microsecond)
+// sessionFor returns the operation's own session type if it sets one, and the client's default otherwise.
+func (c *Client) sessionFor(op WorkloadOperation) (server.SessionType, error) {
+	if op.Session == "" {
+		return c.DefaultSessionType, nil
 	}
+	return server.ParseSessionType(op.Session)
 }
 
 // loadConfig reads and parses the workload configuration from a JSON file.
@@ -87,63 +197,500 @@ func loadConfig(configPath string) (*Config, error) {
 
 // WriteToServer performs a write operation on a server with the specified session type.
 func (c *Client) WriteToServer(value uint64, sessionSemantic server.SessionType) uint64 {
+	data, err := c.Write(value, sessionSemantic)
+	if err != nil {
+		// Panic if no servers could handle the request
+		panic("No servers were able to serve your request")
+	}
+	return data
+}
+
+// Write performs a write like WriteToServer but returns an error matching errs.ErrNoServerAvailable
+// or errs.ErrDependencyNotMet instead of panicking when no server accepts it, or errs.ErrTimeout
+// when it takes longer than OperationTimeout.
+func (c *Client) Write(value uint64, sessionSemantic server.SessionType) (uint64, error) {
+	return c.WriteContext(context.Background(), value, sessionSemantic)
+}
+
+// WriteContext performs a write like Write that gives up when ctx is done.
+func (c *Client) WriteContext(ctx context.Context, value uint64, sessionSemantic server.SessionType) (uint64, error) {
+	ctx, cancel := c.operationContext(ctx)
+	defer cancel()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	reply, err := c.write(ctx, value, sessionSemantic)
+	return reply.Data, err
+}
 
-	order := rand.Perm(len(c.Servers))
-	for _, v := range order {
-		clientReq := server.ClientRequest{
-			OperationType: server.Write,
-			SessionType:   sessionSemantic,
-			Data:          value,
-			ReadVector:    c.ReadVector,
-			WriteVector:   c.WriteVector,
-		}
+// WriteWithVersion performs a write like Write and returns the version vector the server assigned
+// it. Another client can wait for that version, e.g. by passing it as its read vector, to be sure
+// it reads the write.
+func (c *Client) WriteWithVersion(value uint64, sessionSemantic server.SessionType) (version []uint64, err error) {
+	ctx, cancel := c.operationContext(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply, err := c.write(ctx, value, sessionSemantic)
+	return slices.Clone(reply.WriteVector), err
+}
 
-		clientReply := server.ClientReply{}
+// WriteExpiring writes value like Write, but the value expires at expiresAt: reads from then on
+// find no value, with HasValue false in the server's reply. Servers expire it by their own
+// clocks until the tombstone from the accepting server reaches them, so clocks that disagree
+// make the value vanish at slightly different times on different servers.
+func (c *Client) WriteExpiring(value uint64, expiresAt time.Time, sessionSemantic server.SessionType) (uint64, error) {
+	ctx, cancel := c.operationContext(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clientReq := c.request(server.Write, sessionSemantic)
+	clientReq.Data = value
+	clientReq.ExpiresAt = expiresAt
+	reply, err := c.send(ctx, &clientReq)
+	if err != nil {
+		return 0, fmt.Errorf("write of %d expiring at %v: %w", value, expiresAt, err)
+	}
+	return reply.Data, nil
+}
 
-		// Invoke the server method
-		protocol.Invoke(*c.Servers[v], "Server.ProcessClientRequest", &clientReq, &clientReply)
+// GetSet writes value like Write and returns the value the register held just before. Reading the
+// old value and writing the new one are atomic on the server that accepts the write, but only
+// there: another replica may accept a concurrent write that replaces the same old value, and both
+// callers then see it. Use a linearizable register where that matters.
+func (c *Client) GetSet(value uint64, sessionSemantic server.SessionType) (old uint64, err error) {
+	ctx, cancel := c.operationContext(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply, err := c.write(ctx, value, sessionSemantic)
+	return reply.Previous, err
+}
 
-		if clientReply.Succeeded {
-			// Update client vectors if the operation succeeded
-			c.WriteVector = clientReply.WriteVector
-			c.ReadVector = clientReply.ReadVector
-			return clientReply.Data
-		}
+// operationContext bounds ctx by the client's OperationTimeout, if it has one.
+func (c *Client) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.OperationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.OperationTimeout)
+}
+
+// write tries every server in random order until one accepts the write, and returns its reply.
+// Callers must hold c.mu.
+func (c *Client) write(ctx context.Context, value uint64, sessionSemantic server.SessionType) (server.ClientReply, error) {
+	clientReq := c.request(server.Write, sessionSemantic)
+	clientReq.Data = value
+	clientReply, err := c.send(ctx, &clientReq)
+	if err != nil {
+		return server.ClientReply{}, fmt.Errorf("write of %d: %w", value, err)
 	}
+	return clientReply, nil
+}
 
-	// Panic if no servers could handle the request
-	panic("No servers were able to serve your request")
+// request builds a request carrying only the vectors the session's dependency check reads.
+// Callers must hold c.mu.
+func (c *Client) request(operation server.OperationType, sessionSemantic server.SessionType) server.ClientRequest {
+	clientReq := server.ClientRequest{
+		ProtocolVersion: server.ProtocolVersion,
+		OperationType:   operation,
+		SessionType:     sessionSemantic,
+		ClientId:        c.Id,
+	}
+	read, write := sessionSemantic.Vectors()
+	if read {
+		clientReq.ReadVector = c.ReadVector
+	}
+	if write {
+		clientReq.WriteVector = c.WriteVector
+	}
+	return clientReq
+}
+
+// regresses reports whether accepting the reply would move the client's read vector backward,
+// which a correct server never does. A request without the read vector can't be checked, and its
+// reply is merged into the read vector instead of replacing it.
+func (c *Client) regresses(clientReq *server.ClientRequest, reply server.ClientReply) bool {
+	if clientReq.ReadVector == nil {
+		return false
+	}
+	return len(reply.ReadVector) != len(c.ReadVector) || !vectorclock.CompareVersionVector(reply.ReadVector, c.ReadVector)
+}
+
+// adopt returns the client's new vector after a reply: the reply's if the request carried the
+// vector, and otherwise the client's own merged with whatever the reply reported.
+func adopt(mine, sent, replied []uint64) []uint64 {
+	if sent != nil {
+		return replied
+	}
+	if len(replied) != len(mine) {
+		return mine
+	}
+	return vectorclock.GetMaxVersionVector([][]uint64{mine, replied})
 }
 
 // ReadFromServer performs a read operation on a server with the specified session type.
 func (c *Client) ReadFromServer(sessionSemantic server.SessionType) uint64 {
+	value, _ := c.ReadWithFallback(sessionSemantic)
+	return value
+}
+
+// Read performs a read like ReadFromServer but returns an error matching errs.ErrNoServerAvailable
+// or errs.ErrDependencyNotMet instead of panicking when no server can serve it, or errs.ErrTimeout
+// when it takes longer than OperationTimeout.
+func (c *Client) Read(sessionSemantic server.SessionType) (uint64, error) {
+	return c.ReadContext(context.Background(), sessionSemantic)
+}
+
+// ReadContext performs a read like Read that gives up when ctx is done.
+func (c *Client) ReadContext(ctx context.Context, sessionSemantic server.SessionType) (uint64, error) {
+	ctx, cancel := c.operationContext(ctx)
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, _, err := c.read(ctx, sessionSemantic)
+	return value, err
+}
+
+// ReadWithVersion performs a read like Read and also returns the version vector of the value
+// read, which an application can use to order operations across registers itself.
+func (c *Client) ReadWithVersion(sessionSemantic server.SessionType) (value uint64, version []uint64, err error) {
+	ctx, cancel := c.operationContext(context.Background())
+	defer cancel()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.read(ctx, sessionSemantic)
+}
+
+// ReadUntil reads repeatedly under the session, backing off between reads, until the value
+// satisfies predicate and returns it. It is meant for waiting for another client's write to
+// reach this one. Reads that fail are retried too. After timeout it gives up with the last value
+// read and an error matching errs.ErrTimeout.
+func (c *Client) ReadUntil(predicate func(uint64) bool, sessionSemantic server.SessionType, timeout time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	order := rand.Perm(len(c.Servers))
-	for _, v := range order {
-		clientReq := server.ClientRequest{
-			OperationType: server.Read,
-			SessionType:   sessionSemantic,
-			ReadVector:    c.ReadVector,
-			WriteVector:   c.WriteVector,
+	var value uint64
+	backoff := readUntilMinBackoff
+	for {
+		v, err := c.ReadContext(ctx, sessionSemantic)
+		if err == nil {
+			if value = v; predicate(value) {
+				return value, nil
+			}
 		}
 
-		clientReply := server.ClientReply{}
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			if !errors.Is(err, errs.ErrTimeout) {
+				err = fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+			}
+			return value, fmt.Errorf("read until: value %d still unsatisfying after %v: %w", value, timeout, err)
+		case <-c.clock().After(backoff):
+		}
+		backoff = min(2*backoff, readUntilMaxBackoff)
+	}
+}
+
+// ReadWithFallback performs a read like ReadFromServer. If no server can satisfy the session and the
+// client has a FallbackSession configured for it, the read is retried under the weaker session,
+// and downgraded reports that the fallback was used.
+func (c *Client) ReadWithFallback(sessionSemantic server.SessionType) (value uint64, downgraded bool) {
+	ctx, cancel := c.operationContext(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value, _, err := c.read(ctx, sessionSemantic); err == nil {
+		return value, false
+	}
+
+	if fallback, ok := c.FallbackSession[sessionSemantic]; ok {
+		log.Printf("[WARN] client %d found no server for session %d, downgrading to session %d", c.Id, sessionSemantic, fallback)
+		if value, _, err := c.read(ctx, fallback); err == nil {
+			return value, true
+		}
+	}
+
+	// Panic if no servers could handle the request
+	panic("No servers were able to serve your request")
+}
+
+// read tries every server in random order until one serves the read, and returns the value with
+// the read vector of the reply. Callers must hold c.mu.
+func (c *Client) read(ctx context.Context, sessionSemantic server.SessionType) (uint64, []uint64, error) {
+	clientReq := c.request(server.Read, sessionSemantic)
+	clientReply, err := c.send(ctx, &clientReq)
+	if err != nil {
+		return 0, nil, fmt.Errorf("read: %w", err)
+	}
+	if len(clientReply.Siblings) > 1 && c.Resolver != nil {
+		return c.resolve(ctx, clientReply.Siblings), slices.Clone(clientReply.ReadVector), nil
+	}
+	return clientReply.Data, slices.Clone(clientReply.ReadVector), nil
+}
 
+// send tries every server in the client's preference order until one succeeds with the request,
+// then adopts the vectors of its reply. If none does, the error tells whether any server could be
+// reached at all. Callers must hold c.mu.
+func (c *Client) send(ctx context.Context, clientReq *server.ClientRequest) (server.ClientReply, error) {
+	unreachable := 0
+	order := c.order(clientReq.OperationType == server.Read)
+	if clientReq.OperationType == server.Write && c.ProbeFanout > 0 {
+		order = c.probe(ctx, clientReq, order)
+	}
+	for tried, v := range order {
 		// Invoke the server method
-		protocol.Invoke(*c.Servers[v], "Server.ProcessClientRequest", &clientReq, &clientReply)
+		c.attempts++
+		start := time.Now()
+		clientReply, err := c.invoke(ctx, c.Servers[v], clientReq)
+		if err == nil {
+			c.recordLatency(c.Servers[v].Address, time.Since(start))
+		}
+		if ctx.Err() != nil {
+			err := ctx.Err()
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+			}
+			return server.ClientReply{}, fmt.Errorf("gave up after trying %d of %d servers: %w", tried, len(c.Servers), err)
+		}
+		if errors.Is(err, ErrInFlightLimit) {
+			return server.ClientReply{}, err
+		}
+		if err != nil {
+			unreachable++
+			continue
+		}
+
+		if clientReply.Succeeded && c.regresses(clientReq, clientReply) {
+			log.Printf("[WARN] client %d rejected reply from server %d: read vector %v is behind %v", c.Id, v, clientReply.ReadVector, c.ReadVector)
+			continue
+		}
 
 		if clientReply.Succeeded {
 			// Update client vectors if the operation succeeded
-			c.WriteVector = clientReply.WriteVector
-			c.ReadVector = clientReply.ReadVector
-			return clientReply.Data
+			c.WriteVector = adopt(c.WriteVector, clientReq.WriteVector, clientReply.WriteVector)
+			c.ReadVector = adopt(c.ReadVector, clientReq.ReadVector, clientReply.ReadVector)
+			return clientReply, nil
 		}
 	}
 
-	// Panic if no servers could handle the request
-	panic("No servers were able to serve your request")
+	if unreachable == len(c.Servers) {
+		return server.ClientReply{}, fmt.Errorf("none of %d servers reachable: %w", len(c.Servers), errs.ErrNoServerAvailable)
+	}
+	return server.ClientReply{}, fmt.Errorf("%d of %d servers reachable: %w", len(c.Servers)-unreachable, len(c.Servers), errs.ErrDependencyNotMet)
+}
+
+// invoke sends clientReq to conn, returning early if ctx is done first. The RPC itself can't be
+// interrupted, so an abandoned one finishes in the background and its reply is discarded.
+func (c *Client) invoke(ctx context.Context, conn *protocol.Connection, clientReq *server.ClientRequest) (server.ClientReply, error) {
+	type result struct {
+		reply server.ClientReply
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		clientReply := server.ClientReply{}
+		err := c.call(ctx, conn, "Server.ProcessClientRequest", clientReq, &clientReply)
+		done <- result{clientReply, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return server.ClientReply{}, ctx.Err()
+	}
+}
+
+// call invokes method on conn through the client's Transport once fewer than MaxInFlight of the
+// client's RPCs are in flight. It waits for one to finish, unless ctx is done first or
+// FailFastInFlight is set, in which case it fails with ErrInFlightLimit.
+func (c *Client) call(ctx context.Context, conn *protocol.Connection, method string, args, reply any) error {
+	if c.MaxInFlight > 0 {
+		c.inFlightOnce.Do(func() { c.inFlight = make(chan struct{}, c.MaxInFlight) })
+		if c.FailFastInFlight {
+			select {
+			case c.inFlight <- struct{}{}:
+			default:
+				return fmt.Errorf("%s to %s: %w", method, conn.Address, ErrInFlightLimit)
+			}
+		} else {
+			select {
+			case c.inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		defer func() { <-c.inFlight }()
+	}
+	return c.Transport.Invoke(*conn, method, args, reply)
+}
+
+// Attempts returns how many requests the client has sent to servers so far, counting every
+// server an operation tried, whether it was unreachable, turned the request away or served it.
+// The difference across an operation tells how many tries it took.
+func (c *Client) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
+
+// probe asks the first ProbeFanout servers of order for their clocks at once and moves the first
+// one found to satisfy clientReq's dependencies to the front, so the request goes straight to a
+// fresh server instead of being turned away by stale ones in turn. It returns as soon as one
+// server is confirmed fresh, leaving the other probes to finish unread. If none is, order is
+// returned unchanged.
+func (c *Client) probe(ctx context.Context, clientReq *server.ClientRequest, order []int) []int {
+	probed := order[:min(c.ProbeFanout, len(order))]
+	width := max(len(clientReq.ReadVector), len(clientReq.WriteVector))
+	fresh := make(chan int, len(probed))
+	for _, v := range probed {
+		go func() {
+			reply := server.InspectReply{}
+			err := c.call(ctx, c.Servers[v], "Server.Inspect", &server.InspectRequest{}, &reply)
+			if err != nil || (width > 0 && len(reply.VectorClock) != width) || !server.DependencyCheck(reply.VectorClock, *clientReq) {
+				v = -1
+			}
+			fresh <- v
+		}()
+	}
+
+	for range probed {
+		select {
+		case v := <-fresh:
+			if v == -1 {
+				continue
+			}
+			return append([]int{v}, slices.DeleteFunc(slices.Clone(order), func(u int) bool { return u == v })...)
+		case <-ctx.Done():
+			return order
+		}
+	}
+	log.Printf("[DEBUG] client %d found none of %d probed servers fresh", c.Id, len(probed))
+	return order
+}
+
+// Flush blocks until every server's vector clock covers the client's writes so far, making them
+// visible to any session at any server, or until ctx is done.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	target := slices.Clone(c.WriteVector)
+	servers := slices.Clone(c.Servers)
+	c.mu.Unlock()
+
+	behind := servers
+	for {
+		var still []*protocol.Connection
+		for _, conn := range behind {
+			reply := server.InspectReply{}
+			err := c.call(ctx, conn, "Server.Inspect", &server.InspectRequest{}, &reply)
+			if err != nil || len(reply.VectorClock) != len(target) || !vectorclock.CompareVersionVector(reply.VectorClock, target) {
+				still = append(still, conn)
+			}
+		}
+		behind = still
+		if len(behind) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("flush: %d of %d servers behind write vector %v: %w", len(behind), len(servers), target, ctx.Err())
+		case <-c.clock().After(flushPollInterval):
+		}
+	}
+}
+
+// PrimaryFor returns the index of the server that operations on key are sent to first, or -1 if
+// the client has no servers.
+func (c *Client) PrimaryFor(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	order := c.preference(key)
+	if len(order) == 0 {
+		return -1
+	}
+	return order[0]
+}
+
+// vnode is a point on the consistent hashing ring, owned by the server at index server.
+type vnode struct {
+	hash   uint64
+	server int
+}
+
+// preference ranks the servers for key by walking the consistent hashing ring clockwise from the
+// key's hash. The ring is built from server addresses, so every client ranks a key's servers the
+// same way whatever order it lists them in, and a server going away only moves the keys it
+// ranked first. Callers must hold c.mu.
+func (c *Client) preference(key string) []int {
+	ring := c.hashRing()
+	order := make([]int, 0, len(c.Servers))
+	if len(ring) == 0 {
+		return order
+	}
+
+	ranked := make([]bool, len(c.Servers))
+	start, _ := slices.BinarySearchFunc(ring, hash(key), func(v vnode, h uint64) int {
+		return cmp.Compare(v.hash, h)
+	})
+	for i := 0; i < len(ring) && len(order) < len(c.Servers); i++ {
+		v := ring[(start+i)%len(ring)]
+		if !ranked[v.server] {
+			ranked[v.server] = true
+			order = append(order, v.server)
+		}
+	}
+	return order
+}
+
+// hashRing returns the ring of VirtualNodes points per server, rebuilding it when the servers
+// or the number of virtual nodes changed. Callers must hold c.mu.
+func (c *Client) hashRing() []vnode {
+	vnodes := c.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	if c.ringVirtualNodes == vnodes && slices.Equal(c.ringServers, c.Servers) {
+		return c.ring
+	}
+
+	ring := make([]vnode, 0, vnodes*len(c.Servers))
+	for i, conn := range c.Servers {
+		for n := 0; n < vnodes; n++ {
+			ring = append(ring, vnode{hash: hash(fmt.Sprintf("%s#%d", conn.Address, n)), server: i})
+		}
+	}
+	slices.SortFunc(ring, func(a, b vnode) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(c.Servers[a.server].Address, c.Servers[b.server].Address))
+	})
+	c.ring, c.ringServers, c.ringVirtualNodes = ring, slices.Clone(c.Servers), vnodes
+	return ring
+}
+
+// hash spreads s over the ring. FNV alone clusters similar strings like the names of one server's
+// virtual nodes, so its result is put through a finalizer that mixes every bit.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// resolve collapses concurrent siblings into the value the Resolver picks by writing it back.
+// The client's read vector already covers every sibling, so a causal write is ordered after all
+// of them. Callers must hold c.mu.
+func (c *Client) resolve(ctx context.Context, siblings []uint64) uint64 {
+	value := c.Resolver(siblings)
+	if _, err := c.write(ctx, value, server.Causal); err != nil {
+		log.Printf("[WARN] client %d could not write back %d resolved from siblings %v: %v", c.Id, value, siblings, err)
+	}
+	return value
 }
@@ -0,0 +1,1033 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/errs"
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+	"github.com/alanwang67/distributed_registers/session_semantics/vectorclock"
+)
+
+// mockServer answers client requests like a single, always up-to-date server and records them.
+type mockServer struct {
+	mu       sync.Mutex
+	data     uint64
+	requests []server.ClientRequest
+}
+
+func (m *mockServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, *request)
+	if request.OperationType == server.Write {
+		m.data = request.Data
+	}
+
+	reply.Succeeded = true
+	reply.OperationType = request.OperationType
+	reply.Data = m.data
+	reply.ReadVector = request.ReadVector
+	reply.WriteVector = request.WriteVector
+	return nil
+}
+
+// startMock serves m under the "Server" RPC name on an ephemeral port.
+func startMock(t *testing.T, m any) *protocol.Connection {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Server", m); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	go srv.Accept(l)
+
+	return &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestReplayTrace(t *testing.T) {
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+	trace := `[
+		{"Type": "write", "Value": 5, "Delay": 0},
+		{"Type": "read", "Value": 0, "Delay": 100},
+		{"Type": "write", "Value": 9, "Delay": 50}
+	]`
+	if err := os.WriteFile(path, []byte(trace), 0644); err != nil {
+		t.Fatalf("write trace: %v", err)
+	}
+
+	clock := protocol.NewFakeClock(time.Unix(0, 0))
+	c.Clock = clock
+	done := make(chan error, 1)
+	go func() { done <- ReplayTrace(c, path) }()
+
+	received := func() int {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		return len(mock.requests)
+	}
+
+	// Each operation is issued only once the clock has covered its delay.
+	for i, delay := range []time.Duration{100 * time.Millisecond, 50 * time.Millisecond} {
+		clock.BlockUntil(1)
+		if n := received(); n != i+1 {
+			t.Fatalf("mock received %d requests before the delay of operation %d; want %d", n, i+1, i+1)
+		}
+		clock.Advance(delay - time.Millisecond)
+		if n := received(); n != i+1 {
+			t.Fatalf("mock received %d requests 1ms before the delay of operation %d elapsed; want %d", n, i+1, i+1)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	expect := []server.ClientRequest{
+		{OperationType: server.Write, Data: 5},
+		{OperationType: server.Read},
+		{OperationType: server.Write, Data: 9},
+	}
+	if len(mock.requests) != len(expect) {
+		t.Fatalf("mock received %d requests; want %d", len(mock.requests), len(expect))
+	}
+	for i, req := range mock.requests {
+		if req.OperationType != expect[i].OperationType || req.Data != expect[i].Data {
+			t.Errorf("request %d = %+v; want %+v", i, req, expect[i])
+		}
+	}
+}
+
+func TestReplayTraceErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	down := &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+	l.Close()
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := os.WriteFile(path, []byte(`[{"Type": "write", "Value": 5, "Delay": 0}, {"Type": "read", "Value": 0, "Delay": 0}]`), 0644); err != nil {
+		t.Fatalf("write trace: %v", err)
+	}
+
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+	c.DefaultSessionType = server.MonotonicReads
+	if err := ReplayTrace(c, path); err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+	for i, req := range mock.requests {
+		if req.SessionType != server.MonotonicReads {
+			t.Errorf("request %d used session %v; want the client's default MonotonicReads", i, req.SessionType)
+		}
+	}
+
+	err = ReplayTrace(New(0, []*protocol.Connection{down}), path)
+	if !errors.Is(err, errs.ErrNoServerAvailable) || !strings.Contains(err.Error(), "trace operation 0") {
+		t.Errorf("ReplayTrace with every server down: error %v; want ErrNoServerAvailable for operation 0", err)
+	}
+}
+
+func TestReplayTraceRejectsUnknownOperation(t *testing.T) {
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if err := os.WriteFile(path, []byte(`[{"Type": "delete", "Value": 0, "Delay": 0}]`), 0644); err != nil {
+		t.Fatalf("write trace: %v", err)
+	}
+
+	if err := ReplayTrace(c, path); err == nil {
+		t.Errorf("ReplayTrace accepted an unknown operation type")
+	}
+	if len(mock.requests) != 0 {
+		t.Errorf("mock received %d requests; want none", len(mock.requests))
+	}
+}
+
+func TestWorkloadSessionTypes(t *testing.T) {
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+
+	if c.DefaultSessionType != server.Causal {
+		t.Errorf("DefaultSessionType = %v; want Causal", c.DefaultSessionType)
+	}
+	c.DefaultSessionType = server.MonotonicReads
+
+	err := c.runWorkload([]WorkloadOperation{
+		{Type: "write", Value: 1},
+		{Type: "read", Session: "WritesFollowReads"},
+		{Type: "read"},
+		{Type: "write", Value: 2, Session: "mw"},
+	})
+	if err != nil {
+		t.Fatalf("runWorkload: %v", err)
+	}
+
+	expect := []server.SessionType{server.MonotonicReads, server.WritesFollowReads, server.MonotonicReads, server.MonotonicWrites}
+	for i, req := range mock.requests {
+		if req.SessionType != expect[i] {
+			t.Errorf("request %d used session %v; want %v", i, req.SessionType, expect[i])
+		}
+	}
+
+	if err := c.runWorkload([]WorkloadOperation{{Type: "read", Session: "linearizable"}}); err == nil {
+		t.Errorf("runWorkload accepted an unknown session type")
+	}
+}
+
+// staleServer accepts every request but answers with a fixed, possibly outdated, read vector.
+type staleServer struct {
+	mu         sync.Mutex
+	data       uint64
+	readVector []uint64
+	requests   int
+}
+
+func (s *staleServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	reply.Succeeded = true
+	reply.OperationType = request.OperationType
+	reply.Data = s.data
+	reply.ReadVector = s.readVector
+	reply.WriteVector = request.WriteVector
+	return nil
+}
+
+func TestReadRejectsReadVectorRegression(t *testing.T) {
+	stale := &staleServer{data: 1, readVector: []uint64{1, 0}}
+	fresh := &staleServer{data: 2, readVector: []uint64{3, 2}}
+	c := New(0, []*protocol.Connection{startMock(t, stale), startMock(t, fresh)})
+	c.ReadVector = []uint64{3, 1}
+
+	for i := 0; i < 10; i++ {
+		if value := c.ReadFromServer(server.MonotonicReads); value != 2 {
+			t.Fatalf("read %d returned %d from the stale server; want 2", i, value)
+		}
+	}
+
+	if stale.requests == 0 {
+		t.Errorf("stale server was never tried")
+	}
+	if fresh.requests != 10 {
+		t.Errorf("fresh server served %d reads; want 10", fresh.requests)
+	}
+	if c.ReadVector[0] != 3 || c.ReadVector[1] != 2 {
+		t.Errorf("ReadVector = %v; want [3 2]", c.ReadVector)
+	}
+}
+
+// sessionServer only serves the session types it can satisfy, like a server that is missing
+// some of the client's dependencies.
+type sessionServer struct {
+	staleServer
+	serves map[server.SessionType]bool
+}
+
+func (s *sessionServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	if !s.serves[request.SessionType] {
+		return nil
+	}
+	return s.staleServer.ProcessClientRequest(request, reply)
+}
+
+func TestReadFallsBackToWeakerSession(t *testing.T) {
+	mr := &sessionServer{staleServer: staleServer{data: 3, readVector: []uint64{0, 0}}, serves: map[server.SessionType]bool{server.MonotonicReads: true}}
+	c := New(0, []*protocol.Connection{startMock(t, mr), startMock(t, mr)})
+	c.FallbackSession = map[server.SessionType]server.SessionType{server.Causal: server.MonotonicReads}
+
+	value, downgraded := c.ReadWithFallback(server.Causal)
+	if value != 3 || !downgraded {
+		t.Errorf("ReadWithFallback(Causal) = %d, %v; want 3 after a downgrade", value, downgraded)
+	}
+
+	value, downgraded = c.ReadWithFallback(server.MonotonicReads)
+	if value != 3 || downgraded {
+		t.Errorf("ReadWithFallback(MonotonicReads) = %d, %v; want 3 without a downgrade", value, downgraded)
+	}
+}
+
+func TestResolverCollapsesSiblings(t *testing.T) {
+	conns := make([]*protocol.Connection, 2)
+	for i := range conns {
+		// Gossip is exchanged by hand below, so the servers' own gossip never needs to run.
+		s, err := server.NewWithConfig(uint64(i), &protocol.Connection{Network: "tcp", Address: "unused"}, nil,
+			server.Config{ClusterSize: 2, MultiValue: true, GossipInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("NewWithConfig: %v", err)
+		}
+		t.Cleanup(func() { s.Stop() })
+		conns[i] = startMock(t, s)
+	}
+
+	// Two clients write concurrently, each to a different server.
+	writes := make([]server.Operation, 2)
+	for i, value := range []uint64{3, 7} {
+		c := New(uint64(i), conns)
+		c.Servers = conns[i : i+1]
+		c.WriteToServer(value, server.Causal)
+		writes[i] = server.Operation{OperationType: server.Write, VersionVector: c.WriteVector, TieBreaker: uint64(i), Data: value}
+	}
+	for i, conn := range conns {
+		request := server.GossipRequest{ProtocolVersion: server.ProtocolVersion, ServerId: uint64(1 - i), Operations: writes[1-i : 2-i]}
+		if err := protocol.Invoke(*conn, "Server.ReceiveGossip", &request, &server.GossipReply{}); err != nil {
+			t.Fatalf("gossip to server %d: %v", i, err)
+		}
+	}
+
+	c := New(2, conns)
+	c.Resolver = func(siblings []uint64) uint64 {
+		if len(siblings) != 2 {
+			t.Errorf("Resolver called with siblings %v; want both writes", siblings)
+		}
+		return max(siblings[0], siblings[1])
+	}
+	if value := c.ReadFromServer(server.Causal); value != 7 {
+		t.Errorf("first read = %d; want the resolved 7", value)
+	}
+
+	c.Resolver = func(siblings []uint64) uint64 {
+		t.Errorf("Resolver called again with siblings %v after they were collapsed", siblings)
+		return siblings[0]
+	}
+	if value := c.ReadFromServer(server.Causal); value != 7 {
+		t.Errorf("second read = %d; want 7", value)
+	}
+	for _, w := range writes {
+		if !vectorclock.CompareVersionVector(c.WriteVector, w.VersionVector) || slices.Equal(c.WriteVector, w.VersionVector) {
+			t.Errorf("resolved write vector %v does not follow write %v", c.WriteVector, w.VersionVector)
+		}
+	}
+}
+
+func TestOperationErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	down := &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+	l.Close()
+
+	c := New(0, []*protocol.Connection{down, down})
+	if _, err := c.Read(server.Causal); !errors.Is(err, errs.ErrNoServerAvailable) {
+		t.Errorf("Read() with every server down: error %v; want ErrNoServerAvailable", err)
+	}
+
+	behind := &sessionServer{staleServer: staleServer{readVector: []uint64{0, 0}}}
+	c = New(0, []*protocol.Connection{down, startMock(t, behind)})
+	if _, err := c.Write(1, server.Causal); !errors.Is(err, errs.ErrDependencyNotMet) {
+		t.Errorf("Write() with no server satisfying the session: error %v; want ErrDependencyNotMet", err)
+	}
+}
+
+// downableServer is a mockServer that can be taken down, after which it fails every request.
+type downableServer struct {
+	mockServer
+	down atomic.Bool
+}
+
+func (d *downableServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	if d.down.Load() {
+		return errors.New("server down")
+	}
+	return d.mockServer.ProcessClientRequest(request, reply)
+}
+
+// clockedServer has a fixed vector clock, reports it through Inspect and turns away requests it
+// does not satisfy the dependencies of, like a server that hasn't caught up.
+type clockedServer struct {
+	mockServer
+	clock []uint64
+}
+
+func (c *clockedServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	if !server.DependencyCheck(c.clock, *request) {
+		c.mu.Lock()
+		c.requests = append(c.requests, *request)
+		c.mu.Unlock()
+		return nil
+	}
+	return c.mockServer.ProcessClientRequest(request, reply)
+}
+
+func (c *clockedServer) Inspect(request *server.InspectRequest, reply *server.InspectReply) error {
+	reply.VectorClock = slices.Clone(c.clock)
+	return nil
+}
+
+func TestWriteProbesForFreshServer(t *testing.T) {
+	mocks := make([]*clockedServer, 5)
+	conns := make([]*protocol.Connection, len(mocks))
+	fresh := 3
+	for i := range mocks {
+		mocks[i] = &clockedServer{clock: make([]uint64, len(mocks))}
+		if i == fresh {
+			mocks[i].clock[0] = 1
+		}
+		conns[i] = startMock(t, mocks[i])
+	}
+	c := New(0, conns)
+	c.ProbeFanout = len(mocks)
+
+	for range 10 {
+		c.WriteVector = []uint64{1, 0, 0, 0, 0}
+		if _, err := c.Write(7, server.Causal); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for i, m := range mocks {
+		m.mu.Lock()
+		got := len(m.requests)
+		m.mu.Unlock()
+		if i == fresh && got != 10 {
+			t.Errorf("fresh server %d handled %d writes; want 10", i, got)
+		}
+		if i != fresh && got != 0 {
+			t.Errorf("stale server %d was sent %d writes; want 0", i, got)
+		}
+	}
+}
+
+func TestAttemptsCountServerTries(t *testing.T) {
+	mocks := make([]*clockedServer, 3)
+	conns := make([]*protocol.Connection, len(mocks))
+	for i := range mocks {
+		mocks[i] = &clockedServer{clock: []uint64{1, 0, 0}}
+		conns[i] = startMock(t, mocks[i])
+	}
+	c := New(0, conns)
+	c.Key = "k"
+	order := c.preference(c.Key)
+	// The key's first server is stale, so each operation is retried on the second.
+	mocks[order[0]].clock = []uint64{0, 0, 0}
+
+	c.WriteVector = []uint64{1, 0, 0}
+	for _, op := range []func() error{
+		func() error { _, err := c.Write(5, server.Causal); return err },
+		func() error { _, err := c.Read(server.ReadYourWrites); return err },
+	} {
+		before := c.Attempts()
+		if err := op(); err != nil {
+			t.Fatalf("operation: %v", err)
+		}
+		if got := c.Attempts() - before; got != 2 {
+			t.Errorf("operation took %d attempts; want 2, the stale server then a fresh one", got)
+		}
+	}
+
+	before := c.Attempts()
+	if _, err := c.Read(server.Eventual); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got := c.Attempts() - before; got != 1 {
+		t.Errorf("read without dependencies took %d attempts; want 1", got)
+	}
+}
+
+func TestPrimaryForKey(t *testing.T) {
+	mocks := make([]*downableServer, 4)
+	conns := make([]*protocol.Connection, len(mocks))
+	for i := range mocks {
+		mocks[i] = &downableServer{}
+		conns[i] = startMock(t, mocks[i])
+	}
+	c := New(0, conns)
+	c.Key = "k"
+
+	primary := c.PrimaryFor("k")
+	for range 3 {
+		if got := c.PrimaryFor("k"); got != primary {
+			t.Fatalf("PrimaryFor(k) = %d, then %d", primary, got)
+		}
+	}
+	reversed := New(1, slices.Clone(conns))
+	slices.Reverse(reversed.Servers)
+	if got := reversed.Servers[reversed.PrimaryFor("k")]; got != conns[primary] {
+		t.Errorf("client listing servers in reverse picks %s as primary; want %s", got.Address, conns[primary].Address)
+	}
+
+	// served returns the index of the only mock that handled a request since the last call.
+	served := func() int {
+		t.Helper()
+		at := -1
+		for i, m := range mocks {
+			m.mu.Lock()
+			if len(m.requests) > 0 {
+				if at != -1 {
+					t.Errorf("servers %d and %d both handled requests", at, i)
+				}
+				at = i
+			}
+			m.requests = nil
+			m.mu.Unlock()
+		}
+		return at
+	}
+
+	c.WriteToServer(1, server.Causal)
+	if got := served(); got != primary {
+		t.Errorf("write went to server %d; want primary %d", got, primary)
+	}
+
+	mocks[primary].down.Store(true)
+	c.WriteToServer(2, server.Causal)
+	fallback := served()
+	if fallback == primary || fallback == -1 {
+		t.Fatalf("write with primary %d down went to server %d", primary, fallback)
+	}
+	for range 3 {
+		c.WriteToServer(3, server.Causal)
+		if got := served(); got != fallback {
+			t.Errorf("write with primary down went to server %d; want %d as before", got, fallback)
+		}
+	}
+}
+
+func TestVirtualNodesSpreadKeys(t *testing.T) {
+	conns := make([]*protocol.Connection, 5)
+	for i := range conns {
+		conns[i] = &protocol.Connection{Network: "tcp", Address: fmt.Sprintf("10.0.0.%d:9000", i+1)}
+	}
+
+	// imbalance returns how far the busiest or idlest server is from an even share of the keys,
+	// as a fraction of that share.
+	imbalance := func(vnodes int) float64 {
+		c := New(0, conns)
+		c.VirtualNodes = vnodes
+		const keys = 50000
+		load := make([]int, len(conns))
+		for k := range keys {
+			load[c.PrimaryFor(fmt.Sprintf("key-%d", k))]++
+		}
+		even := float64(keys) / float64(len(conns))
+		worst := 0.0
+		for _, n := range load {
+			worst = max(worst, math.Abs(float64(n)-even)/even)
+		}
+		return worst
+	}
+
+	few, many := imbalance(1), imbalance(200)
+	if many > 0.15 {
+		t.Errorf("with 200 virtual nodes a server's load is %.0f%% off an even share; want within 15%%", many*100)
+	}
+	if many >= few {
+		t.Errorf("200 virtual nodes spread keys no better than 1: %.0f%% vs %.0f%% off an even share", many*100, few*100)
+	}
+}
+
+func TestReadWithVersion(t *testing.T) {
+	// Gossip is exchanged by hand below, so the server's own gossip never needs to run.
+	s, err := server.NewWithConfig(0, &protocol.Connection{Network: "tcp", Address: "unused"}, nil,
+		server.Config{ClusterSize: 2, GossipInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	conn := startMock(t, s)
+
+	c := New(0, []*protocol.Connection{conn, conn})
+	c.Servers = c.Servers[:1]
+	c.WriteToServer(5, server.Causal)
+	c.WriteToServer(6, server.Causal)
+	// Server 1's write is concurrent with the client's, so the read returns the later of them.
+	remote := server.Operation{OperationType: server.Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Data: 9, Seq: 1}
+	request := server.GossipRequest{ProtocolVersion: server.ProtocolVersion, ServerId: 1, Operations: []server.Operation{remote}}
+	if err := protocol.Invoke(*conn, "Server.ReceiveGossip", &request, &server.GossipReply{}); err != nil {
+		t.Fatalf("gossip: %v", err)
+	}
+
+	inspect := server.InspectReply{}
+	if err := protocol.Invoke(*conn, "Server.Inspect", &server.InspectRequest{}, &inspect); err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	value, version, err := c.ReadWithVersion(server.Causal)
+	if err != nil {
+		t.Fatalf("ReadWithVersion: %v", err)
+	}
+	if value != inspect.Data || !slices.Equal(version, inspect.VectorClock) {
+		t.Errorf("ReadWithVersion() = %d, %v; want %d, %v", value, version, inspect.Data, inspect.VectorClock)
+	}
+	if want := []uint64{2, 1}; !slices.Equal(version, want) {
+		t.Errorf("ReadWithVersion() version = %v; want %v", version, want)
+	}
+
+	version[0] = 100
+	if c.ReadVector[0] == 100 {
+		t.Errorf("changing the returned version changed the client's read vector")
+	}
+}
+
+func TestWriteWithVersion(t *testing.T) {
+	conns := make([]*protocol.Connection, 2)
+	for i := range conns {
+		// Gossip is exchanged by hand below, so the servers' own gossip never needs to run.
+		s, err := server.NewWithConfig(uint64(i), &protocol.Connection{Network: "tcp", Address: "unused"}, nil,
+			server.Config{ClusterSize: 2, GossipInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("NewWithConfig: %v", err)
+		}
+		t.Cleanup(func() { s.Stop() })
+		conns[i] = startMock(t, s)
+	}
+
+	writer := New(0, conns)
+	writer.Servers = conns[:1]
+	writer.WriteToServer(5, server.Causal)
+	version, err := writer.WriteWithVersion(6, server.Causal)
+	if err != nil {
+		t.Fatalf("WriteWithVersion: %v", err)
+	}
+	inspect := server.InspectReply{}
+	if err := protocol.Invoke(*conns[0], "Server.Inspect", &server.InspectRequest{}, &inspect); err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	if !slices.Equal(version, inspect.VectorClock) {
+		t.Errorf("WriteWithVersion() = %v; want the server's clock %v", version, inspect.VectorClock)
+	}
+
+	// A reader depending on the write is served only by a server that has it.
+	reader := New(1, conns)
+	reader.Servers = conns[1:]
+	reader.ReadVector = version
+	if _, err := reader.Read(server.MonotonicReads); !errors.Is(err, errs.ErrDependencyNotMet) {
+		t.Fatalf("Read() from a server without the write = %v; want ErrDependencyNotMet", err)
+	}
+	reader.Servers = conns[:1]
+	if value, err := reader.Read(server.MonotonicReads); err != nil || value != 6 {
+		t.Errorf("Read() from the server with the write = %d, %v; want 6, nil", value, err)
+	}
+}
+
+func TestReadUntil(t *testing.T) {
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+
+	go func() {
+		writer := New(1, c.Servers)
+		for value := uint64(1); value <= 5; value++ {
+			time.Sleep(10 * time.Millisecond)
+			writer.WriteToServer(value, server.Causal)
+		}
+	}()
+	value, err := c.ReadUntil(func(v uint64) bool { return v >= 5 }, server.Causal, 2*time.Second)
+	if err != nil || value != 5 {
+		t.Fatalf("ReadUntil(>= 5) = %d, %v; want 5", value, err)
+	}
+
+	start := time.Now()
+	value, err = c.ReadUntil(func(v uint64) bool { return v == 100 }, server.Causal, 50*time.Millisecond)
+	if !errors.Is(err, errs.ErrTimeout) || value != 5 {
+		t.Errorf("ReadUntil(== 100) = %d, %v; want the last value 5 and ErrTimeout", value, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("ReadUntil(== 100) gave up after %v; want about 50ms", elapsed)
+	}
+}
+
+func TestFlushWaitsForServersToCatchUp(t *testing.T) {
+	conns := make([]*protocol.Connection, 2)
+	for i := range conns {
+		// Gossip is exchanged by hand below, so the servers' own gossip never needs to run.
+		s, err := server.NewWithConfig(uint64(i), &protocol.Connection{Network: "tcp", Address: "unused"}, nil,
+			server.Config{ClusterSize: 2, GossipInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("NewWithConfig: %v", err)
+		}
+		t.Cleanup(func() { s.Stop() })
+		conns[i] = startMock(t, s)
+	}
+
+	c := New(0, conns)
+	c.Servers = conns[:1]
+	c.WriteToServer(5, server.Causal)
+	write := server.Operation{OperationType: server.Write, VersionVector: c.WriteVector, TieBreaker: 0, Data: 5, Seq: 1}
+	c.Servers = conns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := c.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Flush() with server 1 behind = %v; want DeadlineExceeded", err)
+	}
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- c.Flush(context.Background()) }()
+	select {
+	case err := <-flushed:
+		t.Fatalf("Flush() returned %v before server 1 caught up", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	request := server.GossipRequest{ProtocolVersion: server.ProtocolVersion, ServerId: 0, Operations: []server.Operation{write}}
+	if err := protocol.Invoke(*conns[1], "Server.ReceiveGossip", &request, &server.GossipReply{}); err != nil {
+		t.Fatalf("gossip to server 1: %v", err)
+	}
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("Flush() = %v; want nil once every server caught up", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Flush() did not return after server 1 caught up")
+	}
+}
+
+func TestRequestsCarryOnlyCheckedVectors(t *testing.T) {
+	mock := &mockServer{}
+	c := New(0, []*protocol.Connection{startMock(t, mock)})
+	c.ReadVector, c.WriteVector = []uint64{2}, []uint64{1}
+
+	sessions := []server.SessionType{server.Causal, server.MonotonicReads, server.MonotonicWrites, server.ReadYourWrites, server.WritesFollowReads}
+	for _, session := range sessions {
+		c.ReadFromServer(session)
+		c.WriteToServer(1, session)
+	}
+	for i, req := range mock.requests {
+		read, write := req.SessionType.Vectors()
+		if (req.ReadVector != nil) != read || (req.WriteVector != nil) != write {
+			t.Errorf("request %d under session %d carried read vector %v and write vector %v", i, req.SessionType, req.ReadVector, req.WriteVector)
+		}
+	}
+	if !slices.Equal(c.ReadVector, []uint64{2}) || !slices.Equal(c.WriteVector, []uint64{1}) {
+		t.Errorf("omitted vectors changed the client's to %v and %v; want [2] and [1]", c.ReadVector, c.WriteVector)
+	}
+}
+
+func TestOmittedVectorsPassDependencyCheck(t *testing.T) {
+	conns := make([]*protocol.Connection, 2)
+	for i := range conns {
+		s, err := server.NewWithConfig(uint64(i), &protocol.Connection{Network: "tcp", Address: "unused"}, nil,
+			server.Config{ClusterSize: 2, GossipInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("NewWithConfig: %v", err)
+		}
+		t.Cleanup(func() { s.Stop() })
+		conns[i] = startMock(t, s)
+	}
+
+	c := New(0, conns)
+	c.Servers = conns[:1]
+	if _, err := c.Write(5, server.MonotonicWrites); err != nil {
+		t.Fatalf("Write(MonotonicWrites): %v", err)
+	}
+	if value, err := c.Read(server.ReadYourWrites); err != nil || value != 5 {
+		t.Fatalf("Read(ReadYourWrites) = %d, %v; want 5", value, err)
+	}
+	if !slices.Equal(c.WriteVector, []uint64{1, 0}) || !slices.Equal(c.ReadVector, []uint64{1, 0}) {
+		t.Fatalf("vectors after write and read are %v and %v; want both [1 0]", c.WriteVector, c.ReadVector)
+	}
+
+	// Server 1 has not seen the write, so no session that checks either vector may use it.
+	c.Servers = conns[1:]
+	for _, session := range []server.SessionType{server.MonotonicReads, server.ReadYourWrites} {
+		if _, err := c.Read(session); !errors.Is(err, errs.ErrDependencyNotMet) {
+			t.Errorf("Read(%d) from a server missing the write: error %v; want ErrDependencyNotMet", session, err)
+		}
+	}
+}
+
+// slowServer is a mockServer that takes delay to answer every request.
+type slowServer struct {
+	mockServer
+	delay time.Duration
+}
+
+func (s *slowServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	time.Sleep(s.delay)
+	return s.mockServer.ProcessClientRequest(request, reply)
+}
+
+func TestOperationTimeout(t *testing.T) {
+	conns := make([]*protocol.Connection, 3)
+	for i := range conns {
+		conns[i] = startMock(t, &slowServer{delay: 300 * time.Millisecond})
+	}
+	c := New(0, conns)
+	c.OperationTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Read(server.Causal)
+	elapsed := time.Since(start)
+	if !errors.Is(err, errs.ErrTimeout) {
+		t.Errorf("Read() from slow servers: error %v; want ErrTimeout", err)
+	}
+	if elapsed < c.OperationTimeout || elapsed > 250*time.Millisecond {
+		t.Errorf("Read() gave up after %v; want about %v, well before one server answers", elapsed, c.OperationTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.WriteContext(ctx, 1, server.Causal); !errors.Is(err, context.Canceled) || errors.Is(err, errs.ErrTimeout) {
+		t.Errorf("WriteContext() with a canceled context: error %v; want Canceled and not ErrTimeout", err)
+	}
+}
+
+// countingServer is a slowServer that records the most requests it ever handled at once.
+type countingServer struct {
+	slowServer
+	inFlight *atomic.Int32
+	peak     *atomic.Int32
+}
+
+func (c *countingServer) enter() {
+	n := c.inFlight.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (c *countingServer) ProcessClientRequest(request *server.ClientRequest, reply *server.ClientReply) error {
+	c.enter()
+	defer c.inFlight.Add(-1)
+	return c.slowServer.ProcessClientRequest(request, reply)
+}
+
+func (c *countingServer) Inspect(request *server.InspectRequest, reply *server.InspectReply) error {
+	c.enter()
+	defer c.inFlight.Add(-1)
+	time.Sleep(c.delay)
+	return nil
+}
+
+func TestMaxInFlight(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	conns := make([]*protocol.Connection, 4)
+	for i := range conns {
+		conns[i] = startMock(t, &countingServer{slowServer: slowServer{delay: 20 * time.Millisecond}, inFlight: &inFlight, peak: &peak})
+	}
+	c := New(0, conns)
+	c.MaxInFlight = 2
+	// Probes fan out to every server at once, and operations that time out leave their RPCs
+	// running, so without the limit far more than two would be in flight.
+	c.ProbeFanout = len(conns)
+	c.OperationTimeout = 5 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Write(uint64(i), server.Causal)
+		}()
+	}
+	wg.Wait()
+	c.OperationTimeout = 0
+	if _, err := c.Write(1, server.Causal); err != nil {
+		t.Fatalf("Write once the load is gone: %v", err)
+	}
+	if got := peak.Load(); got > 2 || got == 0 {
+		t.Errorf("servers saw at most %d of the client's RPCs at once; want between 1 and 2", got)
+	}
+
+	c = New(1, conns)
+	c.MaxInFlight, c.FailFastInFlight = 1, true
+	c.OperationTimeout = 5 * time.Millisecond
+	// The first read gives up but leaves its RPC in flight, taking the only slot.
+	c.Read(server.Causal)
+	if _, err := c.Read(server.Causal); !errors.Is(err, ErrInFlightLimit) {
+		t.Errorf("Read() with the only slot taken: error %v; want ErrInFlightLimit", err)
+	}
+}
+
+// startCluster serves a cluster of n real servers on ephemeral ports.
+func startCluster(t *testing.T, n int) []*protocol.Connection {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	conns := make([]*protocol.Connection, len(listeners))
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i] = l
+		conns[i] = &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+	}
+	for i, l := range listeners {
+		s := server.New(uint64(i), conns[i], conns)
+		t.Cleanup(func() { s.Stop() })
+		srv := rpc.NewServer()
+		if err := srv.Register(s); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		go srv.Accept(l)
+	}
+	return conns
+}
+
+func TestNewFromSeed(t *testing.T) {
+	conns := startCluster(t, 3)
+
+	c, err := NewFromSeed(0, conns[1])
+	if err != nil {
+		t.Fatalf("NewFromSeed: %v", err)
+	}
+	if len(c.Servers) != len(conns) {
+		t.Fatalf("client discovered %d servers; want %d", len(c.Servers), len(conns))
+	}
+	for i := range conns {
+		if *c.Servers[i] != *conns[i] {
+			t.Errorf("server %d = %v; want %v", i, *c.Servers[i], *conns[i])
+		}
+	}
+
+	if _, err := c.Write(7, server.Causal); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if value, err := c.Read(server.Causal); err != nil || value != 7 {
+		t.Errorf("Read = %d, %v; want 7", value, err)
+	}
+
+	if _, err := NewFromSeed(0, &protocol.Connection{Network: "tcp", Address: "127.0.0.1:1"}); err == nil {
+		t.Errorf("NewFromSeed succeeded with an unreachable seed")
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	s := server.New(0, &protocol.Connection{Network: "tcp", Address: "self"}, nil)
+	t.Cleanup(func() { s.Stop() })
+	c := New(0, []*protocol.Connection{startMock(t, s)})
+
+	for _, tt := range []struct{ value, old uint64 }{{3, 0}, {8, 3}, {2, 8}} {
+		if old, err := c.GetSet(tt.value, server.Causal); err != nil || old != tt.old {
+			t.Errorf("GetSet(%d) = %d, %v; want %d", tt.value, old, err, tt.old)
+		}
+	}
+	if value, err := c.Read(server.Causal); err != nil || value != 2 {
+		t.Errorf("Read after GetSet = %d, %v; want 2", value, err)
+	}
+}
+
+// startMocks serves n mock servers and returns them with their connections.
+func startMocks(t *testing.T, n int) ([]*mockServer, []*protocol.Connection) {
+	mocks := make([]*mockServer, n)
+	conns := make([]*protocol.Connection, n)
+	for i := range mocks {
+		mocks[i] = &mockServer{}
+		conns[i] = startMock(t, mocks[i])
+	}
+	return mocks, conns
+}
+
+// readCounts returns how many requests each mock has served.
+func readCounts(mocks []*mockServer) []int {
+	counts := make([]int, len(mocks))
+	for i, m := range mocks {
+		m.mu.Lock()
+		counts[i] = len(m.requests)
+		m.mu.Unlock()
+	}
+	return counts
+}
+
+func TestReadPolicyRoundRobin(t *testing.T) {
+	mocks, conns := startMocks(t, 3)
+	c := New(0, conns)
+	c.ReadPolicy = RoundRobin
+
+	for i := range 6 {
+		if _, err := c.Read(server.MonotonicReads); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		want := make([]int, 3)
+		for j := range want {
+			want[j] = (i + 3 - j) / 3
+		}
+		if counts := readCounts(mocks); !slices.Equal(counts, want) {
+			t.Fatalf("after read %d servers served %v; want %v", i, counts, want)
+		}
+	}
+}
+
+func TestReadPolicyNearest(t *testing.T) {
+	mocks, conns := startMocks(t, 3)
+	c := New(0, conns)
+	c.ReadPolicy = Nearest
+
+	// Each server is tried once before any is preferred, so all of them get measured.
+	for range 3 {
+		if _, err := c.Read(server.MonotonicReads); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if counts := readCounts(mocks); !slices.Equal(counts, []int{1, 1, 1}) {
+		t.Fatalf("the first reads went to %v; want one to each unmeasured server", counts)
+	}
+
+	c.latencies = map[string]time.Duration{conns[0].Address: 30 * time.Millisecond, conns[1].Address: 5 * time.Millisecond, conns[2].Address: 20 * time.Millisecond}
+	for range 3 {
+		if _, err := c.Read(server.MonotonicReads); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if counts := readCounts(mocks); !slices.Equal(counts, []int{1, 4, 1}) {
+		t.Errorf("with server 1 nearest, reads went to %v; want every one to server 1", counts)
+	}
+}
+
+func TestReadPolicyPrimaryFirst(t *testing.T) {
+	mocks, conns := startMocks(t, 3)
+	c := New(0, conns)
+	c.ReadPolicy = PrimaryFirst
+
+	for range 4 {
+		if _, err := c.Read(server.MonotonicReads); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if counts := readCounts(mocks); !slices.Equal(counts, []int{4, 0, 0}) {
+		t.Errorf("reads went to %v; want every one to the primary", counts)
+	}
+}
+
+func TestSeedCluster(t *testing.T) {
+	conns := startCluster(t, 3)
+	if err := SeedCluster(conns, 42); err != nil {
+		t.Fatalf("SeedCluster: %v", err)
+	}
+
+	var clock []uint64
+	for i, conn := range conns {
+		reply := server.InspectReply{}
+		if err := protocol.DefaultTransport.Invoke(*conn, "Server.Inspect", &server.InspectRequest{}, &reply); err != nil {
+			t.Fatalf("Inspect server %d: %v", i, err)
+		}
+		if reply.Data != 42 {
+			t.Errorf("server %d holds %d after seeding; want 42", i, reply.Data)
+		}
+		if clock == nil {
+			clock = reply.VectorClock
+		} else if !slices.Equal(reply.VectorClock, clock) {
+			t.Errorf("server %d has clock %v; want %v like server 0", i, reply.VectorClock, clock)
+		}
+	}
+}
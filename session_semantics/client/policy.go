@@ -0,0 +1,71 @@
+package client
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// ReadPolicy decides which servers a client's reads try first. Writes always try servers in
+// random order, and a client with a Key routes both by it instead.
+type ReadPolicy int
+
+const (
+	// Random tries servers in a new random order for every read.
+	Random ReadPolicy = iota
+	// RoundRobin starts each read at the server after the one the previous read started at.
+	RoundRobin
+	// Nearest tries servers from the lowest measured latency up. Servers not yet measured are
+	// tried first, so each gets measured.
+	Nearest
+	// PrimaryFirst tries the first of the client's servers first, then the others at random.
+	PrimaryFirst
+)
+
+// latencyWeight is the weight of each new sample in a server's measured latency, a moving
+// average that follows changes without jumping on every slow reply.
+const latencyWeight = 0.25
+
+// order returns the order in which to try the client's servers for a read, or a write if read
+// is false. Callers must hold c.mu.
+func (c *Client) order(read bool) []int {
+	if c.Key != "" {
+		return c.preference(c.Key)
+	}
+	order := rand.Perm(len(c.Servers))
+	if !read || len(order) == 0 {
+		return order
+	}
+
+	switch c.ReadPolicy {
+	case RoundRobin:
+		start := c.nextRead % len(c.Servers)
+		c.nextRead = start + 1
+		for i := range order {
+			order[i] = (start + i) % len(c.Servers)
+		}
+	case Nearest:
+		// Sorting the random order keeps ties, such as the unmeasured servers, in random order.
+		slices.SortStableFunc(order, func(a, b int) int {
+			return cmp.Compare(c.latencies[c.Servers[a].Address], c.latencies[c.Servers[b].Address])
+		})
+	case PrimaryFirst:
+		i := slices.Index(order, 0)
+		order[0], order[i] = order[i], order[0]
+	}
+	return order
+}
+
+// recordLatency folds a reply from the server at address after d into its measured latency.
+// Callers must hold c.mu.
+func (c *Client) recordLatency(address string, d time.Duration) {
+	if c.latencies == nil {
+		c.latencies = make(map[string]time.Duration)
+	}
+	if old, ok := c.latencies[address]; ok {
+		d = time.Duration(float64(old)*(1-latencyWeight) + float64(d)*latencyWeight)
+	}
+	// A measured server must sort after the unmeasured ones, which have no latency.
+	c.latencies[address] = max(d, 1)
+}
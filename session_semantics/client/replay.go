@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ReplayTrace issues the operations recorded in the JSON trace at path through the client, under
+// its DefaultSessionType, preserving the recorded inter-arrival delays between operations. It
+// stops at the first operation that fails and returns its error along with its index in the trace.
+func ReplayTrace(client *Client, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read trace file: %w", err)
+	}
+
+	var trace []TraceOperation
+	if err := json.Unmarshal(data, &trace); err != nil {
+		return fmt.Errorf("could not parse trace file: %w", err)
+	}
+
+	for i, op := range trace {
+		if op.Type != "read" && op.Type != "write" {
+			return fmt.Errorf("trace operation %d has unknown type %q", i, op.Type)
+		}
+	}
+
+	clock := client.clock()
+	issued := clock.Now()
+	for i, op := range trace {
+		// Delays are relative to when the previous operation was issued, not when it completed.
+		clock.Sleep(issued.Add(time.Duration(op.Delay) * time.Millisecond).Sub(clock.Now()))
+		issued = clock.Now()
+
+		switch op.Type {
+		case "read":
+			resp, err := client.Read(client.DefaultSessionType)
+			if err != nil {
+				return fmt.Errorf("trace operation %d: read: %w", i, err)
+			}
+			log.Printf("[DEBUG] client %d replayed operation %d: read %d", client.Id, i, resp)
+		case "write":
+			resp, err := client.Write(op.Value, client.DefaultSessionType)
+			if err != nil {
+				return fmt.Errorf("trace operation %d: write of %d: %w", i, op.Value, err)
+			}
+			log.Printf("[DEBUG] client %d replayed operation %d: write %d", client.Id, i, resp)
+		}
+	}
+
+	return nil
+}
@@ -2,20 +2,31 @@ package client
 
 import (
 	"sync"
+	"time"
 
 	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
 )
 
 // WorkloadOperation defines the structure for a workload operation.
 type WorkloadOperation struct {
+	Type    string `json:"Type"`
+	Value   uint64 `json:"Value"`
+	Delay   int    `json:"Delay"`   // Delay in milliseconds
+	Session string `json:"Session"` // Overrides the client's default session type if set
+}
+
+// TraceOperation is a single recorded operation in a replay trace.
+type TraceOperation struct {
 	Type  string `json:"Type"`
 	Value uint64 `json:"Value"`
-	Delay int    `json:"Delay"` // Delay in milliseconds
+	Delay int    `json:"Delay"` // Milliseconds since the previous operation was issued
 }
 
 // Config defines the structure of the configuration file.
 type Config struct {
-	Workloads []WorkloadOperation `json:"workloads"`
+	Workloads          []WorkloadOperation `json:"workloads"`
+	DefaultSessionType string              `json:"default_session_type"`
 }
 
 // Client represents a distributed client interacting with servers.
@@ -24,5 +35,60 @@ type Client struct {
 	Servers     []*protocol.Connection
 	ReadVector  []uint64
 	WriteVector []uint64
-	mu          sync.Mutex
+
+	// Transport carries the client's RPCs to servers.
+	Transport protocol.Transport
+
+	// Clock paces the client's workload delays and the polling of ReadUntil and Flush. Deadlines
+	// still follow real time. nil uses protocol.DefaultClock.
+	Clock protocol.Clock
+
+	// DefaultSessionType is used for workload operations that don't specify their own session.
+	DefaultSessionType server.SessionType
+
+	// FallbackSession maps a session type to a weaker one that reads fall back to when no server
+	// can satisfy the original, trading consistency for availability, e.g. Causal to MonotonicReads.
+	FallbackSession map[server.SessionType]server.SessionType
+
+	// Resolver picks one value when a read from a multi-value server returns concurrent siblings.
+	// The chosen value is written back so later reads see it instead of the conflict.
+	Resolver func(siblings []uint64) uint64
+
+	// Key routes the client's operations: when set, they go to PrimaryFor(Key) first and fall
+	// back through the other servers in a fixed order instead of a random one.
+	Key string
+
+	// ReadPolicy decides which servers reads try first when Key is not set. The zero value is
+	// Random.
+	ReadPolicy ReadPolicy
+
+	// VirtualNodes is the number of points each server gets on the consistent hashing ring that
+	// routes keys. More points spread keys more evenly. 0 uses 100.
+	VirtualNodes int
+
+	// ProbeFanout is how many servers a write asks for their clocks at once before it is sent, so
+	// it goes to the first one that satisfies the session's dependencies rather than trying stale
+	// servers one after another. 0 disables probing.
+	ProbeFanout int
+
+	// MaxInFlight bounds how many RPCs the client has outstanding at once, counting freshness
+	// probes and RPCs an operation gave up waiting for, so a client can't overwhelm servers.
+	// Further RPCs wait for one to finish or, with FailFastInFlight, fail with ErrInFlightLimit.
+	// 0 means no limit.
+	MaxInFlight      int
+	FailFastInFlight bool
+
+	// OperationTimeout bounds each read or write as a whole, across every server it tries.
+	// 0 means no bound.
+	OperationTimeout time.Duration
+	mu               sync.Mutex
+	attempts         int           // Requests sent to servers, see Attempts
+	inFlight         chan struct{} // Semaphore of MaxInFlight slots
+	inFlightOnce     sync.Once
+	nextRead         int                      // Server the next RoundRobin read starts at
+	latencies        map[string]time.Duration // Measured latency of each server by address, for Nearest
+
+	ring             []vnode
+	ringServers      []*protocol.Connection // Servers the ring was built for
+	ringVirtualNodes int
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,7 +15,10 @@ import (
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 
+	clusterconfig "github.com/alanwang67/distributed_registers/config"
+	"github.com/alanwang67/distributed_registers/logging"
 	"github.com/alanwang67/distributed_registers/session_semantics/client"
+	"github.com/alanwang67/distributed_registers/session_semantics/diagnose"
 	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
 	"github.com/alanwang67/distributed_registers/session_semantics/server"
 )
@@ -24,13 +29,16 @@ type Metric struct {
 	OperationType  string  `json:"operation_type"`
 	Latency        float64 `json:"latency"`   // In seconds
 	Timestamp      float64 `json:"timestamp"` // Time since start in seconds
+	Attempts       int     `json:"attempts"`  // Servers the operation was sent to
+	Retried        bool    `json:"retried"`   // Whether a server had to be tried again after the first
 }
 
 // Config structure for loading config.json
 type Config struct {
-	Servers  []serverConfig   `json:"servers"`
-	Clients  []clientConfig   `json:"clients"`
-	Workload []WorkloadConfig `json:"workloads"`
+	Servers            []serverConfig   `json:"servers"`
+	Clients            []clientConfig   `json:"clients"`
+	Workload           []WorkloadConfig `json:"workloads"`
+	DefaultSessionType string           `json:"default_session_type"`
 }
 
 // serverConfig contains details about each server
@@ -48,14 +56,24 @@ type clientConfig struct {
 
 // WorkloadConfig defines the structure for workload operations
 type WorkloadConfig struct {
-	Type  string `json:"Type"`
-	Value uint64 `json:"Value"`
-	Delay int    `json:"Delay"`
+	Type    string `json:"Type"`
+	Value   uint64 `json:"Value"`
+	Delay   int    `json:"Delay"`
+	Session string `json:"Session"`
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("[ERROR] Usage: %s [client|server] [id]", os.Args[0])
+	logLevel := flag.String("log-level", "debug", "least severe messages to log: debug, info, warn, error or off")
+	flag.Parse()
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid --log-level: %v", err)
+	}
+	logging.SetLevel(level)
+
+	args := flag.Args()
+	if len(args) < 2 && (len(args) < 1 || args[0] != "diagnose") {
+		log.Fatalf("[ERROR] Usage: %s [--log-level level] [client|server] [id] | replay [id] [trace] | diagnose", os.Args[0])
 	}
 
 	exeDir, err := os.Getwd()
@@ -74,6 +92,22 @@ func main() {
 	if err != nil {
 		log.Fatalf("[ERROR] Can't unmarshal JSON: %s", err)
 	}
+	cluster, err := clusterconfig.Parse(configData)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid config: %s", err)
+	}
+
+	if args[0] == "diagnose" {
+		report, err := diagnose.Diagnose(cluster)
+		fmt.Print(report)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		if report.Diverged {
+			os.Exit(1)
+		}
+		return
+	}
 
 	servers := make([]*protocol.Connection, len(config.Servers))
 	for i, s := range config.Servers {
@@ -83,18 +117,33 @@ func main() {
 		}
 	}
 
-	id, err := strconv.ParseUint(os.Args[2], 10, 64)
+	id, err := strconv.ParseUint(args[1], 10, 64)
 	if err != nil {
-		log.Fatalf("[ERROR] Can't convert %s to int: %s", os.Args[2], err)
+		log.Fatalf("[ERROR] Can't convert %s to int: %s", args[1], err)
 	}
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "client":
-		metrics := runClientWithMetrics(id, servers, config.Workload)
+		defaultSession := server.Causal
+		if config.DefaultSessionType != "" {
+			defaultSession, err = server.ParseSessionType(config.DefaultSessionType)
+			if err != nil {
+				log.Fatalf("[ERROR] Invalid default session type: %v", err)
+			}
+		}
+		metrics := runClientWithMetrics(id, servers, config.Workload, defaultSession)
 		saveMetrics(metrics, "metrics.json")
 		saveMetricsToCSV(metrics, "latency.csv", "throughput.csv")
 		plotMetrics(metrics, "latency_plot.png", "throughput_plot.png")
 
+	case "replay":
+		if len(args) < 3 {
+			log.Fatalf("[ERROR] Usage: %s replay [id] [trace]", os.Args[0])
+		}
+		if err := client.ReplayTrace(client.New(id, servers), args[2]); err != nil {
+			log.Fatalf("[ERROR] Client %d failed to replay %s: %v", id, args[2], err)
+		}
+
 	case "server":
 		if id >= uint64(len(servers)) {
 			log.Fatalf("[ERROR] Invalid server id %d", id)
@@ -106,25 +155,36 @@ func main() {
 		}
 
 	default:
-		log.Fatalf("[ERROR] Unknown command: %s", os.Args[1])
+		log.Fatalf("[ERROR] Unknown command: %s", args[0])
 	}
 }
 
-func runClientWithMetrics(id uint64, servers []*protocol.Connection, workload []WorkloadConfig) []Metric {
+func runClientWithMetrics(id uint64, servers []*protocol.Connection, workload []WorkloadConfig, defaultSession server.SessionType) []Metric {
 	c := client.New(id, servers)
+	c.DefaultSessionType = defaultSession
 
 	startTime := time.Now()
 	metrics := []Metric{}
 
 	for i, op := range workload {
+		session := c.DefaultSessionType
+		if op.Session != "" {
+			var err error
+			session, err = server.ParseSessionType(op.Session)
+			if err != nil {
+				log.Fatalf("[ERROR] Invalid session type for operation %d: %v", i+1, err)
+			}
+		}
+
 		startOp := time.Now()
+		startAttempts := c.Attempts()
 
 		switch op.Type {
 		case "read":
-			resp := c.ReadFromServer(server.WritesFollowReads)
+			resp := c.ReadFromServer(session)
 			log.Printf("[INFO] Client %d performed read operation: Response = %v", id, resp)
 		case "write":
-			resp := c.WriteToServer(op.Value, server.WritesFollowReads)
+			resp := c.WriteToServer(op.Value, session)
 			log.Printf("[INFO] Client %d performed write operation with value %d: Response = %v", id, op.Value, resp)
 		default:
 			log.Printf("[WARN] Client %d encountered unknown operation type: %s", id, op.Type)
@@ -133,12 +193,15 @@ func runClientWithMetrics(id uint64, servers []*protocol.Connection, workload []
 
 		duration := time.Since(startOp)
 		elapsedTime := time.Since(startTime).Seconds()
+		attempts := c.Attempts() - startAttempts
 
 		metrics = append(metrics, Metric{
 			OperationIndex: i + 1,
 			OperationType:  op.Type,
 			Latency:        duration.Seconds(),
 			Timestamp:      elapsedTime,
+			Attempts:       attempts,
+			Retried:        attempts > 1,
 		})
 
 		if op.Delay > 0 {
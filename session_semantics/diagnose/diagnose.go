@@ -0,0 +1,126 @@
+// Package diagnose checks a running session_semantics cluster for servers whose state has
+// diverged from the rest.
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	clusterconfig "github.com/alanwang67/distributed_registers/config"
+	"github.com/alanwang67/distributed_registers/errs"
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+// inspectTimeout bounds how long Diagnose waits for each server.
+const inspectTimeout = 2 * time.Second
+
+// Report is the state of every server in a cluster at one point in time.
+type Report struct {
+	Servers  []ServerReport // In the order of the config
+	Diverged bool           // Whether any reachable server's state differs from the freshest one's
+}
+
+// ServerReport is what one server reported, or why it couldn't be reached.
+type ServerReport struct {
+	Id                uint64
+	Address           string
+	Down              bool
+	Err               error // Why the server is down
+	Data              uint64
+	VectorClock       []uint64
+	PendingOperations int
+	ConvergenceLag    []uint64
+	Diverged          bool // Whether its value or clock differs from the freshest server's
+}
+
+// Diagnose inspects every server in config and compares their states. The server whose clock
+// has advanced the furthest is taken as the freshest; every other one with a different value or
+// clock has diverged, typically because gossip hasn't reached it yet. Unreachable servers are
+// reported as down. It fails only if no server could be reached.
+func Diagnose(config clusterconfig.Cluster) (Report, error) {
+	protocol.RegisterTypes()
+	report := Report{Servers: make([]ServerReport, len(config.Servers))}
+	var wg sync.WaitGroup
+	for i, node := range config.Servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Servers[i] = inspect(node)
+		}()
+	}
+	wg.Wait()
+
+	freshest := -1
+	for i, s := range report.Servers {
+		if !s.Down && (freshest < 0 || clockSum(s.VectorClock) > clockSum(report.Servers[freshest].VectorClock)) {
+			freshest = i
+		}
+	}
+	if freshest < 0 {
+		return report, fmt.Errorf("diagnose: none of %d servers answered: %w", len(config.Servers), errs.ErrNoServerAvailable)
+	}
+
+	reference := report.Servers[freshest]
+	for i := range report.Servers {
+		s := &report.Servers[i]
+		if !s.Down && (s.Data != reference.Data || !slices.Equal(s.VectorClock, reference.VectorClock)) {
+			s.Diverged = true
+			report.Diverged = true
+		}
+	}
+	return report, nil
+}
+
+func inspect(node clusterconfig.Node) ServerReport {
+	ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+	defer cancel()
+
+	s := ServerReport{Id: node.ID, Address: node.Address}
+	reply := server.InspectReply{}
+	conn := protocol.Connection{Network: node.Network, Address: node.Address}
+	if err := protocol.InvokeContext(ctx, conn, "Server.Inspect", &server.InspectRequest{}, &reply); err != nil {
+		s.Down, s.Err = true, err
+		return s
+	}
+	s.Data = reply.Data
+	s.VectorClock = reply.VectorClock
+	s.PendingOperations = reply.PendingOperations
+	s.ConvergenceLag = reply.ConvergenceLag
+	return s
+}
+
+func clockSum(clock []uint64) uint64 {
+	var sum uint64
+	for _, x := range clock {
+		sum += x
+	}
+	return sum
+}
+
+// String formats the report with a line per server.
+func (r Report) String() string {
+	var b strings.Builder
+	for _, s := range r.Servers {
+		fmt.Fprintf(&b, "server %d at %s: ", s.Id, s.Address)
+		if s.Down {
+			fmt.Fprintf(&b, "DOWN (%v)\n", s.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "data %d, clock %v, %d pending, lag %v", s.Data, s.VectorClock, s.PendingOperations, s.ConvergenceLag)
+		if s.Diverged {
+			b.WriteString(", DIVERGED")
+		}
+		b.WriteString("\n")
+	}
+	if r.Diverged {
+		b.WriteString("cluster has diverged\n")
+	} else {
+		b.WriteString("all reachable servers agree\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package diagnose
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	clusterconfig "github.com/alanwang67/distributed_registers/config"
+	"github.com/alanwang67/distributed_registers/errs"
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/server"
+)
+
+// startCluster serves n servers on ephemeral ports, without gossip between them.
+func startCluster(t *testing.T, n int) ([]*server.Server, clusterconfig.Cluster) {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	conns := make([]*protocol.Connection, n)
+	var config clusterconfig.Cluster
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i] = l
+		conns[i] = &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+		config.Servers = append(config.Servers, clusterconfig.Node{ID: uint64(i), Network: "tcp", Address: conns[i].Address})
+	}
+
+	servers := make([]*server.Server, n)
+	for i, l := range listeners {
+		servers[i] = server.New(uint64(i), conns[i], conns)
+		servers[i].Stop()
+		srv := rpc.NewServer()
+		if err := srv.Register(servers[i]); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		go srv.Accept(l)
+	}
+	return servers, config
+}
+
+func TestDiagnoseReportsLaggingServer(t *testing.T) {
+	servers, config := startCluster(t, 3)
+	write := []server.Operation{{OperationType: server.Write, VersionVector: []uint64{1, 0, 0}, TieBreaker: 0, Seq: 1, Data: 5}}
+	for _, s := range servers[:2] {
+		if err := s.InjectOperations(write); err != nil {
+			t.Fatalf("InjectOperations: %v", err)
+		}
+	}
+	// Server 3 is configured but not running.
+	config.Servers = append(config.Servers, clusterconfig.Node{ID: 3, Network: "tcp", Address: "127.0.0.1:1"})
+
+	report, err := Diagnose(config)
+	if err != nil {
+		t.Fatalf("Diagnose: %v", err)
+	}
+	if !report.Diverged {
+		t.Errorf("report does not flag the cluster as diverged:\n%v", report)
+	}
+	for i, want := range []struct {
+		down, diverged bool
+		data           uint64
+	}{{false, false, 5}, {false, false, 5}, {false, true, 0}, {true, false, 0}} {
+		s := report.Servers[i]
+		if s.Down != want.down || s.Diverged != want.diverged || s.Data != want.data {
+			t.Errorf("server %d reported down %v, diverged %v with %d; want down %v, diverged %v with %d",
+				i, s.Down, s.Diverged, s.Data, want.down, want.diverged, want.data)
+		}
+	}
+	if !strings.Contains(report.String(), "server 2 at "+config.Servers[2].Address+": data 0, clock [0 0 0], 0 pending") {
+		t.Errorf("report does not describe the lagging server:\n%v", report)
+	}
+
+	// Once the lagging server catches up the cluster agrees again.
+	if err := servers[2].InjectOperations(write); err != nil {
+		t.Fatalf("InjectOperations: %v", err)
+	}
+	if report, err := Diagnose(config); err != nil || report.Diverged {
+		t.Errorf("Diagnose after catching up = %v, %v; want no divergence", report, err)
+	}
+}
+
+func TestDiagnoseWithEveryServerDown(t *testing.T) {
+	config := clusterconfig.Cluster{Servers: []clusterconfig.Node{{ID: 0, Network: "tcp", Address: "127.0.0.1:1"}}}
+	report, err := Diagnose(config)
+	if !errors.Is(err, errs.ErrNoServerAvailable) {
+		t.Errorf("Diagnose = %v; want ErrNoServerAvailable", err)
+	}
+	if len(report.Servers) != 1 || !report.Servers[0].Down {
+		t.Errorf("report = %+v; want the server reported down", report)
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	slept := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Second)
+		close(slept)
+	}()
+	soon, later := clock.After(500*time.Millisecond), clock.After(2*time.Second)
+	clock.BlockUntil(3)
+
+	clock.Advance(time.Second)
+	if now := clock.Now(); !now.Equal(start.Add(time.Second)) {
+		t.Errorf("Now after advancing 1s = %v; want %v", now, start.Add(time.Second))
+	}
+	if at := <-soon; !at.Equal(start.Add(time.Second)) {
+		t.Errorf("After(500ms) fired at %v; want %v", at, start.Add(time.Second))
+	}
+	<-slept
+	select {
+	case <-later:
+		t.Errorf("After(2s) fired after advancing 1s")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-later:
+	default:
+		t.Errorf("After(2s) did not fire after advancing 2s")
+	}
+	select {
+	case <-clock.After(0):
+	default:
+		t.Errorf("After(0) did not fire immediately")
+	}
+}
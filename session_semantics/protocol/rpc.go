@@ -1,6 +1,18 @@
 package protocol
 
-import "net/rpc"
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"syscall"
+
+	"github.com/alanwang67/distributed_registers/errs"
+)
 
 type Connection struct {
 	Network string
@@ -20,17 +32,70 @@ type PeerRequest struct{}
 
 type PeerReply struct{}
 
+// payloadTypes lists the concrete types that may be carried in interface-typed RPC fields.
+// gob can only decode an interface value whose concrete type has been registered.
+var payloadTypes = []any{
+	uint64(0),
+	[]uint64(nil),
+	[]byte(nil),
+	"",
+}
+
+var registerOnce sync.Once
+
+// RegisterTypes registers the supported payload types with gob. It is safe to call repeatedly.
+func RegisterTypes() {
+	registerOnce.Do(func() {
+		for _, t := range payloadTypes {
+			gob.Register(t)
+		}
+	})
+}
+
+// Invoke calls method on the server at conn and waits for its reply. Errors are classified: a
+// server that can't be dialed gives errs.ErrUnreachable, one that drops the connection before
+// replying errs.ErrConnectionLost, and an error returned by the method itself errs.ErrRemote.
 func Invoke(conn Connection, method string, args, reply any) error {
-	c, err := rpc.Dial(conn.Network, conn.Address)
+	return InvokeContext(context.Background(), conn, method, args, reply)
+}
+
+// InvokeContext calls method like Invoke, but gives up with an error matching errs.ErrTimeout
+// once ctx's deadline passes.
+func InvokeContext(ctx context.Context, conn Connection, method string, args, reply any) error {
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, conn.Network, conn.Address)
 	if err != nil {
-		// log.Fatalf("trouble dialing %s: %s", conn.Address, err)
-		return err
+		return classify(ctx, fmt.Errorf("%w: dialing %s: %w", errs.ErrUnreachable, conn.Address, err))
 	}
+	c := rpc.NewClient(nc)
+	defer c.Close()
 
-	err = c.Call(method, args, reply)
-	if err != nil {
-		// log.Fatalf("trouble calling %s: %s", method, err)
+	select {
+	case call := <-c.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		if call.Error != nil {
+			return classify(ctx, fmt.Errorf("%s on %s: %w", method, conn.Address, call.Error))
+		}
+		return nil
+	case <-ctx.Done():
+		return classify(ctx, fmt.Errorf("%s on %s: %w", method, conn.Address, ctx.Err()))
 	}
+}
 
-	return nil
+// classify adds the category of a failed call to err, unless it already has one.
+func classify(ctx context.Context, err error) error {
+	var netErr net.Error
+	var serverErr rpc.ServerError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w", errs.ErrTimeout, err)
+	case errors.Is(err, errs.ErrUnreachable), errors.Is(err, context.Canceled):
+		return err
+	case errors.As(err, &serverErr):
+		return fmt.Errorf("%w: %w", errs.ErrRemote, err)
+	case errors.Is(err, rpc.ErrShutdown), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return fmt.Errorf("%w: %w", errs.ErrConnectionLost, err)
+	default:
+		return err
+	}
 }
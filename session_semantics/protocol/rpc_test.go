@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/errs"
+)
+
+type EchoRequest struct {
+	Payload any
+}
+
+type EchoReply struct {
+	Payload any
+}
+
+type Echo struct{}
+
+func (e *Echo) Echo(request *EchoRequest, reply *EchoReply) error {
+	reply.Payload = request.Payload
+	return nil
+}
+
+func (e *Echo) Fail(request *EchoRequest, reply *EchoReply) error {
+	return errors.New("echo refused")
+}
+
+func (e *Echo) Hang(request *EchoRequest, reply *EchoReply) error {
+	time.Sleep(time.Second)
+	return nil
+}
+
+// startEcho serves an Echo service on an ephemeral port.
+func startEcho(t *testing.T) Connection {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := rpc.NewServer()
+	if err := srv.Register(&Echo{}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	go srv.Accept(l)
+	return Connection{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestPayloadTypesRoundTrip(t *testing.T) {
+	RegisterTypes()
+	conn := startEcho(t)
+
+	payloads := []any{
+		uint64(0),
+		uint64(1<<64 - 1),
+		[]uint64{1, 2, 3},
+		[]byte("register"),
+		"register",
+	}
+
+	for _, payload := range payloads {
+		reply := EchoReply{}
+		if err := Invoke(conn, "Echo.Echo", &EchoRequest{Payload: payload}, &reply); err != nil {
+			t.Errorf("Invoke(%#v): %v", payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(reply.Payload, payload) {
+			t.Errorf("payload %#v came back as %#v", payload, reply.Payload)
+		}
+	}
+}
+
+func TestInvokeClassifiesErrors(t *testing.T) {
+	echo := startEcho(t)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closed.Close()
+
+	// dropping accepts connections and closes them without replying, like a server that crashes
+	// mid-call.
+	dropping, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { dropping.Close() })
+	go func() {
+		for {
+			c, err := dropping.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 1))
+			c.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		conn   Connection
+		method string
+		want   error
+	}{
+		{"closed listener", Connection{Network: "tcp", Address: closed.Addr().String()}, "Echo.Echo", errs.ErrUnreachable},
+		{"dropped connection", Connection{Network: "tcp", Address: dropping.Addr().String()}, "Echo.Echo", errs.ErrConnectionLost},
+		{"hanging server", echo, "Echo.Hang", errs.ErrTimeout},
+		{"application error", echo, "Echo.Fail", errs.ErrRemote},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := InvokeContext(ctx, tc.conn, tc.method, &EchoRequest{Payload: "ping"}, &EchoReply{})
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("InvokeContext() = %v; want %v", err, tc.want)
+			}
+			for _, other := range []error{errs.ErrUnreachable, errs.ErrConnectionLost, errs.ErrTimeout, errs.ErrRemote} {
+				if other != tc.want && errors.Is(err, other) {
+					t.Errorf("InvokeContext() = %v; classified as %v as well", err, other)
+				}
+			}
+		})
+	}
+
+	err = Invoke(echo, "Echo.Fail", &EchoRequest{}, &EchoReply{})
+	if !errors.Is(err, errs.ErrRemote) || !strings.Contains(err.Error(), "echo refused") {
+		t.Errorf("Invoke() of a failing method = %v; want ErrRemote with the server's message", err)
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+)
+
+// Transport carries RPCs from one node to another. Servers and clients send all of their
+// RPCs through a Transport so tests and benchmarks can substitute the network.
+type Transport interface {
+	Invoke(conn Connection, method string, args, reply any) error
+}
+
+// TCPTransport sends RPCs over real connections using Invoke.
+type TCPTransport struct{}
+
+func (TCPTransport) Invoke(conn Connection, method string, args, reply any) error {
+	return Invoke(conn, method, args, reply)
+}
+
+// DefaultTransport is used when no other transport is configured.
+var DefaultTransport Transport = TCPTransport{}
+
+// ShapedTransport wraps another transport and simulates per-link latency and bandwidth, so
+// protocols can be benchmarked under WAN-like conditions on a single machine. Nodes are
+// identified by their index in Nodes; From is the index of the node sending the RPCs.
+type ShapedTransport struct {
+	Transport Transport
+	From      int
+	Nodes     []Connection
+
+	// LatencyFunc returns the delay added to each RPC on the link from one node to another.
+	LatencyFunc func(from, to int) time.Duration
+
+	// Bandwidth caps each link's throughput in bytes per second, measured on the gob-encoded
+	// request. RPCs on a busy link queue behind each other. 0 means unlimited.
+	Bandwidth int
+
+	mu        sync.Mutex
+	busyUntil map[int]time.Time
+}
+
+func (t *ShapedTransport) Invoke(conn Connection, method string, args, reply any) error {
+	to := -1
+	for i, node := range t.Nodes {
+		if node == conn {
+			to = i
+			break
+		}
+	}
+
+	delay := time.Duration(0)
+	if t.LatencyFunc != nil {
+		delay += t.LatencyFunc(t.From, to)
+	}
+	if t.Bandwidth > 0 {
+		delay += t.transmit(to, args)
+	}
+	time.Sleep(delay)
+
+	next := t.Transport
+	if next == nil {
+		next = DefaultTransport
+	}
+	return next.Invoke(conn, method, args, reply)
+}
+
+// transmit reserves the link to node to for the time needed to send args and returns how long
+// the caller has to wait until its transfer completes.
+func (t *ShapedTransport) transmit(to int, args any) time.Duration {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(args)
+	duration := time.Duration(buf.Len()) * time.Second / time.Duration(t.Bandwidth)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busyUntil == nil {
+		t.busyUntil = make(map[int]time.Time)
+	}
+
+	now := time.Now()
+	start := t.busyUntil[to]
+	if start.Before(now) {
+		start = now
+	}
+	t.busyUntil[to] = start.Add(duration)
+	return t.busyUntil[to].Sub(now)
+}
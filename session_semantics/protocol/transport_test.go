@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShapedTransportLatency(t *testing.T) {
+	conn := startEcho(t)
+	transport := &ShapedTransport{
+		From:  0,
+		Nodes: []Connection{{Network: "tcp", Address: "self"}, conn},
+		LatencyFunc: func(from, to int) time.Duration {
+			if from == 0 && to == 1 {
+				return 50 * time.Millisecond
+			}
+			return 0
+		},
+	}
+
+	start := time.Now()
+	reply := EchoReply{}
+	if err := transport.Invoke(conn, "Echo.Echo", &EchoRequest{Payload: "ping"}, &reply); err != nil || reply.Payload != "ping" {
+		t.Fatalf("Invoke = %v, %v", reply, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 90*time.Millisecond {
+		t.Errorf("RPC over a 50ms link took %v", elapsed)
+	}
+}
+
+func TestShapedTransportBandwidth(t *testing.T) {
+	conn := startEcho(t)
+	transport := &ShapedTransport{Nodes: []Connection{conn}, Bandwidth: 1 << 20}
+
+	// Ten concurrent 10KiB requests share a 1MiB/s link, so they need about 100ms in total.
+	payload := make([]byte, 10<<10)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transport.Invoke(conn, "Echo.Echo", &EchoRequest{Payload: payload}, &EchoReply{})
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 95*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Errorf("100KiB over a 1MiB/s link took %v; want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+)
+
+// serverState is everything DumpCluster saves of a server. Caches that are rebuilt on demand,
+// like the last dependencies checked, are left out, as is the configuration that can't be
+// encoded: the transport, the store, the tie-breaker and the callbacks.
+type serverState struct {
+	Id                  uint64
+	Self                *protocol.Connection
+	Peers               []*protocol.Connection
+	Config              Config
+	VectorClock         []uint64
+	OperationsPerformed []Operation
+	MyOperations        []Operation
+	PendingOperations   []Operation
+	Data                uint64
+	ConcurrentWrites    uint64
+	PeerClocks          map[uint64][]uint64
+	Snapshot            Operation
+	Seen                []operationId
+	Seq                 uint64
+}
+
+// DumpCluster writes the state of every server, their logs, clocks and pending operations, to
+// the file at path, so a cluster caught in a failing state can be reloaded with RestoreCluster.
+func DumpCluster(servers []*Server, path string) error {
+	states := make([]json.RawMessage, len(servers))
+	for i, s := range servers {
+		s.mu.Lock()
+		state := serverState{
+			Id:                  s.Id,
+			Self:                s.Self,
+			Peers:               s.Peers,
+			Config:              s.Config,
+			VectorClock:         s.VectorClock,
+			OperationsPerformed: s.OperationsPerformed,
+			MyOperations:        s.MyOperations,
+			PendingOperations:   s.PendingOperations,
+			Data:                s.Data,
+			ConcurrentWrites:    s.ConcurrentWrites,
+			PeerClocks:          s.peerClocks,
+			Snapshot:            s.snapshot,
+			Seq:                 s.seq,
+		}
+		for id := range s.seen {
+			state.Seen = append(state.Seen, id)
+		}
+		slices.SortFunc(state.Seen, func(a, b operationId) int {
+			return cmp.Or(cmp.Compare(a.Origin, b.Origin), cmp.Compare(a.Seq, b.Seq))
+		})
+		// Encode while still holding the lock, since the state shares the server's slices.
+		var err error
+		states[i], err = json.Marshal(state)
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("dumping server %d: %w", s.Id, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("dumping cluster: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("dumping cluster: %w", err)
+	}
+	return nil
+}
+
+// RestoreCluster recreates the servers DumpCluster saved to the file at path. They use the
+// default transport and have no store, tie-breaker or callbacks; set those on their Config as needed.
+// Restored servers don't gossip on their own, so a scenario can be replayed step by step with
+// Gossip.
+func RestoreCluster(path string) ([]*Server, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("restoring cluster: %w", err)
+	}
+	var states []serverState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("restoring cluster from %s: %w", path, err)
+	}
+
+	protocol.RegisterTypes()
+	servers := make([]*Server, len(states))
+	for i, state := range states {
+		state.Config.Transport = protocol.DefaultTransport
+		s := &Server{
+			Id:                  state.Id,
+			Self:                state.Self,
+			Peers:               state.Peers,
+			Config:              state.Config,
+			VectorClock:         state.VectorClock,
+			OperationsPerformed: state.OperationsPerformed,
+			MyOperations:        state.MyOperations,
+			PendingOperations:   state.PendingOperations,
+			Data:                state.Data,
+			ConcurrentWrites:    state.ConcurrentWrites,
+			peerClocks:          state.PeerClocks,
+			snapshot:            state.Snapshot,
+			seen:                make(map[operationId]struct{}, len(state.Seen)),
+			seq:                 state.Seq,
+			done:                make(chan struct{}),
+		}
+		if s.peerClocks == nil {
+			s.peerClocks = make(map[uint64][]uint64)
+		}
+		for _, id := range state.Seen {
+			s.seen[id] = struct{}{}
+		}
+		s.peers = resolvePeers(s.Id, s.Self, s.Peers)
+		servers[i] = s
+	}
+	return servers, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// The versions of the binary layout written by Operation.MarshalBinary. Each operation is written
+// in the oldest format that holds it, so servers that don't use checksums or expiry write what
+// older servers read.
+const (
+	operationFormat            = 1
+	operationFormatChecksummed = 2
+	operationFormatExpiring    = 3
+)
+
+// MarshalBinary encodes the operation in a stable layout, independent of gob, for logs and
+// snapshots that must outlive the code that wrote them. The layout is a format version byte
+// followed by unsigned varints as written by binary.AppendUvarint:
+//
+//	operation type
+//	version vector length n
+//	n version vector entries
+//	tie-breaker
+//	sequence number
+//	data
+//
+// Format 2, used when the operation has a checksum, appends the checksum as 4 big-endian bytes.
+// Format 3, used when it expires, appends the expiry time as another varint, then the checksum,
+// which is 0 if there is none. Since Operation implements encoding.BinaryMarshaler, gob uses this
+// layout for it as well.
+func (op Operation) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 5+binary.MaxVarintLen64*(6+len(op.VersionVector)))
+	switch {
+	case op.ExpiresAt != 0:
+		buf = appendOperationFields(append(buf, operationFormatExpiring), op)
+	case op.Checksum != 0:
+		buf = appendOperationFields(append(buf, operationFormatChecksummed), op)
+	default:
+		return appendOperationFields(append(buf, operationFormat), op), nil
+	}
+	return binary.BigEndian.AppendUint32(buf, op.Checksum), nil
+}
+
+// appendOperationFields appends every field of op but its checksum to buf, in the layout
+// MarshalBinary describes. The expiry time is only appended if the operation has one.
+func appendOperationFields(buf []byte, op Operation) []byte {
+	buf = binary.AppendUvarint(buf, uint64(op.OperationType))
+	buf = binary.AppendUvarint(buf, uint64(len(op.VersionVector)))
+	for _, entry := range op.VersionVector {
+		buf = binary.AppendUvarint(buf, entry)
+	}
+	buf = binary.AppendUvarint(buf, op.TieBreaker)
+	buf = binary.AppendUvarint(buf, op.Seq)
+	buf = binary.AppendUvarint(buf, op.Data)
+	if op.ExpiresAt != 0 {
+		buf = binary.AppendUvarint(buf, uint64(op.ExpiresAt))
+	}
+	return buf
+}
+
+// computeChecksum returns the CRC-32 (IEEE) of op's fields other than Checksum.
+func (op Operation) computeChecksum() uint32 {
+	return crc32.ChecksumIEEE(appendOperationFields(nil, op))
+}
+
+// UnmarshalBinary decodes an operation written by MarshalBinary. An empty version vector
+// decodes as nil.
+func (op *Operation) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("decoding operation: no data")
+	}
+	format := data[0]
+	if format != operationFormat && format != operationFormatChecksummed && format != operationFormatExpiring {
+		return fmt.Errorf("decoding operation: unknown format version %d", format)
+	}
+	data = data[1:]
+
+	next := func(field string) (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, fmt.Errorf("decoding operation: malformed %s", field)
+		}
+		data = data[n:]
+		return v, nil
+	}
+
+	var decoded Operation
+	opType, err := next("operation type")
+	if err != nil {
+		return err
+	}
+	decoded.OperationType = OperationType(opType)
+	width, err := next("version vector length")
+	if err != nil {
+		return err
+	}
+	// Every entry takes at least a byte, which bounds what a corrupt length can allocate.
+	if width > uint64(len(data)) {
+		return fmt.Errorf("decoding operation: version vector length %d exceeds the remaining %d bytes", width, len(data))
+	}
+	if width > 0 {
+		decoded.VersionVector = make([]uint64, width)
+	}
+	for i := range decoded.VersionVector {
+		if decoded.VersionVector[i], err = next("version vector entry"); err != nil {
+			return err
+		}
+	}
+	if decoded.TieBreaker, err = next("tie-breaker"); err != nil {
+		return err
+	}
+	if decoded.Seq, err = next("sequence number"); err != nil {
+		return err
+	}
+	if decoded.Data, err = next("data"); err != nil {
+		return err
+	}
+	if format == operationFormatExpiring {
+		expiresAt, err := next("expiry time")
+		if err != nil {
+			return err
+		}
+		decoded.ExpiresAt = int64(expiresAt)
+	}
+	if format != operationFormat {
+		if len(data) < 4 {
+			return errors.New("decoding operation: malformed checksum")
+		}
+		decoded.Checksum = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("decoding operation: %d trailing bytes", len(data))
+	}
+
+	*op = decoded
+	return nil
+}
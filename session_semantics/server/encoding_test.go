@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOperationBinaryRoundTrip(t *testing.T) {
+	for _, op := range []Operation{
+		{},
+		{OperationType: Write, VersionVector: []uint64{1, 0, 2}, TieBreaker: 2, Seq: 2, Data: 7},
+		{OperationType: Read, VersionVector: []uint64{}, TieBreaker: 1},
+		{OperationType: Write, VersionVector: []uint64{3}, Seq: 3, Data: 1, Checksum: 0xdeadbeef},
+		{OperationType: Write, VersionVector: []uint64{4}, Seq: 4, Data: 2, ExpiresAt: 1_700_000_000_000_000_000},
+		{OperationType: Expire, VersionVector: []uint64{5}, Seq: 5, ExpiresAt: 1, Checksum: 7},
+		{OperationType: Write, VersionVector: []uint64{math.MaxUint64, 0, math.MaxUint64}, TieBreaker: math.MaxUint64, Seq: math.MaxUint64, Data: math.MaxUint64},
+	} {
+		data, err := op.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%+v): %v", op, err)
+		}
+		var decoded Operation
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary of %+v: %v", op, err)
+		}
+		if len(op.VersionVector) == 0 {
+			// Empty vectors come back as nil.
+			op.VersionVector = nil
+		}
+		if !reflect.DeepEqual(decoded, op) {
+			t.Errorf("round trip of %+v gave %+v", op, decoded)
+		}
+	}
+}
+
+func TestOperationBinaryLayout(t *testing.T) {
+	op := Operation{OperationType: Write, VersionVector: []uint64{1, 300}, TieBreaker: 1, Seq: 2, Data: 3}
+	data, err := op.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	// Format 1, type 1, 2 entries, 1 and 300 as varints, tie-breaker 1, seq 2, data 3.
+	want := []byte{1, 1, 2, 1, 0xac, 0x02, 1, 2, 3}
+	if !bytes.Equal(data, want) {
+		t.Errorf("MarshalBinary = %x; want %x", data, want)
+	}
+}
+
+func TestOperationUnmarshalBinaryRejectsCorruptData(t *testing.T) {
+	valid, _ := Operation{OperationType: Write, VersionVector: []uint64{1, 2}, Data: 3}.MarshalBinary()
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown format", append([]byte{3}, valid[1:]...)},
+		{"truncated", valid[:len(valid)-1]},
+		{"truncated checksum", append([]byte{2}, valid[1:]...)},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0)},
+		{"huge vector length", []byte{1, 1, 0xff, 0xff, 0xff, 0xff, 0x0f, 0}},
+		{"overlong varint", []byte{1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	} {
+		var op Operation
+		if err := op.UnmarshalBinary(tt.data); err == nil {
+			t.Errorf("%s: UnmarshalBinary(%x) = %+v; want an error", tt.name, tt.data, op)
+		}
+	}
+}
+
+func TestGossipCarriesBinaryOperations(t *testing.T) {
+	ops := history(5, 2, 3)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(GossipRequest{ProtocolVersion: ProtocolVersion, Operations: ops}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var decoded GossipRequest
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Operations, ops) {
+		t.Errorf("gob round trip gave %+v; want %+v", decoded.Operations, ops)
+	}
+}
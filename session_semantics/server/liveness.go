@@ -0,0 +1,134 @@
+package server
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// defaultSuspectAfter is how many consecutive failed gossip rounds make a peer suspected when
+// Config.SuspectAfter isn't set.
+const defaultSuspectAfter = 3
+
+// defaultSuspectRetryRounds is how many gossip intervals pass between attempts to reach a
+// suspected peer when Config.SuspectRetryInterval isn't set.
+const defaultSuspectRetryRounds = 10
+
+// PeerStatus is what a server knows about whether one of its peers is up.
+type PeerStatus struct {
+	Id          uint64
+	Suspected   bool      // The peer failed SuspectAfter gossip rounds in a row and isn't heard from since
+	Failures    int       // Consecutive failed gossip rounds
+	LastContact time.Time // Last time gossip to or from the peer went through; zero if it never did
+}
+
+// liveness is what the server has seen of one peer. Suspicion is lifted as soon as the peer
+// answers gossip or sends some of its own.
+type liveness struct {
+	failures    int
+	lastContact time.Time
+	lastAttempt time.Time
+	lastSynced  time.Time // Last time this server's gossip reached the peer
+}
+
+func (c Config) suspectAfter() int {
+	if c.SuspectAfter > 0 {
+		return c.SuspectAfter
+	}
+	return defaultSuspectAfter
+}
+
+func (c Config) suspectRetryInterval() time.Duration {
+	if c.SuspectRetryInterval > 0 {
+		return c.SuspectRetryInterval
+	}
+	return defaultSuspectRetryRounds * c.GossipInterval
+}
+
+// livenessOf returns what the server has seen of peer id. Callers must hold s.mu.
+func (s *Server) livenessOf(id uint64) *liveness {
+	if s.liveness == nil {
+		s.liveness = make(map[uint64]*liveness)
+	}
+	l, ok := s.liveness[id]
+	if !ok {
+		l = &liveness{}
+		s.liveness[id] = l
+	}
+	return l
+}
+
+func (s *Server) suspected(id uint64) bool {
+	l, ok := s.liveness[id]
+	return ok && l.failures >= s.Config.suspectAfter()
+}
+
+// gossipTargets returns the peers to gossip to at now: the fanout peers that aren't suspected and
+// were synced with least recently, or all of them if fanout is 0, and suspected ones only once per
+// SuspectRetryInterval, to notice when they come back. Callers must hold s.mu.
+func (s *Server) gossipTargets(now time.Time, fanout int) []peer {
+	var live, probes []peer
+	for _, p := range s.peers {
+		l := s.livenessOf(p.Id)
+		switch {
+		case !s.suspected(p.Id):
+			live = append(live, p)
+		case now.Sub(l.lastAttempt) >= s.Config.suspectRetryInterval():
+			probes = append(probes, p)
+		}
+	}
+	if fanout > 0 && fanout < len(live) {
+		// Peers synced with at the same time, such as ones never synced with, go in ID order.
+		slices.SortStableFunc(live, func(a, b peer) int {
+			return s.livenessOf(a.Id).lastSynced.Compare(s.livenessOf(b.Id).lastSynced)
+		})
+		live = live[:fanout]
+	}
+
+	targets := append(live, probes...)
+	for _, p := range targets {
+		s.livenessOf(p.Id).lastAttempt = now
+	}
+	return targets
+}
+
+// recordContact records the outcome of gossiping with peer id at now. Callers must hold s.mu.
+func (s *Server) recordContact(id uint64, ok bool, now time.Time) {
+	l := s.livenessOf(id)
+	wasSuspected := s.suspected(id)
+	if ok {
+		l.failures, l.lastContact = 0, now
+		if wasSuspected {
+			log.Infof("server %d reached suspected peer %d again", s.Id, id)
+		}
+		return
+	}
+	l.failures++
+	if !wasSuspected && s.suspected(id) {
+		log.Warnf("server %d suspects peer %d is down after %d failed gossip rounds", s.Id, id, l.failures)
+	}
+}
+
+// heardFrom records gossip arriving from server id, if it is one of the server's peers. Callers
+// must hold s.mu.
+func (s *Server) heardFrom(id uint64, now time.Time) {
+	for _, p := range s.peers {
+		if p.Id == id {
+			s.recordContact(id, true, now)
+			return
+		}
+	}
+}
+
+// peerStatuses reports the liveness of every peer, ordered by ID. Callers must hold s.mu.
+func (s *Server) peerStatuses() []PeerStatus {
+	statuses := make([]PeerStatus, 0, len(s.peers))
+	for _, p := range s.peers {
+		l := s.livenessOf(p.Id)
+		statuses = append(statuses, PeerStatus{Id: p.Id, Suspected: s.suspected(p.Id), Failures: l.failures, LastContact: l.lastContact})
+	}
+	slices.SortFunc(statuses, func(a, b PeerStatus) int { return cmp.Compare(a.Id, b.Id) })
+	return statuses
+}
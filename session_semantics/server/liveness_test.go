@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+)
+
+// partitionTransport delivers gossip like clusterTransport, except to servers marked down.
+type partitionTransport struct {
+	clusterTransport
+	mu    sync.Mutex
+	down  map[string]bool
+	calls map[string]int
+}
+
+func (p *partitionTransport) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	p.mu.Lock()
+	p.calls[conn.Address]++
+	down := p.down[conn.Address]
+	p.mu.Unlock()
+	if down {
+		return errors.New("connection refused")
+	}
+	return p.clusterTransport.Invoke(conn, method, args, reply)
+}
+
+func (p *partitionTransport) setDown(address string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[address] = down
+}
+
+func (p *partitionTransport) callsTo(address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[address]
+}
+
+func peerStatus(t *testing.T, s *Server, id uint64) PeerStatus {
+	t.Helper()
+	reply := InspectReply{}
+	if err := s.Inspect(&InspectRequest{}, &reply); err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	for _, status := range reply.Peers {
+		if status.Id == id {
+			return status
+		}
+	}
+	t.Fatalf("server %d reports no status for peer %d", s.Id, id)
+	return PeerStatus{}
+}
+
+func TestSuspectedPeers(t *testing.T) {
+	transport := &partitionTransport{clusterTransport: clusterTransport{}, down: map[string]bool{}, calls: map[string]int{}}
+	clock := protocol.NewFakeClock(time.Unix(0, 0))
+	config := Config{Transport: transport, Clock: clock, SuspectAfter: 2, SuspectRetryInterval: time.Minute}
+	servers := make([]*Server, 3)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), config)
+		servers[i].stopGossipLoop()
+		transport.clusterTransport[servers[i].Self.Address] = servers[i]
+	}
+	s, offline := servers[0], servers[1].Self.Address
+
+	if _, err := write(s, 1); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	transport.setDown(offline, true)
+	for range 2 {
+		s.Gossip()
+	}
+	if status := peerStatus(t, s, 1); !status.Suspected || status.Failures != 2 {
+		t.Errorf("after 2 failed rounds peer 1 is %+v; want it suspected", status)
+	}
+	if status := peerStatus(t, s, 2); status.Suspected || status.LastContact.IsZero() {
+		t.Errorf("peer 2 is %+v; want it alive", status)
+	}
+
+	// Until the retry interval passes the suspected peer is left out.
+	calls := transport.callsTo(offline)
+	s.Gossip()
+	if transport.callsTo(offline) != calls {
+		t.Errorf("server gossiped to suspected peer 1 before its retry interval")
+	}
+
+	transport.setDown(offline, false)
+	clock.Advance(config.SuspectRetryInterval)
+	s.Gossip()
+	if status := peerStatus(t, s, 1); status.Suspected || status.Failures != 0 || status.LastContact.IsZero() {
+		t.Errorf("after coming back peer 1 is %+v; want it alive", status)
+	}
+	if servers[1].Data != 1 {
+		t.Errorf("peer 1 has %d after coming back; want 1", servers[1].Data)
+	}
+
+	// Hearing from a suspected peer clears it as well.
+	transport.setDown(offline, true)
+	for range 2 {
+		s.Gossip()
+	}
+	if _, err := write(servers[1], 2); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	servers[1].Gossip()
+	if status := peerStatus(t, s, 1); status.Suspected {
+		t.Errorf("peer 1 is %+v after gossiping to server 0; want it alive", status)
+	}
+}
+
+func TestGossipFanoutPrefersLeastRecentlySynced(t *testing.T) {
+	transport := &partitionTransport{clusterTransport: clusterTransport{}, down: map[string]bool{}, calls: map[string]int{}}
+	servers := make([]*Server, 4)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), Config{Transport: transport, GossipFanout: 1, SuspectAfter: 1, SuspectRetryInterval: time.Hour})
+		servers[i].stopGossipLoop()
+		transport.clusterTransport[servers[i].Self.Address] = servers[i]
+	}
+	s := servers[0]
+	if _, err := write(s, 1); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Each peer is the least recently synced in turn, so rounds cycle through all of them.
+	rounds := 3 * (len(servers) - 1)
+	for range rounds {
+		s.Gossip()
+	}
+	for _, peer := range servers[1:] {
+		if calls := transport.callsTo(peer.Self.Address); calls != 3 {
+			t.Errorf("peer %d got %d of %d rounds; want 3", peer.Id, calls, rounds)
+		}
+		if peer.Data != 1 {
+			t.Errorf("peer %d has %d; want 1", peer.Id, peer.Data)
+		}
+	}
+
+	// A dead peer is never synced, but once suspected it doesn't take up the fanout.
+	down := servers[1].Self.Address
+	transport.setDown(down, true)
+	for range rounds {
+		s.Gossip()
+	}
+	if calls := transport.callsTo(down); calls != 4 {
+		t.Errorf("dead peer 1 got %d gossip messages in total; want 4", calls)
+	}
+	for _, peer := range servers[2:] {
+		if calls := transport.callsTo(peer.Self.Address); calls < 7 {
+			t.Errorf("peer %d got %d gossip messages in total; want at least 7", peer.Id, calls)
+		}
+	}
+}
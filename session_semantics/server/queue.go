@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// fairQueue holds the client requests waiting to be served when Config.FairQueueDepth is set.
+// Each client has at most one request in flight and the rest wait behind it, so a client sending
+// a burst takes turns with the others instead of crowding them out. Different clients are served
+// concurrently: a request waiting out DependencyWaitTimeout holds up only its own client.
+type fairQueue struct {
+	mu       sync.Mutex
+	pending  map[uint64][]*queuedRequest // Requests waiting behind the one in flight, keyed by client ID
+	inFlight map[uint64]bool             // Clients with a request being served
+}
+
+type queuedRequest struct {
+	request *ClientRequest
+	reply   *ClientReply
+	done    chan error
+}
+
+// enqueueClientRequest serves request once its client's earlier requests are done. It fails at
+// once if the client already has Config.FairQueueDepth requests waiting.
+func (s *Server) enqueueClientRequest(request *ClientRequest, reply *ClientReply) error {
+	q := &s.queue
+	q.mu.Lock()
+	client := request.ClientId
+	if n := len(q.pending[client]); n >= s.Config.FairQueueDepth {
+		q.mu.Unlock()
+		return fmt.Errorf("server %d is busy: client %d already has %d requests queued", s.Id, client, n)
+	}
+	if q.pending == nil {
+		q.pending = make(map[uint64][]*queuedRequest)
+		q.inFlight = make(map[uint64]bool)
+	}
+	queued := &queuedRequest{request: request, reply: reply, done: make(chan error, 1)}
+	if q.inFlight[client] {
+		q.pending[client] = append(q.pending[client], queued)
+	} else {
+		q.inFlight[client] = true
+		go s.serveQueue(client, queued)
+	}
+	q.mu.Unlock()
+
+	return <-queued.done
+}
+
+// serveQueue serves client's requests one at a time, starting with next, until none are waiting.
+func (s *Server) serveQueue(client uint64, next *queuedRequest) {
+	q := &s.queue
+	for {
+		next.done <- s.processClientRequest(next.request, next.reply)
+
+		q.mu.Lock()
+		if len(q.pending[client]) == 0 {
+			delete(q.pending, client)
+			delete(q.inFlight, client)
+			q.mu.Unlock()
+			return
+		}
+		next = q.pending[client][0]
+		q.pending[client] = q.pending[client][1:]
+		q.mu.Unlock()
+	}
+}
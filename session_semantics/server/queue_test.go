@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// queued returns how many of client's requests are waiting to be served.
+func (q *fairQueue) queued(client uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending[client])
+}
+
+// waitQueued waits for client to have n requests waiting on s.
+func waitQueued(t *testing.T, s *Server, client uint64, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.queue.queued(client) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %d has %d requests queued; want %d", client, s.queue.queued(client), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	const flooder, occasional = 1, 2
+	const flood = 8
+
+	// Every flooding write is held in OnWriteApplied until the test ends, so the flooder's queue
+	// stays full while the occasional client is served.
+	release := make(chan struct{})
+	config := Config{GossipInterval: time.Hour, FairQueueDepth: flood - 1, OnWriteApplied: func(op Operation) {
+		if op.Data == flooder {
+			<-release
+		}
+	}}
+	s := newTestServer(t, 0, 1, config)
+
+	var wg sync.WaitGroup
+	submit := func(client uint64, operation OperationType, reply *ClientReply) chan error {
+		done := make(chan error, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done <- s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: operation,
+				SessionType: Eventual, Data: client, ClientId: client}, reply)
+		}()
+		return done
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	// One flooding write is being served and the rest fill the flooder's queue.
+	for range flood {
+		submit(flooder, Write, &ClientReply{})
+	}
+	waitQueued(t, s, flooder, flood-1)
+	if err := <-submit(flooder, Write, &ClientReply{}); err == nil {
+		t.Errorf("a request beyond FairQueueDepth was accepted")
+	}
+
+	var reply ClientReply
+	read := submit(occasional, Read, &reply)
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatalf("occasional read: %v", err)
+		}
+		// The read's clock counts the writes served before it: at most the one in flight when it
+		// arrived, which it doesn't wait behind. Served in arrival order, it would have waited for
+		// all of them.
+		if writes := reply.ReadVector[0]; writes > 1 {
+			t.Errorf("the occasional read waited for %d flooding writes; want at most 1", writes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the occasional read was not served while a flooding write was in flight")
+	}
+}
+
+func TestFairQueueDependencyWait(t *testing.T) {
+	const waiting, other = 1, 2
+	config := Config{GossipInterval: time.Hour, FairQueueDepth: 4, DependencyWaitTimeout: time.Minute}
+	s := newTestServer(t, 0, 1, config)
+
+	// The read depends on three writes the server doesn't have yet, so it waits for them.
+	read := make(chan error, 1)
+	var reply ClientReply
+	go func() {
+		read <- s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read,
+			SessionType: Causal, ReadVector: []uint64{3}, ClientId: waiting}, &reply)
+	}()
+	waitParked(t, s, 1)
+
+	// Another client's writes are served while the read waits, and supply its dependencies.
+	for i := range 3 {
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			done <- s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write,
+				SessionType: Causal, Data: uint64(i + 1), ClientId: other}, &ClientReply{})
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("write %d: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("write %d from another client was held up behind the waiting read", i)
+		}
+		if latency := time.Since(start); latency > 500*time.Millisecond {
+			t.Errorf("write %d took %v behind the waiting read", i, latency)
+		}
+	}
+
+	select {
+	case err := <-read:
+		if err != nil || !reply.Succeeded || reply.Data != 3 {
+			t.Errorf("read = %d, succeeded %v, error %v; want 3 once its dependencies arrived", reply.Data, reply.Succeeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the read did not finish once its dependencies arrived")
+	}
+}
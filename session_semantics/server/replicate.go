@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// replicateAttempts is how many times an operation is offered to Config.Replicate before the
+// server gives up on it.
+const replicateAttempts = 5
+
+// queueReplication hands ops, just applied and persisted, to Config.Replicate in the order they
+// were applied. A goroutine, running only while operations are queued, makes the calls, so a
+// slow hook delays neither clients nor gossip. s.mu must be held.
+func (s *Server) queueReplication(ops ...Operation) {
+	if s.Config.Replicate == nil || len(ops) == 0 {
+		return
+	}
+	for _, op := range ops {
+		op.VersionVector = append([]uint64(nil), op.VersionVector...)
+		s.toReplicate = append(s.toReplicate, op)
+	}
+	if !s.replicating {
+		s.replicating = true
+		go s.replicate()
+	}
+}
+
+// replicate passes the queued operations to Config.Replicate one at a time until none are left.
+func (s *Server) replicate() {
+	for {
+		s.mu.Lock()
+		if len(s.toReplicate) == 0 {
+			s.replicating = false
+			s.mu.Unlock()
+			return
+		}
+		op := s.toReplicate[0]
+		s.toReplicate = s.toReplicate[1:]
+		s.mu.Unlock()
+
+		s.replicateOne(op)
+	}
+}
+
+// replicateOne calls Config.Replicate with op, retrying with backoff while it fails, and logs
+// the operation as lost to replication if it still fails after replicateAttempts calls.
+func (s *Server) replicateOne(op Operation) {
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.Config.Replicate(op)
+		if err == nil {
+			return
+		}
+		if attempt == replicateAttempts {
+			log.Printf("[ERROR] server %d giving up replicating operation %+v after %d attempts: %v", s.Id, op, attempt, err)
+			return
+		}
+		log.Printf("[WARN] server %d could not replicate operation %+v, retrying in %v: %v", s.Id, op, backoff, err)
+		s.Config.clock().Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReplicateReceivesEveryAppliedOperationOnce(t *testing.T) {
+	replicated := make(chan Operation, 16)
+	failed := false
+	config := Config{GossipInterval: time.Hour, Replicate: func(op Operation) error {
+		// The first call fails, and the operation must be offered again.
+		if !failed {
+			failed = true
+			return errors.New("mirror unavailable")
+		}
+		replicated <- op
+		return nil
+	}}
+	s := newTestServer(t, 0, 2, config)
+	s.stopGossipLoop()
+
+	gossip := []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Seq: 1, Data: 7},
+		{OperationType: Write, VersionVector: []uint64{0, 2}, TieBreaker: 1, Seq: 2, Data: 8},
+	}
+	write(s, 3)
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: gossip}, &GossipReply{})
+	// Gossip repeats operations already applied; they must not be replicated again.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: gossip}, &GossipReply{})
+	write(s, 4)
+
+	var got []uint64
+	for range 4 {
+		select {
+		case op := <-replicated:
+			got = append(got, op.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("replicated %v; want 4 operations", got)
+		}
+	}
+	if want := []uint64{3, 7, 8, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replicated %v; want %v, each once in the order applied", got, want)
+	}
+	select {
+	case op := <-replicated:
+		t.Errorf("replicated %+v beyond the applied operations", op)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -1,9 +1,17 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/gob"
 	"fmt"
+	"hash/fnv"
+	"log"
 	"reflect"
+	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
@@ -12,40 +20,189 @@ import (
 
 // New creates and initializes a new Server instance with the given ID, self connection, and peer connections.
 func New(id uint64, self *protocol.Connection, peers []*protocol.Connection) *Server {
+	// Without an explicit cluster size the config is always valid.
+	s, _ := NewWithConfig(id, self, peers, Config{})
+	return s
+}
+
+// NewWithConfig creates and initializes a new Server instance like New, applying the given config.
+// It fails if the server or one of its peers doesn't fit in the configured cluster size.
+func NewWithConfig(id uint64, self *protocol.Connection, peers []*protocol.Connection, config Config) (*Server, error) {
+	protocol.RegisterTypes()
+	if config.Transport == nil {
+		config.Transport = protocol.DefaultTransport
+	}
+	if config.GossipInterval == 0 {
+		config.GossipInterval = defaultGossipInterval
+	}
+	if config.InitialValue != 0 && !config.inRange(config.InitialValue) {
+		return nil, fmt.Errorf("initial value %d is outside the allowed range [%d, %d]", config.InitialValue, config.MinValue, config.MaxValue)
+	}
 	s := &Server{
 		Id:                  id,
 		Self:                self,
 		Peers:               peers,
-		VectorClock:         make([]uint64, len(peers)),
+		Config:              config,
 		MyOperations:        make([]Operation, 0),
 		OperationsPerformed: make([]Operation, 0),
 		PendingOperations:   make([]Operation, 0),
 		Data:                0,
+		peerClocks:          make(map[uint64][]uint64),
+		seen:                make(map[operationId]struct{}),
+		done:                make(chan struct{}),
+		wake:                make(chan struct{}, 1),
 	}
+	s.peers = resolvePeers(id, self, peers)
+
+	size := clusterSize(id, s.peers)
+	if config.ClusterSize != 0 {
+		if size > config.ClusterSize {
+			return nil, fmt.Errorf("server %d with %d peers does not fit in a cluster of size %d", id, len(s.peers), config.ClusterSize)
+		}
+		size = config.ClusterSize
+	}
+	s.VectorClock = make([]uint64, size)
+	s.applyGenesis()
+	if config.Store != nil {
+		if err := s.recover(); err != nil {
+			return nil, fmt.Errorf("server %d could not recover from its store: %w", id, err)
+		}
+	}
+
+	s.loop.Add(1)
 	go s.sendGossip()
-	return s
+	return s, nil
+}
+
+// applyGenesis records the genesis operation holding Config.InitialValue, if there is one. Every
+// server derives the same operation from its config, so it is never gossiped, and its zero vector
+// orders it before every write and leaves the clock at zero.
+func (s *Server) applyGenesis() {
+	if s.Config.InitialValue == 0 {
+		return
+	}
+	s.OperationsPerformed = append(s.OperationsPerformed, Operation{
+		OperationType: Write,
+		VersionVector: make([]uint64, len(s.VectorClock)),
+		Data:          s.Config.InitialValue,
+	})
+	s.Data = s.Config.InitialValue
+}
+
+// resolvePeers pairs every peer connection other than self with its server ID. The peers
+// list may or may not contain self; when it does, a peer's ID is its index in the list,
+// otherwise the IDs skip over the server's own ID.
+func resolvePeers(id uint64, self *protocol.Connection, peers []*protocol.Connection) []peer {
+	includesSelf := false
+	for _, p := range peers {
+		if self != nil && p != nil && *p == *self {
+			includesSelf = true
+			break
+		}
+	}
+
+	resolved := make([]peer, 0, len(peers))
+	for i, p := range peers {
+		if self != nil && p != nil && *p == *self {
+			continue
+		}
+		peerId := uint64(i)
+		if !includesSelf && peerId >= id {
+			peerId += 1
+		}
+		resolved = append(resolved, peer{Id: peerId, Conn: p})
+	}
+	return resolved
+}
+
+// clock returns the configured clock, or protocol.DefaultClock if there is none.
+func (c Config) clock() protocol.Clock {
+	if c.Clock == nil {
+		return protocol.DefaultClock
+	}
+	return c.Clock
+}
+
+// inRange reports whether the value lies within the register's configured bounds.
+func (c Config) inRange(value uint64) bool {
+	return value >= c.MinValue && (c.MaxValue == 0 || value <= c.MaxValue)
+}
+
+// clusterSize returns the number of vector clock entries needed to hold a slot for the server
+// itself and for every peer.
+func clusterSize(id uint64, peers []peer) int {
+	size := int(id) + 1
+	for _, p := range peers {
+		size = max(size, int(p.Id)+1)
+	}
+	return size
 }
 
 // DependencyCheck verifies if the server's vector clock satisfies the client's dependency
-// requirements based on the session type.
+// requirements based on the session type. A vector the client left out is no dependency.
 func DependencyCheck(vectorClock []uint64, request ClientRequest) bool {
 	switch request.SessionType {
 	case Causal:
-		return vectorclock.CompareVersionVector(vectorClock, request.WriteVector) &&
-			vectorclock.CompareVersionVector(vectorClock, request.ReadVector)
+		return covers(vectorClock, request.WriteVector) && covers(vectorClock, request.ReadVector)
 	case MonotonicReads:
-		return vectorclock.CompareVersionVector(vectorClock, request.ReadVector)
+		return covers(vectorClock, request.ReadVector)
 	case MonotonicWrites:
-		return vectorclock.CompareVersionVector(vectorClock, request.WriteVector)
+		return covers(vectorClock, request.WriteVector)
 	case ReadYourWrites:
-		return vectorclock.CompareVersionVector(vectorClock, request.WriteVector)
+		return covers(vectorClock, request.WriteVector)
 	case WritesFollowReads:
-		return vectorclock.CompareVersionVector(vectorClock, request.ReadVector)
+		return covers(vectorClock, request.ReadVector)
+	case Eventual:
+		return true
 	default:
 		panic("Unspecified session type")
 	}
 }
 
+// covers reports whether clock dominates v, treating an empty v as all zeros.
+func covers(clock []uint64, v []uint64) bool {
+	return len(v) == 0 || vectorclock.CompareVersionVector(clock, v)
+}
+
+// dependencyCheck is DependencyCheck against the server's clock with fast paths for the common
+// cases. A fresh client has no dependencies, and since the clock never moves backward, a request
+// whose vectors equal those of the last request that passed passes again. Comparing for equality
+// is cheaper than checking dominance, and repeated reads from one client hit the cache. Callers
+// must hold s.mu.
+func (s *Server) dependencyCheck(request ClientRequest) bool {
+	if request.SessionType > Eventual {
+		return DependencyCheck(s.VectorClock, request)
+	}
+	if zeroVector(request.ReadVector) && zeroVector(request.WriteVector) {
+		return true
+	}
+
+	// Causal checks both vectors, so a request that passed it would pass any session type.
+	cached := &s.lastDependencies
+	if cached.valid && (cached.sessionType == Causal || cached.sessionType == request.SessionType) &&
+		slices.Equal(cached.readVector, request.ReadVector) && slices.Equal(cached.writeVector, request.WriteVector) {
+		return true
+	}
+
+	if !DependencyCheck(s.VectorClock, request) {
+		return false
+	}
+	cached.valid = true
+	cached.sessionType = request.SessionType
+	cached.readVector = append(cached.readVector[:0], request.ReadVector...)
+	cached.writeVector = append(cached.writeVector[:0], request.WriteVector...)
+	return true
+}
+
+func zeroVector(v []uint64) bool {
+	for _, x := range v {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // operationsGetMaxVersionVector computes the maximum version vector from a list of operations.
 // It returns a new version vector where each element is the maximum across all operations.
 func operationsGetMaxVersionVector(lst []Operation) []uint64 {
@@ -65,65 +222,308 @@ func operationsGetMaxVersionVector(lst []Operation) []uint64 {
 	return mx
 }
 
-// ProcessClientRequest processes a client's read or write request and populates the reply accordingly.
+// maxVersionVectorInto raises each entry of mx to the matching entry of v.
+func maxVersionVectorInto(mx []uint64, v []uint64) {
+	for j := 0; j < len(v) && j < len(mx); j++ {
+		if v[j] > mx[j] {
+			mx[j] = v[j]
+		}
+	}
+}
+
+// checkProtocolVersion rejects a message whose sender speaks a different protocol version.
+func checkProtocolVersion(message string, version uint64) error {
+	if version != ProtocolVersion {
+		return fmt.Errorf("%s uses protocol version %d, but this server only speaks version %d", message, version, ProtocolVersion)
+	}
+	return nil
+}
+
+// wordSize is the size of each integer field in the payload size estimates.
+const wordSize = 8
+
+// operationSize estimates the encoded size of op: its vector plus its fixed fields.
+func operationSize(op Operation) int {
+	return wordSize * (len(op.VersionVector) + 4)
+}
+
+// clientRequestSize estimates the encoded size of request.
+func clientRequestSize(request *ClientRequest) int {
+	return wordSize * (len(request.ReadVector) + len(request.WriteVector) + 4)
+}
+
+// gossipHeaderSize estimates the encoded size of a gossip message carrying clock but no operations.
+func gossipHeaderSize(clock []uint64) int {
+	return wordSize * (len(clock) + 3)
+}
+
+// gossipSize estimates the encoded size of request.
+func gossipSize(request *GossipRequest) int {
+	size := gossipHeaderSize(request.VectorClock) + len(request.Compressed)
+	for _, op := range request.Operations {
+		size += operationSize(op)
+	}
+	return size
+}
+
+// checkPayloadSize rejects a message larger than the configured MaxPayloadBytes.
+func (c Config) checkPayloadSize(message string, size int) error {
+	if c.MaxPayloadBytes > 0 && size > c.MaxPayloadBytes {
+		return fmt.Errorf("%s of about %d bytes exceeds the %d byte payload limit", message, size, c.MaxPayloadBytes)
+	}
+	return nil
+}
+
+// satisfies reports whether the server can serve request now: it passes the session's dependency
+// check and, for a write, the server has everything the client saw. A write's version vector is
+// the server's clock, so covering every vector the client sent orders the write after all of it
+// even when the session checks only one of them. The vectors can't simply be merged into the
+// clock instead: the clock would then claim operations the server doesn't have, and it would
+// discard them as already applied when they arrived. Eventual writes record no dependencies.
+// s.mu must be held.
+func (s *Server) satisfies(request ClientRequest) bool {
+	if !s.dependencyCheck(request) {
+		return false
+	}
+	if request.OperationType != Write || request.SessionType == Eventual {
+		return true
+	}
+	return covers(s.VectorClock, request.ReadVector) && covers(s.VectorClock, request.WriteVector)
+}
+
+// waitForDependencies waits up to timeout for the clock to satisfy request's dependencies and
+// reports whether it did. s.mu must be held; it is released while waiting.
+func (s *Server) waitForDependencies(request ClientRequest, timeout time.Duration) bool {
+	cond := s.clockCond()
+	expired := false
+	done := make(chan struct{})
+	defer close(done)
+	go func(expiry <-chan time.Time) {
+		select {
+		case <-expiry:
+		case <-done:
+			return
+		}
+		s.mu.Lock()
+		expired = true
+		s.mu.Unlock()
+		cond.Broadcast()
+	}(s.Config.clock().After(timeout))
+
+	s.dependencyWaiters++
+	defer func() { s.dependencyWaiters-- }()
+	for !expired {
+		cond.Wait()
+		if s.satisfies(request) {
+			return true
+		}
+	}
+	return false
+}
+
+// clockCond returns the condition signaled when the clock advances, by a local write or by
+// gossip, creating it on first use. Waiters check the clock and wait under s.mu, and the clock
+// only advances under s.mu before the broadcast, so no advance can slip in between a check and
+// the wait that follows it. s.mu must be held.
+func (s *Server) clockCond() *sync.Cond {
+	if s.clockAdvanced == nil {
+		s.clockAdvanced = sync.NewCond(&s.mu)
+	}
+	return s.clockAdvanced
+}
+
+// ProcessClientRequest serves a client's read or write, through the fair queue when
+// Config.FairQueueDepth is set.
 func (s *Server) ProcessClientRequest(request *ClientRequest, reply *ClientReply) error {
+	if s.Config.FairQueueDepth > 0 {
+		return s.enqueueClientRequest(request, reply)
+	}
+	return s.processClientRequest(request, reply)
+}
+
+func (s *Server) processClientRequest(request *ClientRequest, reply *ClientReply) error {
+	reply.ProtocolVersion = ProtocolVersion
+	if err := checkProtocolVersion("client request", request.ProtocolVersion); err != nil {
+		return err
+	}
+	if err := s.Config.checkPayloadSize("client request", clientRequestSize(request)); err != nil {
+		return err
+	}
+	if s.notReady.Load() {
+		return fmt.Errorf("server %d is not ready: its startup self-test has not passed", s.Id)
+	}
+
 	s.mu.Lock()
-	check := !(DependencyCheck(s.VectorClock, *request))
+	if s.stopped {
+		s.mu.Unlock()
+		return fmt.Errorf("server %d is stopped", s.Id)
+	}
+	check := !s.satisfies(*request)
+	if check && s.Config.DependencyWaitTimeout > 0 {
+		check = !s.waitForDependencies(*request, s.Config.DependencyWaitTimeout)
+	}
 
 	if check {
 		reply.Succeeded = false
 		s.mu.Unlock()
+		if s.Config.OnDependencyRejected != nil {
+			s.Config.OnDependencyRejected(*request)
+		}
 		return nil
 	}
 
 	if request.OperationType == Read {
-		if len(s.OperationsPerformed) == 0 {
-			reply.Succeeded = true
-			reply.OperationType = Read
-			reply.Data = s.Data
-			reply.ReadVector = request.ReadVector
-			reply.WriteVector = request.WriteVector
-		}
-
 		reply.Succeeded = true
 		reply.OperationType = Read
-		reply.Data = s.Data
+		if latest, ok := s.latestOperation(); ok && expired(latest, s.Config.clock().Now()) {
+			// The value expired: the read finds nothing, even on a server not yet told so by
+			// the tombstone.
+			reply.Data = 0
+		} else {
+			reply.Data = s.value()
+			// The genesis operation of an InitialValue counts as a write.
+			reply.HasValue = ok
+		}
 
 		// Update the client's read vector with the maximum of its current read vector and the server's vector clock
-		reply.ReadVector = vectorclock.GetMaxVersionVector(append([][]uint64{request.ReadVector}, append([]uint64(nil), s.VectorClock...)))
+		reply.ReadVector = vectorclock.GetMaxVersionVector([][]uint64{s.VectorClock, request.ReadVector})
 
 		reply.WriteVector = request.WriteVector
+		if s.Config.MultiValue {
+			reply.Siblings = s.siblings()
+		}
 		s.mu.Unlock()
 		return nil
 	} else {
-		s.VectorClock[s.Id] += 1
-
-		s.OperationsPerformed = append(
-			s.OperationsPerformed,
-			Operation{
-				OperationType: Write,
-				VersionVector: append([]uint64(nil), s.VectorClock...),
-				TieBreaker:    s.Id,
-				Data:          request.Data,
-			})
-		s.MyOperations = append(
-			s.MyOperations,
-			Operation{
-				OperationType: Write,
-				VersionVector: append([]uint64(nil), s.VectorClock...),
-				TieBreaker:    s.Id,
-				Data:          request.Data,
-			})
-
-		s.Data = request.Data
+		if !s.Config.inRange(request.Data) {
+			reply.Succeeded = false
+			s.mu.Unlock()
+			return fmt.Errorf("write of %d is outside the allowed range [%d, %d]", request.Data, s.Config.MinValue, s.Config.MaxValue)
+		}
+
+		var expiresAt int64
+		if !request.ExpiresAt.IsZero() {
+			expiresAt = request.ExpiresAt.UnixNano()
+		}
+		previous := s.value()
+		applied, err := s.issue(Operation{OperationType: Write, Data: request.Data, ExpiresAt: expiresAt})
+		if err != nil {
+			reply.Succeeded = false
+			s.mu.Unlock()
+			return fmt.Errorf("server %d could not log write of %d: %w", s.Id, request.Data, err)
+		}
+
+		reply.Previous = previous
 		reply.Succeeded = true
 		reply.OperationType = Write
 		reply.Data = request.Data
+		reply.HasValue = true
 		reply.ReadVector = request.ReadVector
 		reply.WriteVector = append([]uint64(nil), s.VectorClock...)
 		s.mu.Unlock()
+		if s.Config.OnWriteApplied != nil {
+			s.Config.OnWriteApplied(applied)
+		}
+		if s.Config.SyncGossip {
+			s.gossipRound(0)
+		}
+		return nil
+	}
+}
+
+// issue applies op as the server's next own operation: it stamps op with the server's next
+// version vector and sequence number, logs it to the Store, applies it and queues it for gossip.
+// It fails, changing nothing, if op can't be logged. s.mu must be held.
+func (s *Server) issue(op Operation) (Operation, error) {
+	op.VersionVector = append([]uint64(nil), s.VectorClock...)
+	op.VersionVector[s.Id]++
+	op.TieBreaker = s.Id
+	op.Seq = s.seq + 1
+	if s.Config.Checksums {
+		op.Checksum = op.computeChecksum()
+	}
+	if s.Config.Store != nil {
+		// The operation is logged before it is applied, so it is never acknowledged unlogged.
+		if err := s.Config.Store.AppendOp(op); err != nil {
+			return Operation{}, err
+		}
+	}
+
+	s.VectorClock[s.Id] += 1
+	s.seq += 1
+	s.OperationsPerformed = append(s.OperationsPerformed, op)
+	mine := op
+	mine.VersionVector = append([]uint64(nil), op.VersionVector...)
+	s.MyOperations = append(s.MyOperations, mine)
+	s.markSeen(mine)
+	s.queueReplication(mine)
+	s.Data = s.value()
+
+	s.clockCond().Broadcast()
+	if s.gossipInterval > s.Config.GossipInterval {
+		// An idle server backed off; gossip the operation at the base interval again.
+		s.gossipInterval = s.Config.GossipInterval
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return mine, nil
+}
+
+// siblings returns the values of the writes no other applied operation dominates, or nil if
+// there is only one.
+func (s *Server) siblings() []uint64 {
+	latest := undominated(make([]Operation, 0, 1), s.OperationsPerformed)
+	if len(latest) < 2 {
 		return nil
 	}
+	values := make([]uint64, len(latest))
+	for i, op := range latest {
+		values[i] = op.Data
+	}
+	return values
+}
+
+// undominated adds ops to latest, a set of operations none of which dominates another, and returns
+// the set of those no other operation dominates. The log is kept in an order consistent with
+// causality, so it is scanned from the end, where the dominating operations are.
+func undominated(latest []Operation, ops []Operation) []Operation {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		dominated := false
+		for _, l := range latest {
+			if vectorclock.CompareVersionVector(l.VersionVector, op.VersionVector) {
+				dominated = true
+				break
+			}
+		}
+		if dominated {
+			continue
+		}
+		latest = slices.DeleteFunc(latest, func(l Operation) bool {
+			return vectorclock.CompareVersionVector(op.VersionVector, l.VersionVector)
+		})
+		latest = append(latest, op)
+	}
+	return latest
+}
+
+// winner returns the operation of latest that wins over all the others under the configured
+// TieBreaker, which makes it the one that decides the register's value. latest must not be empty.
+// Operations the TieBreaker leaves tied are decided by the order the server keeps them in.
+func (c *Config) winner(latest []Operation) Operation {
+	wins := c.TieBreaker
+	if wins == nil {
+		wins = HighestServerWins
+	}
+	best := latest[0]
+	for _, op := range latest[1:] {
+		if wins(op, best) || (!wins(best, op) && c.order(op, best) > 0) {
+			best = op
+		}
+	}
+	return best
 }
 
 // oneOff checks if o2 is directly dependent on o1, i.e., if o2's vector clock is exactly one increment ahead
@@ -144,27 +544,86 @@ func oneOffVersionVector(serverId uint64, v1 []uint64, v2 []uint64) bool {
 	return true
 }
 
-// compareOperations compares two operations to determine their ordering.
-// If the operations are concurrent, the tie-breaker (server ID) is used.
-func compareOperations(o1 Operation, o2 Operation) bool {
-	if vectorclock.ConcurrentVersionVectors(o1.VersionVector, o2.VersionVector) {
-		return o1.TieBreaker > o2.TieBreaker
+// operationOrder orders operations totally and consistently with causality, as slices.SortFunc
+// expects: an operation sorts after every operation its vector dominates, since its vector has
+// the larger sum. Concurrent operations are ordered by that sum, then by tie-breaker (server ID),
+// so every server orders the same operations the same way whatever order they arrived in. The
+// order only arranges the log; which concurrent write the register holds is decided by winner,
+// since no total order that respects causality can also let the tie-breaker decide between
+// every pair of concurrent operations.
+func operationOrder(o1 Operation, o2 Operation) int {
+	return orderOperations(nil, o1, o2)
+}
+
+// HighestServerWins is the default Config.TieBreaker: of two concurrent operations, the one from
+// the server with the higher ID wins.
+func HighestServerWins(a, b Operation) bool {
+	return a.TieBreaker > b.TieBreaker
+}
+
+// order is the order the server keeps operations in, operationOrder with the configured
+// TieBreaker.
+func (c *Config) order(o1 Operation, o2 Operation) int {
+	return orderOperations(c.TieBreaker, o1, o2)
+}
+
+// orderOperations is operationOrder with wins deciding between operations of equal vector sum.
+// A nil wins is HighestServerWins. Operations wins leaves tied are ordered as by default.
+func orderOperations(wins func(a, b Operation) bool, o1 Operation, o2 Operation) int {
+	if c := cmp.Compare(vectorSum(o1.VersionVector), vectorSum(o2.VersionVector)); c != 0 {
+		return c
+	}
+	if wins != nil {
+		if wins(o1, o2) {
+			return 1
+		}
+		if wins(o2, o1) {
+			return -1
+		}
+	}
+	if c := cmp.Compare(o1.TieBreaker, o2.TieBreaker); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(o1.Seq, o2.Seq); c != 0 {
+		return c
+	}
+	if c := slices.Compare(o1.VersionVector, o2.VersionVector); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(o1.OperationType, o2.OperationType); c != 0 {
+		return c
+	}
+	return cmp.Compare(o1.Data, o2.Data)
+}
+
+func vectorSum(v []uint64) uint64 {
+	var sum uint64
+	for _, x := range v {
+		sum += x
+	}
+	return sum
+}
+
+// insertOperation adds op to ops, which must be sorted by order, keeping it sorted.
+// Operations are mostly applied in order, so op usually goes at the end.
+func insertOperation(ops []Operation, op Operation, order func(a, b Operation) int) []Operation {
+	if len(ops) == 0 || order(ops[len(ops)-1], op) <= 0 {
+		return append(ops, op)
 	}
-	return vectorclock.CompareVersionVector(o1.VersionVector, o2.VersionVector)
+	i, _ := slices.BinarySearchFunc(ops, op, order)
+	return slices.Insert(ops, i, op)
 }
 
 func equalOperations(x Operation, y Operation) bool {
-	return (x.OperationType == y.OperationType) && (reflect.DeepEqual(x.VersionVector, y.VersionVector)) && x.TieBreaker == y.TieBreaker && x.Data == y.Data
+	return (x.OperationType == y.OperationType) && (reflect.DeepEqual(x.VersionVector, y.VersionVector)) && x.TieBreaker == y.TieBreaker && x.Seq == y.Seq && x.Data == y.Data
 }
 
-func removeDuplicateOperationsAndSort(s []Operation) []Operation {
+func removeDuplicateOperationsAndSort(s []Operation, order func(a, b Operation) int) []Operation {
 	if len(s) < 1 {
 		return s
 	}
 
-	sort.Slice(s, func(i, j int) bool {
-		return compareOperations(s[j], s[i])
-	})
+	slices.SortFunc(s, order)
 
 	prev := 1
 	for curr := 1; curr < len(s); curr++ {
@@ -177,47 +636,204 @@ func removeDuplicateOperationsAndSort(s []Operation) []Operation {
 	return s[:prev]
 }
 
-// merge combines two lists of operations and sorts them using compareOperations.
-// what do we do about duplicate operations
-func mergePendingOperations(l1 []Operation, l2 []Operation) []Operation {
-	output := append(l1, l2...)
-	sort.Slice(output, func(i, j int) bool {
-		return compareOperations(output[j], output[i])
-	})
+// merge combines two lists of operations and sorts them using order. l2 must already be sorted,
+// as the pending operations are, so only the new ones in l1 need sorting.
+func mergePendingOperations(l1 []Operation, l2 []Operation, order func(a, b Operation) int) []Operation {
+	return mergeOperations(removeDuplicateOperationsAndSort(l1, order), l2, order)
+}
+
+// mergeOperations merges a and b, both sorted by order, into one sorted list in a single pass,
+// dropping duplicates where the two meet. When all of b sorts after a, as a gossiped batch
+// usually does after the applied log, it is appended to a instead.
+func mergeOperations(a []Operation, b []Operation, order func(a, b Operation) int) []Operation {
+	if len(a) == 0 || len(b) == 0 || order(a[len(a)-1], b[0]) < 0 {
+		return append(a, b...)
+	}
+
+	merged := make([]Operation, 0, len(a)+len(b))
+	add := func(op Operation) {
+		if n := len(merged); n == 0 || !equalOperations(merged[n-1], op) {
+			merged = append(merged, op)
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if order(b[j], a[i]) < 0 {
+			add(b[j])
+			j++
+		} else {
+			add(a[i])
+			i++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(a[i])
+	}
+	for ; j < len(b); j++ {
+		add(b[j])
+	}
+	return merged
+}
 
-	return removeDuplicateOperationsAndSort(output)
+// compressOperations gob-encodes ops and gzips the result.
+func compressOperations(ops []Operation) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(ops); err != nil {
+		return nil, fmt.Errorf("encoding operations: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing operations: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressOperations reverses compressOperations.
+func decompressOperations(data []byte) ([]Operation, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing operations: %w", err)
+	}
+	defer zr.Close()
+	var ops []Operation
+	if err := gob.NewDecoder(zr).Decode(&ops); err != nil {
+		return nil, fmt.Errorf("decoding operations: %w", err)
+	}
+	return ops, nil
 }
 
 // ReceiveGossip processes incoming gossip messages from peers and updates the server's state.
 func (s *Server) ReceiveGossip(request *GossipRequest, reply *GossipReply) error {
+	reply.ProtocolVersion = ProtocolVersion
+	if err := checkProtocolVersion(fmt.Sprintf("gossip from server %d", request.ServerId), request.ProtocolVersion); err != nil {
+		log.Printf("[WARN] server %d rejecting %v", s.Id, err)
+		return err
+	}
+	if err := s.Config.checkPayloadSize(fmt.Sprintf("gossip from server %d", request.ServerId), gossipSize(request)); err != nil {
+		log.Printf("[WARN] server %d rejecting %v", s.Id, err)
+		return err
+	}
+	if len(request.Compressed) > 0 {
+		operations, err := decompressOperations(request.Compressed)
+		if err != nil {
+			log.Printf("[WARN] server %d rejecting gossip from server %d: %v", s.Id, request.ServerId, err)
+			return fmt.Errorf("gossip from server %d: %w", request.ServerId, err)
+		}
+		request.Operations, request.Compressed = append(request.Operations, operations...), nil
+		// The limit applies to what the operations take up once decompressed as well.
+		if err := s.Config.checkPayloadSize(fmt.Sprintf("gossip from server %d", request.ServerId), gossipSize(request)); err != nil {
+			log.Printf("[WARN] server %d rejecting %v", s.Id, err)
+			return err
+		}
+	}
+	if s.Config.OnGossipReceived != nil {
+		s.Config.OnGossipReceived(request.ServerId, len(request.Operations))
+	}
+
 	s.mu.Lock()
+	s.heardFrom(request.ServerId, s.Config.clock().Now())
+	reply.ServerId = s.Id
+	reply.VectorClock = append([]uint64(nil), s.VectorClock...)
+	reply.MembershipEpoch = s.Config.MembershipEpoch
+
+	// Within one membership epoch every server has the same clock width, so a mismatch means
+	// the peer is misconfigured and none of its vectors can be trusted.
+	widthMismatch := len(request.VectorClock) != 0 && len(request.VectorClock) != len(s.VectorClock)
+	for _, op := range request.Operations {
+		widthMismatch = widthMismatch || len(op.VersionVector) != len(s.VectorClock)
+	}
+	if widthMismatch && request.MembershipEpoch == s.Config.MembershipEpoch {
+		log.Printf("[WARN] server %d rejecting gossip from server %d: clock width differs within membership epoch %d",
+			s.Id, request.ServerId, s.Config.MembershipEpoch)
+		s.mu.Unlock()
+		return nil
+	}
+
+	if clock, ok := coerceVersionVector(request.VectorClock, len(s.VectorClock)); ok {
+		s.recordPeerClock(request.ServerId, clock)
+	}
+
 	if len(request.Operations) == 0 {
 		s.mu.Unlock()
 		return nil
 	}
 
-	s.PendingOperations = mergePendingOperations(request.Operations, s.PendingOperations)
+	operations := make([]Operation, 0, len(request.Operations))
+	for _, op := range request.Operations {
+		if s.Config.Checksums && op.Checksum != op.computeChecksum() {
+			log.Printf("[ERROR] server %d rejecting gossiped operation %+v from server %d: its checksum does not match its contents",
+				s.Id, op, request.ServerId)
+			continue
+		}
 
-	latestVersionVector := make([]uint64, len(s.Peers))
-	if len(s.OperationsPerformed) != 0 {
-		latestVersionVector = operationsGetMaxVersionVector(s.OperationsPerformed)
-		// s.OperationsPerformed[len(s.OperationsPerformed)-1].VersionVector
+		// During a membership change the peer's clocks may be wider or narrower than ours.
+		vector, ok := coerceVersionVector(op.VersionVector, len(s.VectorClock))
+		if !ok {
+			log.Printf("[WARN] server %d skipping gossiped operation %v from server %d (epoch %d): it depends on servers outside this server's membership (epoch %d)",
+				s.Id, op.VersionVector, request.ServerId, request.MembershipEpoch, s.Config.MembershipEpoch)
+			continue
+		}
+		coerced := len(vector) != len(op.VersionVector)
+		op.VersionVector = vector
+		if s.Config.Checksums && coerced {
+			op.Checksum = op.computeChecksum()
+		}
+
+		// Peers re-send everything they know each round, so most operations are already here.
+		if s.hasSeen(op) {
+			continue
+		}
+
+		// A peer with different bounds may have accepted writes this server would reject.
+		if op.OperationType == Write && !s.Config.inRange(op.Data) {
+			log.Printf("[WARN] server %d skipping gossiped write of %d from server %d: outside the allowed range [%d, %d]",
+				s.Id, op.Data, request.ServerId, s.Config.MinValue, s.Config.MaxValue)
+			continue
+		}
+		operations = append(operations, op)
 	}
 
+	if len(operations) == 0 {
+		reply.VectorClock = append([]uint64(nil), s.VectorClock...)
+		s.mu.Unlock()
+		return nil
+	}
+	for _, op := range operations {
+		s.markSeen(op)
+	}
+
+	s.PendingOperations = mergePendingOperations(operations, s.PendingOperations, s.Config.order)
+
+	// The clock is the max over every applied operation, and applying only ever raises it, so it
+	// is kept up to date one operation at a time instead of rescanning the whole log.
+	latestVersionVector := append([]uint64(nil), s.VectorClock...)
+
+	// Applicable operations are collected in order and merged into the log once at the end.
+	var batch, applied []Operation
 	i := 0
 	for i < len(s.PendingOperations) {
 		// perform operation if it doesn't have any dependencies and remove it from the pending operations
 		if vectorclock.CompareVersionVector(latestVersionVector, s.PendingOperations[i].VersionVector) {
 			i += 1
 		} else if oneOffVersionVector(s.Id, latestVersionVector, s.PendingOperations[i].VersionVector) {
-			s.OperationsPerformed = append(s.OperationsPerformed, s.PendingOperations[i])
-			latestVersionVector = operationsGetMaxVersionVector(s.OperationsPerformed) // s.OperationsPerformed[len(s.OperationsPerformed)-1].VersionVector
+			if vectorclock.ConcurrentVersionVectors(latestVersionVector, s.PendingOperations[i].VersionVector) {
+				s.ConcurrentWrites += 1
+			}
+			batch = append(batch, s.PendingOperations[i])
+			if s.Config.OnWriteApplied != nil && s.PendingOperations[i].OperationType == Write {
+				applied = append(applied, s.PendingOperations[i])
+			}
+			maxVersionVectorInto(latestVersionVector, s.PendingOperations[i].VersionVector)
 			i += 1
 		} else {
 			break
 		}
 	}
 
+	s.OperationsPerformed = mergeOperations(s.OperationsPerformed, batch, s.Config.order)
+	s.persist(batch)
+	s.queueReplication(batch...)
+
 	if i == len(s.PendingOperations) {
 		s.PendingOperations = make([]Operation, 0)
 	} else {
@@ -225,36 +841,676 @@ func (s *Server) ReceiveGossip(request *GossipRequest, reply *GossipReply) error
 		s.PendingOperations = s.PendingOperations[i:]
 	}
 
-	sort.Slice(s.OperationsPerformed, func(i, j int) bool {
-		return compareOperations(s.OperationsPerformed[j], s.OperationsPerformed[i])
-	})
+	s.VectorClock = latestVersionVector
+	s.Data = s.value()
+	reply.VectorClock = append([]uint64(nil), s.VectorClock...)
+	s.clockCond().Broadcast()
+	s.mu.Unlock()
+
+	for _, op := range applied {
+		s.Config.OnWriteApplied(op)
+	}
+	return nil
+}
+
+// persist logs operations applied from gossip to the configured store, if any. One that fails
+// to be logged is still applied: after a restart the server reports a clock without it, and
+// peers gossip it again. Callers must hold s.mu.
+func (s *Server) persist(ops []Operation) {
+	if s.Config.Store == nil {
+		return
+	}
+	for _, op := range ops {
+		if err := s.Config.Store.AppendOp(op); err != nil {
+			log.Printf("[ERROR] server %d could not log gossiped operation %v: %v", s.Id, op.VersionVector, err)
+			return
+		}
+	}
+}
+
+// recover rebuilds the register from the configured store: the snapshot, the logged operations
+// and, among them, the server's own writes, which it gossips again since peers may not have them.
+func (s *Server) recover() error {
+	snapshot, ok, err := s.Config.Store.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+	ops, err := s.Config.Store.LoadAll()
+	if err != nil {
+		return fmt.Errorf("loading operations: %w", err)
+	}
+	if s.Config.Checksums {
+		// The snapshot stands for operations no longer in the log, so it can't be dropped.
+		if ok && snapshot.Checksum != snapshot.computeChecksum() {
+			return fmt.Errorf("snapshot %+v: its checksum does not match its contents", snapshot)
+		}
+		// A dropped operation is still in its issuer's log, and gossip brings it back.
+		valid := ops[:0]
+		for _, op := range ops {
+			if op.Checksum != op.computeChecksum() {
+				log.Printf("[ERROR] server %d dropping stored operation %+v: its checksum does not match its contents", s.Id, op)
+				continue
+			}
+			valid = append(valid, op)
+		}
+		ops = valid
+	}
+	all := ops
+	if ok {
+		all = append([]Operation{snapshot}, ops...)
+	}
+	for _, op := range all {
+		if len(op.VersionVector) != len(s.VectorClock) {
+			return fmt.Errorf("stored operation %v does not fit a clock of width %d", op.VersionVector, len(s.VectorClock))
+		}
+	}
+
+	if ok {
+		s.snapshot = snapshot
+	}
+	for _, op := range all {
+		maxVersionVectorInto(s.VectorClock, op.VersionVector)
+		s.markSeen(op)
+		if op.TieBreaker == s.Id {
+			s.seq = max(s.seq, op.Seq)
+		}
+	}
+	for _, op := range ops {
+		s.OperationsPerformed = append(s.OperationsPerformed, op)
+		if op.TieBreaker == s.Id {
+			s.MyOperations = append(s.MyOperations, op)
+		}
+	}
+	s.OperationsPerformed = removeDuplicateOperationsAndSort(s.OperationsPerformed, s.Config.order)
+	slices.SortFunc(s.MyOperations, func(a, b Operation) int { return cmp.Compare(a.Seq, b.Seq) })
+	s.Data = s.value()
+	if len(all) > 0 {
+		log.Printf("[INFO] server %d recovered %d operations, value %d at %v", s.Id, len(all), s.Data, s.VectorClock)
+	}
+	return nil
+}
+
+// idOf returns the identity of op. An operation without a sequence number has no usable
+// identity and is never treated as seen.
+func idOf(op Operation) (operationId, bool) {
+	if op.Seq == 0 {
+		return operationId{}, false
+	}
+	return operationId{Origin: op.TieBreaker, Seq: op.Seq}, true
+}
+
+// hasSeen reports whether op is already applied or pending on this server.
+func (s *Server) hasSeen(op Operation) bool {
+	id, ok := idOf(op)
+	if !ok {
+		return false
+	}
+	_, seen := s.seen[id]
+	return seen
+}
+
+// markSeen records op so later copies of it are skipped.
+func (s *Server) markSeen(op Operation) {
+	id, ok := idOf(op)
+	if !ok {
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[operationId]struct{})
+	}
+	s.seen[id] = struct{}{}
+}
+
+// coerceVersionVector adapts a vector from a peer with a different clock width to the given width.
+// Shorter vectors are zero-padded. Longer vectors are truncated if the extra entries are all zero,
+// since those servers contributed nothing; otherwise the vector can't be represented locally.
+func coerceVersionVector(v []uint64, width int) ([]uint64, bool) {
+	if len(v) == width {
+		return v, true
+	}
+	if len(v) < width {
+		padded := make([]uint64, width)
+		copy(padded, v)
+		return padded, true
+	}
+	for _, entry := range v[width:] {
+		if entry != 0 {
+			return nil, false
+		}
+	}
+	return append([]uint64(nil), v[:width]...), true
+}
+
+// recordPeerClock remembers the latest vector clock heard from a peer. Callers must hold s.mu.
+func (s *Server) recordPeerClock(peerId uint64, clock []uint64) {
+	if len(clock) == 0 || peerId == s.Id {
+		return
+	}
+	s.peerClocks[peerId] = append([]uint64(nil), clock...)
+}
+
+// ConvergenceLag returns, for each clock entry, how far this server is behind the most advanced
+// clock it has heard from any peer. It is only as fresh as the last gossip exchanged with each peer.
+func (s *Server) ConvergenceLag() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.convergenceLag()
+}
+
+func (s *Server) convergenceLag() []uint64 {
+	clocks := [][]uint64{s.VectorClock}
+	for _, clock := range s.peerClocks {
+		if len(clock) == len(s.VectorClock) {
+			clocks = append(clocks, clock)
+		}
+	}
+	frontier := vectorclock.GetMaxVersionVector(clocks)
+
+	lag := make([]uint64, len(s.VectorClock))
+	for i := range lag {
+		lag[i] = frontier[i] - s.VectorClock[i]
+	}
+	return lag
+}
+
+// ServerInfo reports the server's build version and the configuration that must agree across the
+// cluster, so clients can detect misconfigured servers.
+func (s *Server) ServerInfo(request *ServerInfoRequest, reply *ServerInfoReply) error {
+	reply.ServerId = s.Id
+	reply.Version = Version
+	reply.ClusterSize = len(s.VectorClock)
+	reply.GossipInterval = s.Config.GossipInterval
+	reply.PeerListHash = peerListHash(s.Peers)
+	return nil
+}
+
+// peerListHash hashes the network and address of every peer, in order.
+func peerListHash(peers []*protocol.Connection) uint64 {
+	h := fnv.New64a()
+	for _, p := range peers {
+		fmt.Fprintf(h, "%s/%s\n", p.Network, p.Address)
+	}
+	return h.Sum64()
+}
 
-	if len(s.OperationsPerformed) != 0 {
-		s.Data = s.OperationsPerformed[len(s.OperationsPerformed)-1].Data
-		s.VectorClock = operationsGetMaxVersionVector(s.OperationsPerformed)
+// ListPeers reports the cluster's membership as the server knows it: itself and its peers,
+// ordered by server ID so clients can index their vectors by position in the list.
+func (s *Server) ListPeers(request *ListPeersRequest, reply *ListPeersReply) error {
+	servers := make([]*protocol.Connection, len(s.VectorClock))
+	if int(s.Id) < len(servers) {
+		servers[s.Id] = s.Self
 	}
+	for _, p := range s.peers {
+		if int(p.Id) < len(servers) {
+			servers[p.Id] = p.Conn
+		}
+	}
+	reply.Servers = servers
+	return nil
+}
+
+// Inspect reports the server's current state for monitoring and diagnostics.
+func (s *Server) Inspect(request *InspectRequest, reply *InspectReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply.ServerId = s.Id
+	reply.Data = s.Data
+	reply.VectorClock = append([]uint64(nil), s.VectorClock...)
+	reply.PendingOperations = len(s.PendingOperations)
+	reply.ConvergenceLag = s.convergenceLag()
+	reply.ConcurrentWrites = s.ConcurrentWrites
+	reply.Peers = s.peerStatuses()
+	return nil
+}
+
+// selfTestTimeout bounds how long the startup self-test waits for its peer to come up.
+const selfTestTimeout = 5 * time.Second
+
+// runSelfTest runs the startup self-test, then either marks the server ready or stops it.
+func (s *Server) runSelfTest() {
+	err := s.selfTest()
+	if err == nil {
+		log.Printf("[INFO] server %d passed its startup self-test", s.Id)
+		s.notReady.Store(false)
+		return
+	}
+
+	log.Printf("[ERROR] server %d failed its startup self-test, stopping: %v", s.Id, err)
+	s.mu.Lock()
+	s.selfTestErr = fmt.Errorf("startup self-test: %w", err)
+	s.mu.Unlock()
+	s.Stop()
+}
+
+// selfTest checks that a write and a read behave as expected on a scratch server with this
+// server's configuration, and that the first peer speaks the same protocol with the same
+// cluster size. It leaves the register itself untouched: the scratch server has no Store,
+// hooks or Replicate, and doesn't gossip, so its probe write is seen nowhere else.
+func (s *Server) selfTest() error {
+	s.mu.Lock()
+	width := len(s.VectorClock)
 	s.mu.Unlock()
+
+	config := s.Config
+	config.Store = nil
+	config.SyncGossip = false
+	config.OnWriteApplied = nil
+	config.OnGossipReceived = nil
+	config.OnDependencyRejected = nil
+	config.Replicate = nil
+	scratch := &Server{Id: s.Id, Config: config, VectorClock: make([]uint64, width), peerClocks: make(map[uint64][]uint64)}
+	value := max(s.Config.MinValue, 1)
+	if s.Config.MaxValue != 0 && value > s.Config.MaxValue {
+		value = s.Config.MaxValue
+	}
+	written := ClientReply{}
+	err := scratch.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Causal, Data: value}, &written)
+	if err != nil || !written.Succeeded {
+		return fmt.Errorf("write of %d failed: %v", value, err)
+	}
+	read := ClientReply{}
+	err = scratch.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal, WriteVector: written.WriteVector}, &read)
+	if err != nil || !read.Succeeded || read.Data != value {
+		return fmt.Errorf("read after writing %d returned %d, %v", value, read.Data, err)
+	}
+
+	if len(s.peers) == 0 {
+		return nil
+	}
+	p := s.peers[0]
+	info := ServerInfoReply{}
+	clock := s.Config.clock()
+	for deadline := clock.Now().Add(selfTestTimeout); ; {
+		// A peer that is reachable always reports a cluster size of at least one.
+		err := s.Config.Transport.Invoke(*p.Conn, "Server.ServerInfo", &ServerInfoRequest{}, &info)
+		if err == nil && info.ClusterSize != 0 {
+			break
+		}
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("peer %d at %s did not respond", p.Id, p.Conn.Address)
+		}
+		clock.Sleep(50 * time.Millisecond)
+	}
+	if info.ServerId != p.Id {
+		return fmt.Errorf("peer at %s is server %d, but this server expects server %d there", p.Conn.Address, info.ServerId, p.Id)
+	}
+	if info.ClusterSize != width {
+		return fmt.Errorf("peer %d has a cluster size of %d, but this server has %d", p.Id, info.ClusterSize, width)
+	}
+
+	gossip := &GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: s.Id, VectorClock: make([]uint64, width), MembershipEpoch: s.Config.MembershipEpoch}
+	reply := &GossipReply{}
+	if err := s.Config.Transport.Invoke(*p.Conn, "Server.ReceiveGossip", &gossip, &reply); err != nil || reply.ProtocolVersion != ProtocolVersion {
+		return fmt.Errorf("peer %d did not accept gossip of protocol version %d: %v", p.Id, ProtocolVersion, err)
+	}
 	return nil
 }
 
-// sendGossip sends the server's operations to all peers to synchronize state.
+// sendGossip periodically sends the server's operations to all peers to synchronize state.
 func (s *Server) sendGossip() {
+	defer s.loop.Done()
 	for {
-		ms := 50
-		time.Sleep(time.Duration(ms) * time.Millisecond)
-
-		if len(s.MyOperations) == 0 {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+			// A write reset the interval; wait again from the base interval.
 			continue
+		case <-s.Config.clock().After(s.currentGossipInterval()):
 		}
+		s.gossipTick()
+	}
+}
+
+// gossipTick runs one round of the gossip loop and adapts the interval to the next one.
+func (s *Server) gossipTick() {
+	s.sweepExpired()
+	sent := s.gossipOnce()
+	s.GarbageCollect()
+	s.adaptGossipInterval(sent)
+}
+
+// currentGossipInterval returns how long the gossip loop waits before its next round.
+func (s *Server) currentGossipInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gossipInterval == 0 {
+		return s.Config.GossipInterval
+	}
+	return s.gossipInterval
+}
+
+// adaptGossipInterval doubles the gossip interval, up to MaxGossipInterval, after a round that
+// sent no operations, and returns it to GossipInterval after one that did.
+func (s *Server) adaptGossipInterval(sent int) {
+	if s.Config.MaxGossipInterval <= s.Config.GossipInterval {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent > 0 || s.gossipInterval == 0 {
+		s.gossipInterval = s.Config.GossipInterval
+	}
+	if sent == 0 {
+		s.gossipInterval = min(2*s.gossipInterval, s.Config.MaxGossipInterval)
+	}
+}
+
+// Gossip sends one round of gossip now instead of at the next interval.
+func (s *Server) Gossip() {
+	s.gossipOnce()
+}
+
+// gossipOnce sends every peer the server's own operations it isn't known to have yet, split into
+// messages within the configured limits. A peer that is far behind catches up over consecutive
+// messages, each applied as it arrives; one that is up to date still gets an empty message, so
+// its reply keeps this server's view of its clock fresh. With a GossipFanout only that many peers
+// get the round, those synced with least recently. Suspected peers are only tried once per
+// SuspectRetryInterval. It returns how many operations peers accepted.
+func (s *Server) gossipOnce() int {
+	return s.gossipRound(s.Config.GossipFanout)
+}
+
+// gossipRound sends a round of gossip like gossipOnce, to at most fanout peers that aren't
+// suspected, or to all of them if fanout is 0.
+func (s *Server) gossipRound(fanout int) int {
+	s.mu.Lock()
+	if len(s.MyOperations) == 0 {
+		s.mu.Unlock()
+		return 0
+	}
+	operations := append([]Operation(nil), s.MyOperations...)
+	clock := append([]uint64(nil), s.VectorClock...)
+	targets := s.gossipTargets(s.Config.clock().Now(), fanout)
+	unsent := make([][]Operation, len(targets))
+	for i, p := range targets {
+		unsent[i] = s.unsent(p.Id, operations)
+	}
+	resets := s.resets
+	s.mu.Unlock()
+
+	sent := 0
+	for i, p := range targets {
+		var err error
+		for _, chunk := range s.Config.gossipChunks(unsent[i], clock) {
+			req := &GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: s.Id, Operations: chunk, VectorClock: clock, MembershipEpoch: s.Config.MembershipEpoch}
+			if s.Config.CompressGossip {
+				compressed, err := compressOperations(chunk)
+				if err != nil {
+					log.Printf("[ERROR] server %d could not compress gossip: %v", s.Id, err)
+					break
+				}
+				req.Operations, req.Compressed = nil, compressed
+			}
+			reply := &GossipReply{}
+			if err = s.Config.Transport.Invoke(*p.Conn, "Server.ReceiveGossip", &req, &reply); err != nil {
+				break
+			}
+			sent += len(chunk)
+			s.mu.Lock()
+			// Replies to gossip sent before a Reset describe state this server no longer has.
+			if s.resets == resets {
+				s.recordPeerClock(p.Id, reply.VectorClock)
+			}
+			s.mu.Unlock()
+		}
+		now := s.Config.clock().Now()
+		s.mu.Lock()
+		s.recordContact(p.Id, err == nil, now)
+		if err == nil {
+			s.livenessOf(p.Id).lastSynced = now
+		}
+		s.mu.Unlock()
+	}
+	return sent
+}
+
+// unsent returns the suffix of operations, the server's own in the order it issued them, that
+// the peer's last reported clock doesn't cover. That clock acknowledges everything the peer has
+// applied, whether it arrived in a reply to gossip or in the peer's own gossip, so nothing it
+// has is sent again however long MyOperations grows. Callers must hold s.mu.
+func (s *Server) unsent(peerId uint64, operations []Operation) []Operation {
+	clock := s.peerClocks[peerId]
+	if int(s.Id) >= len(clock) {
+		return operations
+	}
+	i := sort.Search(len(operations), func(i int) bool {
+		return operations[i].VersionVector[s.Id] > clock[s.Id]
+	})
+	return operations[i:]
+}
+
+// gossipChunks splits operations into consecutive runs that each fit in a gossip message carrying
+// clock under MaxGossipOperations and MaxPayloadBytes. An operation too large for any message
+// gets one of its own, which the peer will reject.
+func (c Config) gossipChunks(operations []Operation, clock []uint64) [][]Operation {
+	var chunks [][]Operation
+	start, size := 0, gossipHeaderSize(clock)
+	for i, op := range operations {
+		full := c.MaxGossipOperations > 0 && i-start == c.MaxGossipOperations
+		full = full || (c.MaxPayloadBytes > 0 && i > start && size+operationSize(op) > c.MaxPayloadBytes)
+		if full {
+			chunks = append(chunks, operations[start:i])
+			start, size = i, gossipHeaderSize(clock)
+		}
+		size += operationSize(op)
+	}
+	return append(chunks, operations[start:])
+}
+
+// StableFrontier returns the element-wise minimum of the server's clock and the last clock heard
+// from every peer: every server has applied every operation the frontier covers. It is only as
+// fresh as the last gossip exchanged with each peer, so it may lag behind the cluster, but never
+// runs ahead of it. It is nil until every peer has reported a clock.
+func (s *Server) StableFrontier() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stableFrontier()
+}
+
+// stableFrontier is StableFrontier for callers that hold s.mu.
+func (s *Server) stableFrontier() []uint64 {
+	frontier := append([]uint64(nil), s.VectorClock...)
+	for _, p := range s.peers {
+		clock, ok := s.peerClocks[p.Id]
+		if !ok || len(clock) != len(frontier) {
+			return nil
+		}
+		for i := range frontier {
+			frontier[i] = min(frontier[i], clock[i])
+		}
+	}
+	return frontier
+}
+
+// GarbageCollect drops the operations every server has applied, so no gossip can still depend
+// on them, and returns how many it dropped from the applied log. Applied operations are only
+// dropped once the latest one dominates them, so the value and any siblings a read reports stay
+// the same. The server's own operations are dropped from the gossip log as soon as every peer
+// has them. It runs after every gossip round.
+func (s *Server) GarbageCollect() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		for i := range s.Peers {
-			if i != int(s.Id) {
-				req := &GossipRequest{ServerId: s.Id, Operations: s.MyOperations}
-				reply := &GossipReply{}
-				protocol.Invoke(*s.Peers[i], "Server.ReceiveGossip", &req, &reply)
+	frontier := s.stableFrontier()
+	if frontier == nil {
+		return 0
+	}
+
+	removed := 0
+	if n := len(s.OperationsPerformed); n > 1 {
+		latest := s.OperationsPerformed[n-1]
+		kept := s.OperationsPerformed[:0]
+		for _, op := range s.OperationsPerformed[:n-1] {
+			if covers(frontier, op.VersionVector) && vectorclock.CompareVersionVector(latest.VersionVector, op.VersionVector) {
+				// The clock covers it, so re-gossip of it is ignored without the seen set.
+				if id, ok := idOf(op); ok {
+					delete(s.seen, id)
+				}
+				removed++
+				continue
 			}
+			kept = append(kept, op)
+		}
+		s.OperationsPerformed = append(kept, latest)
+	}
+
+	stable := 0
+	for stable < len(s.MyOperations) && covers(frontier, s.MyOperations[stable].VersionVector) {
+		stable++
+	}
+	if stable > 0 {
+		s.MyOperations = append([]Operation(nil), s.MyOperations[stable:]...)
+	}
+	return removed
+}
+
+// Compact folds the applied operations every server has, from the start of the log, into a
+// snapshot of the one that decides their value, and returns how many it folded. Unlike GarbageCollect it may
+// fold every operation, so the register's value is defined by the snapshot and the log together.
+// Reads then see no siblings among the folded operations.
+func (s *Server) Compact() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frontier := s.stableFrontier()
+	if frontier == nil {
+		return 0
+	}
+	folded := 0
+	for folded < len(s.OperationsPerformed) && covers(frontier, s.OperationsPerformed[folded].VersionVector) {
+		folded++
+	}
+	if folded > 0 {
+		var latest []Operation
+		if s.hasSnapshot() {
+			latest = append(latest, s.snapshot)
 		}
+		s.snapshot = s.Config.winner(undominated(latest, s.OperationsPerformed[:folded]))
+	}
+	s.OperationsPerformed = append([]Operation(nil), s.OperationsPerformed[folded:]...)
+	if folded > 0 && s.Config.Store != nil {
+		if err := s.Config.Store.SaveSnapshot(s.snapshot, s.OperationsPerformed); err != nil {
+			log.Printf("[ERROR] server %d could not save its snapshot: %v", s.Id, err)
+		}
+	}
+	return folded
+}
+
+func (s *Server) hasSnapshot() bool {
+	return s.snapshot.VersionVector != nil
+}
+
+// value returns the register's value: that of the operation latestOperation picks. Callers must
+// hold s.mu.
+func (s *Server) value() uint64 {
+	if latest, ok := s.latestOperation(); ok {
+		return latest.Data
+	}
+	return s.Data
+}
+
+// latestOperation returns the operation that decides the register's value: of the operations in
+// the snapshot and the log that no other one dominates, the one that wins under the TieBreaker.
+// An operation concurrent with the snapshot can arrive after compaction, so the log alone doesn't
+// decide. It reports false if there is no operation at all. s.mu must be held.
+func (s *Server) latestOperation() (Operation, bool) {
+	// The clock covers every applied operation, so an operation with the clock's vector dominates
+	// all of them. That is always so after a local write.
+	if n := len(s.OperationsPerformed); n > 0 && len(s.OperationsPerformed[n-1].VersionVector) == len(s.VectorClock) &&
+		vectorclock.CompareVersionVector(s.OperationsPerformed[n-1].VersionVector, s.VectorClock) {
+		return s.OperationsPerformed[n-1], true
 	}
+	var latest []Operation
+	if s.hasSnapshot() {
+		latest = append(latest, s.snapshot)
+	}
+	latest = undominated(latest, s.OperationsPerformed)
+	if len(latest) == 0 {
+		return Operation{}, false
+	}
+	return s.Config.winner(latest), true
+}
+
+// expired reports whether op, as the latest operation, leaves the register without a value at
+// now: it is a tombstone, or a write whose expiry time has passed.
+func expired(op Operation, now time.Time) bool {
+	return op.OperationType == Expire || (op.ExpiresAt != 0 && now.UnixNano() >= op.ExpiresAt)
+}
+
+// sweepExpired issues a tombstone if the latest operation is one of the server's own writes and
+// has expired. Expiry follows each server's own clock, so servers whose clocks differ disagree
+// about a value near its expiry; the tombstone, gossiped like a write, makes every server agree
+// once it arrives, however far its clock lags. Only the issuing server sweeps, so there is one
+// tombstone per expired write, but if it is down the others still read the value as expired.
+func (s *Server) sweepExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest, ok := s.latestOperation()
+	if !ok || s.stopped || latest.OperationType != Write || latest.TieBreaker != s.Id || !expired(latest, s.Config.clock().Now()) {
+		return
+	}
+	if _, err := s.issue(Operation{OperationType: Expire}); err != nil {
+		log.Printf("[ERROR] server %d could not log the tombstone of expired write %+v: %v", s.Id, latest, err)
+	}
+}
+
+// Reset wipes the register's state, returning the server to the state New left it in while
+// keeping its ID, peers and config. Gossip already sent to peers can't be recalled, so their
+// operations return unless they are reset too.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.VectorClock = make([]uint64, len(s.VectorClock))
+	s.OperationsPerformed = make([]Operation, 0)
+	s.MyOperations = make([]Operation, 0)
+	s.PendingOperations = make([]Operation, 0)
+	s.Data = 0
+	s.snapshot = Operation{}
+	s.ConcurrentWrites = 0
+	s.peerClocks = make(map[uint64][]uint64)
+	s.seen = make(map[operationId]struct{})
+	s.lastDependencies = dependencies{}
+	s.resets++
+	s.applyGenesis()
+	if s.Config.Store != nil {
+		if err := s.Config.Store.SaveSnapshot(Operation{}, nil); err != nil {
+			log.Printf("[ERROR] server %d could not clear its store: %v", s.Id, err)
+		}
+	}
+}
+
+// InjectOperations adds ops to the server's log as if they had been applied, bypassing clients
+// and gossip, and re-derives the clock and value from the log. It lets tests set up an arbitrary
+// starting state. The operations are not gossiped. It fails, changing nothing, if an operation's
+// version vector isn't as wide as the server's clock.
+func (s *Server) InjectOperations(ops []Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, op := range ops {
+		if len(op.VersionVector) != len(s.VectorClock) {
+			return fmt.Errorf("operation %v has a version vector of width %d; server %d's clock has width %d",
+				op, len(op.VersionVector), s.Id, len(s.VectorClock))
+		}
+	}
+
+	for _, op := range ops {
+		op.VersionVector = append([]uint64(nil), op.VersionVector...)
+		s.OperationsPerformed = append(s.OperationsPerformed, op)
+		s.markSeen(op)
+		// Later writes must not reuse the identity of an injected one.
+		if op.TieBreaker == s.Id {
+			s.seq = max(s.seq, op.Seq)
+		}
+	}
+	s.OperationsPerformed = removeDuplicateOperationsAndSort(s.OperationsPerformed, s.Config.order)
+	maxVersionVectorInto(s.VectorClock, operationsGetMaxVersionVector(s.OperationsPerformed))
+	s.Data = s.value()
+	s.clockCond().Broadcast()
+	return nil
 }
 
 func (s *Server) PrintOperations(request *ClientRequest, reply *ClientReply) error {
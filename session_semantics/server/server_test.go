@@ -0,0 +1,2034 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+	"github.com/alanwang67/distributed_registers/session_semantics/vectorclock"
+)
+
+// gossipRecorder stands in for a peer server and counts the gossip it receives.
+type gossipRecorder struct {
+	mu       sync.Mutex
+	received map[uint64]int
+}
+
+func (g *gossipRecorder) ReceiveGossip(request *GossipRequest, reply *GossipReply) error {
+	g.mu.Lock()
+	g.received[request.ServerId]++
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *gossipRecorder) count(serverId uint64) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.received[serverId]
+}
+
+// startRecorder serves a gossipRecorder under the "Server" RPC name on an ephemeral port.
+func startRecorder(t *testing.T) (*gossipRecorder, *protocol.Connection) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	g := &gossipRecorder{received: make(map[uint64]int)}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Server", g); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	go srv.Accept(l)
+
+	return g, &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+}
+
+// newTestServer creates server id in a cluster of n servers whose peers are unreachable, so
+// tests drive it by calling its handlers directly.
+func newTestServer(t *testing.T, id uint64, n int, config Config) *Server {
+	t.Helper()
+	conns := make([]*protocol.Connection, n)
+	for i := range conns {
+		conns[i] = &protocol.Connection{Network: "tcp", Address: fmt.Sprintf("server-%d", i)}
+	}
+	s, err := NewWithConfig(id, conns[id], conns, config)
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+	return s
+}
+
+func write(s *Server, value uint64) (ClientReply, error) {
+	reply := ClientReply{}
+	err := s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion,
+		OperationType: Write,
+		SessionType:   Causal,
+		Data:          value,
+		ReadVector:    make([]uint64, len(s.VectorClock)),
+		WriteVector:   make([]uint64, len(s.VectorClock)),
+	}, &reply)
+	return reply, err
+}
+
+func TestResolvePeers(t *testing.T) {
+	a := &protocol.Connection{Network: "tcp", Address: "a"}
+	b := &protocol.Connection{Network: "tcp", Address: "b"}
+	c := &protocol.Connection{Network: "tcp", Address: "c"}
+
+	tests := []struct {
+		id     uint64
+		self   *protocol.Connection
+		peers  []*protocol.Connection
+		expect []peer
+	}{
+		{1, b, []*protocol.Connection{a, b, c}, []peer{{0, a}, {2, c}}}, // peers include self
+		{1, b, []*protocol.Connection{a, c}, []peer{{0, a}, {2, c}}},    // peers exclude self
+		{0, a, []*protocol.Connection{b, c}, []peer{{1, b}, {2, c}}},    // self is the lowest ID
+		{2, c, []*protocol.Connection{a, b}, []peer{{0, a}, {1, b}}},    // self is the highest ID
+		{0, a, nil, []peer{}}, // no peers
+	}
+
+	for _, tt := range tests {
+		result := resolvePeers(tt.id, tt.self, tt.peers)
+		if len(result) != len(tt.expect) {
+			t.Fatalf("resolvePeers(%d) = %v; want %v", tt.id, result, tt.expect)
+		}
+		for i := range result {
+			if result[i] != tt.expect[i] {
+				t.Errorf("resolvePeers(%d)[%d] = %v; want %v", tt.id, i, result[i], tt.expect[i])
+			}
+		}
+	}
+}
+
+func TestGossipReachesEveryPeerOnce(t *testing.T) {
+	self, selfConn := startRecorder(t)
+	p1, conn1 := startRecorder(t)
+	p2, conn2 := startRecorder(t)
+
+	configs := map[string][]*protocol.Connection{
+		"peers include self": {conn1, selfConn, conn2},
+		"peers exclude self": {conn1, conn2},
+	}
+
+	for name, peers := range configs {
+		t.Run(name, func(t *testing.T) {
+			s := &Server{Id: 1, Self: selfConn, Peers: peers, Config: Config{Transport: protocol.DefaultTransport, GossipInterval: defaultGossipInterval}, peerClocks: make(map[uint64][]uint64)}
+			s.peers = resolvePeers(s.Id, selfConn, peers)
+			s.MyOperations = []Operation{{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Data: 7}}
+
+			before1, before2 := p1.count(1), p2.count(1)
+			s.gossipOnce()
+
+			if got := p1.count(1) - before1; got != 1 {
+				t.Errorf("peer 0 received %d gossip messages; want 1", got)
+			}
+			if got := p2.count(1) - before2; got != 1 {
+				t.Errorf("peer 2 received %d gossip messages; want 1", got)
+			}
+			if got := self.count(1); got != 0 {
+				t.Errorf("server gossiped to itself %d times", got)
+			}
+		})
+	}
+}
+
+func TestBoundedRegister(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{MinValue: 10, MaxValue: 20})
+
+	for _, value := range []uint64{10, 15, 20} {
+		if reply, err := write(s, value); err != nil || !reply.Succeeded {
+			t.Errorf("write(%d) = %+v, %v; want success", value, reply, err)
+		}
+	}
+
+	for _, value := range []uint64{0, 9, 21} {
+		if reply, err := write(s, value); err == nil || reply.Succeeded {
+			t.Errorf("write(%d) = %+v, %v; want rejection", value, reply, err)
+		}
+	}
+	if s.Data != 20 {
+		t.Errorf("Data = %d after rejected writes; want 20", s.Data)
+	}
+}
+
+func TestBoundedRegisterSkipsOutOfRangeGossip(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{MaxValue: 100})
+
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Data: 500},
+		{OperationType: Write, VersionVector: []uint64{0, 0, 1}, TieBreaker: 2, Data: 50},
+	}}, &GossipReply{})
+
+	if len(s.OperationsPerformed) != 1 || s.Data != 50 {
+		t.Errorf("applied %v with Data %d; want only the in-range write of 50", s.OperationsPerformed, s.Data)
+	}
+}
+
+func TestConvergenceLag(t *testing.T) {
+	servers := []*Server{newTestServer(t, 0, 3, Config{}), newTestServer(t, 1, 3, Config{}), newTestServer(t, 2, 3, Config{})}
+	write(servers[0], 1)
+	write(servers[0], 2)
+
+	// Server 1 receives all of server 0's writes, server 2 only learns server 0's clock.
+	servers[1].ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: servers[0].MyOperations, VectorClock: servers[0].VectorClock}, &GossipReply{})
+	servers[2].ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, VectorClock: servers[0].VectorClock}, &GossipReply{})
+
+	expect := [][]uint64{{0, 0, 0}, {0, 0, 0}, {2, 0, 0}}
+	for i, s := range servers {
+		if lag := s.ConvergenceLag(); !reflect.DeepEqual(lag, expect[i]) {
+			t.Errorf("server %d ConvergenceLag() = %v; want %v", i, lag, expect[i])
+		}
+	}
+
+	reply := InspectReply{}
+	servers[2].Inspect(&InspectRequest{}, &reply)
+	if !reflect.DeepEqual(reply.ConvergenceLag, expect[2]) {
+		t.Errorf("Inspect() reported lag %v; want %v", reply.ConvergenceLag, expect[2])
+	}
+}
+
+// serve exposes s over RPC on an ephemeral port without going through Start.
+func serve(t *testing.T, s *Server) *protocol.Connection {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv := rpc.NewServer()
+	if err := srv.Register(s); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	go srv.Accept(l)
+	return &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestOperationsRoundTripOverRPC(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	conn := serve(t, s)
+
+	writeReq := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Causal, Data: 1<<64 - 1, ReadVector: []uint64{0, 0, 0}, WriteVector: []uint64{0, 0, 0}}
+	writeReply := ClientReply{}
+	if err := protocol.Invoke(*conn, "Server.ProcessClientRequest", &writeReq, &writeReply); err != nil || !writeReply.Succeeded {
+		t.Fatalf("write over RPC = %+v, %v", writeReply, err)
+	}
+	if writeReply.OperationType != Write || writeReply.Data != writeReq.Data || !reflect.DeepEqual(writeReply.WriteVector, []uint64{1, 0, 0}) {
+		t.Errorf("write reply = %+v", writeReply)
+	}
+
+	gossip := GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{{OperationType: Write, VersionVector: []uint64{1, 1, 0}, TieBreaker: 1, Data: 3}}, VectorClock: []uint64{1, 1, 0}}
+	if err := protocol.Invoke(*conn, "Server.ReceiveGossip", &gossip, &GossipReply{}); err != nil {
+		t.Fatalf("gossip over RPC: %v", err)
+	}
+
+	readReq := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal, ReadVector: []uint64{0, 0, 0}, WriteVector: []uint64{0, 0, 0}}
+	readReply := ClientReply{}
+	if err := protocol.Invoke(*conn, "Server.ProcessClientRequest", &readReq, &readReply); err != nil || !readReply.Succeeded {
+		t.Fatalf("read over RPC = %+v, %v", readReply, err)
+	}
+	if readReply.OperationType != Read || readReply.Data != 3 || !reflect.DeepEqual(readReply.ReadVector, []uint64{1, 1, 0}) {
+		t.Errorf("read reply = %+v", readReply)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	self := &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+	l.Close()
+
+	s, _ := NewWithConfig(0, self, []*protocol.Connection{self}, Config{MaxConnections: 2})
+	started := make(chan error)
+	go func() { started <- s.Start() }()
+	t.Cleanup(func() { s.Stop() })
+
+	held := make([]net.Conn, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(held) < 5 {
+		conn, err := net.Dial("tcp", self.Address)
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("dial: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		held = append(held, conn)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	s.mu.Lock()
+	connections := s.connections
+	s.mu.Unlock()
+	if connections != 2 {
+		t.Errorf("serving %d connections with 5 open; want the cap of 2", connections)
+	}
+
+	for _, conn := range held {
+		conn.Close()
+	}
+	reply := InspectReply{}
+	if err := protocol.Invoke(*self, "Server.Inspect", &InspectRequest{}, &reply); err != nil || len(reply.VectorClock) != 1 {
+		t.Errorf("Inspect after releasing connections = %+v, %v", reply, err)
+	}
+
+	s.Stop()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start() = %v after Stop; want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Start did not return after Stop")
+	}
+}
+
+// waitListening waits for a started server to bind and returns its address.
+func waitListening(t *testing.T, s *Server) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if addr := s.Addr(); addr != "" {
+			return addr
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("server %d never started listening", s.Id)
+	return ""
+}
+
+func TestStartOnEphemeralPort(t *testing.T) {
+	self := &protocol.Connection{Network: "tcp", Address: "127.0.0.1:0"}
+	s := New(0, self, []*protocol.Connection{self})
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	addr := waitListening(t, s)
+	if strings.HasSuffix(addr, ":0") {
+		t.Fatalf("Addr() = %s; want the assigned port", addr)
+	}
+
+	reply := InspectReply{}
+	if err := protocol.Invoke(protocol.Connection{Network: "tcp", Address: addr}, "Server.Inspect", &InspectRequest{}, &reply); err != nil || len(reply.VectorClock) != 1 {
+		t.Errorf("Inspect via %s = %+v, %v", addr, reply, err)
+	}
+}
+
+func TestStartRetriesWhileAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	self := &protocol.Connection{Network: "tcp", Address: l.Addr().String()}
+
+	if err := New(0, self, []*protocol.Connection{self}).Start(); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Start() without retries = %v; want EADDRINUSE", err)
+	}
+
+	s, _ := NewWithConfig(0, self, []*protocol.Connection{self}, Config{ListenRetryTimeout: 2 * time.Second})
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	time.Sleep(100 * time.Millisecond)
+	l.Close()
+
+	if addr := waitListening(t, s); addr != self.Address {
+		t.Errorf("Addr() = %s; want %s", addr, self.Address)
+	}
+}
+
+func TestConcurrentWritesCounted(t *testing.T) {
+	s0, s1 := newTestServer(t, 0, 3, Config{}), newTestServer(t, 1, 3, Config{})
+	write(s0, 1)
+	write(s1, 2)
+
+	s0.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: s1.MyOperations}, &GossipReply{})
+
+	reply := InspectReply{}
+	s0.Inspect(&InspectRequest{}, &reply)
+	if reply.ConcurrentWrites != 1 {
+		t.Errorf("ConcurrentWrites = %d after a concurrent gossiped write; want 1", reply.ConcurrentWrites)
+	}
+
+	// A write that causally follows everything server 1 has seen is not concurrent.
+	s1.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: s0.MyOperations}, &GossipReply{})
+	write(s1, 3)
+	s0.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: s1.MyOperations}, &GossipReply{})
+	if s0.ConcurrentWrites != 1 {
+		t.Errorf("ConcurrentWrites = %d after a causally ordered write; want 1", s0.ConcurrentWrites)
+	}
+}
+
+func TestPeerlessServerAcceptsWrites(t *testing.T) {
+	for _, id := range []uint64{0, 1} {
+		s := New(id, &protocol.Connection{Network: "tcp", Address: "standalone"}, nil)
+
+		if reply, err := write(s, 5); err != nil || !reply.Succeeded {
+			t.Fatalf("server %d write = %+v, %v", id, reply, err)
+		}
+		if s.Data != 5 || s.VectorClock[id] != 1 {
+			t.Errorf("server %d has Data %d and clock %v after one write", id, s.Data, s.VectorClock)
+		}
+	}
+}
+
+func TestExplicitClusterSize(t *testing.T) {
+	self := &protocol.Connection{Network: "tcp", Address: "self"}
+
+	for _, id := range []uint64{0, 4} {
+		s, err := NewWithConfig(id, self, nil, Config{ClusterSize: 5})
+		if err != nil {
+			t.Fatalf("NewWithConfig(%d): %v", id, err)
+		}
+		if len(s.VectorClock) != 5 {
+			t.Errorf("server %d clock has %d entries; want 5", id, len(s.VectorClock))
+		}
+		if reply, err := write(s, 1); err != nil || !reply.Succeeded || s.VectorClock[id] != 1 {
+			t.Errorf("server %d write = %+v, %v with clock %v", id, reply, err, s.VectorClock)
+		}
+	}
+
+	if _, err := NewWithConfig(5, self, nil, Config{ClusterSize: 5}); err == nil {
+		t.Errorf("NewWithConfig accepted server 5 in a cluster of size 5")
+	}
+	peers := []*protocol.Connection{{Network: "tcp", Address: "a"}, {Network: "tcp", Address: "b"}, {Network: "tcp", Address: "c"}}
+	if _, err := NewWithConfig(0, self, peers, Config{ClusterSize: 3}); err == nil {
+		t.Errorf("NewWithConfig accepted 3 peers plus self in a cluster of size 3")
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	s := newTestServer(t, 1, 4, Config{})
+	reply := ServerInfoReply{}
+	s.ServerInfo(&ServerInfoRequest{}, &reply)
+
+	if reply.ServerId != 1 || reply.ClusterSize != 4 || reply.GossipInterval != defaultGossipInterval || reply.Version != Version {
+		t.Errorf("ServerInfo() = %+v", reply)
+	}
+	if reply.PeerListHash != peerListHash(s.Peers) {
+		t.Errorf("PeerListHash = %x; want %x", reply.PeerListHash, peerListHash(s.Peers))
+	}
+
+	// Servers built from the same config agree, a different peer list does not.
+	other := ServerInfoReply{}
+	newTestServer(t, 2, 4, Config{}).ServerInfo(&ServerInfoRequest{}, &other)
+	if other.PeerListHash != reply.PeerListHash {
+		t.Errorf("servers with the same peers report different hashes %x and %x", other.PeerListHash, reply.PeerListHash)
+	}
+	newTestServer(t, 1, 3, Config{}).ServerInfo(&ServerInfoRequest{}, &other)
+	if other.PeerListHash == reply.PeerListHash || other.ClusterSize == reply.ClusterSize {
+		t.Errorf("servers with different peers report the same configuration %+v", other)
+	}
+}
+
+func TestReceiveGossipCoercesClockWidth(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{MembershipEpoch: 2})
+
+	// A peer from before the third server joined sends two-entry vectors.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, MembershipEpoch: 1, VectorClock: []uint64{0, 1}, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Data: 4},
+	}}, &GossipReply{})
+	if s.Data != 4 || !reflect.DeepEqual(s.VectorClock, []uint64{0, 1, 0}) {
+		t.Errorf("after shorter gossip: Data %d, clock %v; want 4 and [0 1 0]", s.Data, s.VectorClock)
+	}
+
+	// A peer from a newer, wider membership sends four-entry vectors. Operations that don't
+	// depend on the fourth server can be truncated, the others can't be applied.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 2, MembershipEpoch: 3, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1, 1, 0}, TieBreaker: 2, Data: 5},
+		{OperationType: Write, VersionVector: []uint64{0, 1, 1, 1}, TieBreaker: 3, Data: 6},
+	}}, &GossipReply{})
+	if s.Data != 5 || !reflect.DeepEqual(s.VectorClock, []uint64{0, 1, 1}) || len(s.PendingOperations) != 0 {
+		t.Errorf("after longer gossip: Data %d, clock %v, pending %v; want 5, [0 1 1] and none", s.Data, s.VectorClock, s.PendingOperations)
+	}
+
+	// Within the same epoch a width mismatch is a misconfiguration and is rejected outright.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, MembershipEpoch: 2, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 2}, TieBreaker: 1, Data: 7},
+	}}, &GossipReply{})
+	if s.Data != 5 || len(s.OperationsPerformed) != 2 {
+		t.Errorf("applied gossip with a mismatched width from the same epoch: Data %d, log %v", s.Data, s.OperationsPerformed)
+	}
+}
+
+// history returns n writes issued in turn by the first origins servers of a cluster of the given size.
+func history(n, origins, size int) []Operation {
+	clock := make([]uint64, size)
+	ops := make([]Operation, n)
+	for i := range ops {
+		origin := i % origins
+		clock[origin]++
+		ops[i] = Operation{OperationType: Write, VersionVector: append([]uint64(nil), clock...), TieBreaker: uint64(origin), Seq: clock[origin], Data: uint64(i)}
+	}
+	return ops
+}
+
+func TestReceiveGossipSkipsSeenOperations(t *testing.T) {
+	ops := history(6, 2, 3)
+	once := newTestServer(t, 2, 3, Config{})
+	twice := newTestServer(t, 2, 3, Config{})
+
+	once.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops[1:]}, &GossipReply{})
+
+	// The first delivery leaves everything after the missing ops[0] pending. Re-sending it,
+	// and then the whole history, must not duplicate pending or applied operations.
+	twice.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops[1:]}, &GossipReply{})
+	twice.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops[1:]}, &GossipReply{})
+	if len(twice.PendingOperations) != len(ops)-1 {
+		t.Errorf("pending after re-gossip = %d operations; want %d", len(twice.PendingOperations), len(ops)-1)
+	}
+	twice.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops}, &GossipReply{})
+	once.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops[:1]}, &GossipReply{})
+
+	for _, s := range []*Server{once, twice} {
+		if s.Data != 5 || len(s.OperationsPerformed) != len(ops) || len(s.PendingOperations) != 0 {
+			t.Errorf("server state = Data %d, %d applied, %d pending; want 5, %d and 0",
+				s.Data, len(s.OperationsPerformed), len(s.PendingOperations), len(ops))
+		}
+	}
+	if !reflect.DeepEqual(once.OperationsPerformed, twice.OperationsPerformed) {
+		t.Errorf("re-gossip changed the applied log: %v; want %v", twice.OperationsPerformed, once.OperationsPerformed)
+	}
+
+	// The server's own writes are already known to it when a peer echoes them back.
+	reply, _ := write(once, 9)
+	once.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: once.MyOperations}, &GossipReply{})
+	if len(once.OperationsPerformed) != len(ops)+1 || once.Data != 9 {
+		t.Errorf("echoed write %v was applied again: %d applied, Data %d", reply.WriteVector, len(once.OperationsPerformed), once.Data)
+	}
+}
+
+// BenchmarkReceiveGossipKnownOperations re-gossips an already applied history. The seen set
+// skips the batch; forgetting it every round forces the merge and sort it replaces.
+func BenchmarkReceiveGossipKnownOperations(b *testing.B) {
+	ops := history(1000, 2, 3)
+	for _, bc := range []struct {
+		name   string
+		forget bool
+	}{{"seen", false}, {"merge", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := &Server{Id: 2, VectorClock: make([]uint64, 3), peerClocks: make(map[uint64][]uint64)}
+			s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops}, &GossipReply{})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bc.forget {
+					s.seen = nil
+				}
+				s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: ops}, &GossipReply{})
+			}
+		})
+	}
+}
+
+func TestIncrementalClockMatchesLog(t *testing.T) {
+	s := newTestServer(t, 3, 4, Config{})
+	ops := history(300, 3, 4)
+
+	// Deliver the history out of order in overlapping batches, interleaved with local writes.
+	for i := 0; i < len(ops); i += 7 {
+		batch := append([]Operation(nil), ops[i:min(i+20, len(ops))]...)
+		for j := len(batch) - 1; j > 0; j -= 2 {
+			batch[j], batch[j-1] = batch[j-1], batch[j]
+		}
+		s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: uint64(i % 3), Operations: batch}, &GossipReply{})
+		if i%21 == 0 {
+			write(s, uint64(i))
+		}
+
+		if expect := operationsGetMaxVersionVector(s.OperationsPerformed); !reflect.DeepEqual(s.VectorClock, expect) {
+			t.Fatalf("after batch at %d: clock %v; want %v recomputed from the log", i, s.VectorClock, expect)
+		}
+	}
+	if len(s.PendingOperations) != 0 || s.VectorClock[0] != 100 {
+		t.Errorf("clock %v with %d pending; want every gossiped operation applied", s.VectorClock, len(s.PendingOperations))
+	}
+}
+
+// BenchmarkApplyToLargeLog applies one gossiped operation at a time on top of a long history.
+func BenchmarkApplyToLargeLog(b *testing.B) {
+	const logSize = 10000
+	ops := history(logSize+b.N, 3, 4)
+	s := &Server{Id: 3, VectorClock: make([]uint64, 4), peerClocks: make(map[uint64][]uint64)}
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: ops[:logSize]}, &GossipReply{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: ops[logSize+i : logSize+i+1]}, &GossipReply{})
+	}
+}
+
+func TestBatchedApplyMatchesIncremental(t *testing.T) {
+	ops := history(500, 3, 4)
+	batched, incremental := newTestServer(t, 3, 4, Config{}), newTestServer(t, 3, 4, Config{})
+	batched.stopGossipLoop()
+	incremental.stopGossipLoop()
+
+	// Local writes concurrent with the history make the batch sort into the log, not after it.
+	for _, s := range []*Server{batched, incremental} {
+		for value := range uint64(20) {
+			write(s, value)
+		}
+	}
+
+	batched.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: ops}, &GossipReply{})
+	for _, op := range ops {
+		incremental.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: []Operation{op}}, &GossipReply{})
+	}
+
+	if !reflect.DeepEqual(batched.OperationsPerformed, incremental.OperationsPerformed) {
+		t.Errorf("batched log differs from the incremental one")
+	}
+	if !reflect.DeepEqual(batched.VectorClock, incremental.VectorClock) || batched.Data != incremental.Data || batched.ConcurrentWrites != incremental.ConcurrentWrites {
+		t.Errorf("batched server has %d at %v with %d concurrent writes; incremental one %d at %v with %d",
+			batched.Data, batched.VectorClock, batched.ConcurrentWrites, incremental.Data, incremental.VectorClock, incremental.ConcurrentWrites)
+	}
+	if len(batched.OperationsPerformed) != len(ops)+20 {
+		t.Errorf("batched server applied %d operations; want %d", len(batched.OperationsPerformed), len(ops)+20)
+	}
+}
+
+// BenchmarkApplyLargeBatch applies a large gossiped batch that sorts into a long log rather than
+// after it, merging it in one pass and, as before, inserting one operation at a time.
+func BenchmarkApplyLargeBatch(b *testing.B) {
+	const logSize, batchSize = 10000, 5000
+	log := history(logSize, 1, 4)
+	batch := make([]Operation, batchSize)
+	for i := range batch {
+		batch[i] = Operation{OperationType: Write, VersionVector: []uint64{0, 0, 0, uint64(i + 1)}, TieBreaker: 3, Seq: uint64(i + 1)}
+	}
+	for _, bc := range []struct {
+		name  string
+		apply func([]Operation, []Operation) []Operation
+	}{
+		{"merge", func(log, batch []Operation) []Operation { return mergeOperations(log, batch, operationOrder) }},
+		{"insert", func(log, batch []Operation) []Operation {
+			for _, op := range batch {
+				log = insertOperation(log, op, operationOrder)
+			}
+			return log
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ops := make([]Operation, 0, logSize+batchSize)
+			for i := 0; i < b.N; i++ {
+				bc.apply(append(ops[:0], log...), batch)
+			}
+		})
+	}
+}
+
+func TestDependencyCheckFastPathAgrees(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := newTestServer(t, 0, 4, Config{})
+	vector := func() []uint64 {
+		v := make([]uint64, 4)
+		for i := range v {
+			v[i] = uint64(rng.Intn(4))
+		}
+		return v
+	}
+
+	var previous ClientRequest
+	for i := 0; i < 2000; i++ {
+		// The clock only grows, as it does when the server applies operations.
+		if rng.Intn(10) == 0 {
+			s.VectorClock[rng.Intn(4)]++
+		}
+
+		request := ClientRequest{SessionType: SessionType(rng.Intn(5)), ReadVector: vector(), WriteVector: vector()}
+		switch rng.Intn(4) {
+		case 0:
+			// Repeat the previous dependencies, possibly under another session type.
+			request.ReadVector, request.WriteVector = previous.ReadVector, previous.WriteVector
+		case 1:
+			request.ReadVector, request.WriteVector = make([]uint64, 4), make([]uint64, 4)
+		}
+		previous = request
+
+		if fast, full := s.dependencyCheck(request), DependencyCheck(s.VectorClock, request); fast != full {
+			t.Fatalf("request %d %+v against clock %v: fast path %v, full check %v", i, request, s.VectorClock, fast, full)
+		}
+	}
+}
+
+// BenchmarkDependencyCheck repeats one client's read against a wide clock, with and without the
+// fast path.
+func BenchmarkDependencyCheck(b *testing.B) {
+	const width = 64
+	s := &Server{VectorClock: make([]uint64, width)}
+	request := ClientRequest{SessionType: Causal, ReadVector: make([]uint64, width), WriteVector: make([]uint64, width)}
+	for i := range s.VectorClock {
+		s.VectorClock[i] = uint64(i + 1)
+		request.ReadVector[i] = uint64(i)
+		request.WriteVector[i] = uint64(i)
+	}
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			DependencyCheck(s.VectorClock, request)
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.dependencyCheck(request)
+		}
+	})
+}
+
+// resettingTransport resets the server while its gossip is in flight and answers with a peer clock.
+type resettingTransport struct {
+	s     *Server
+	clock []uint64
+}
+
+func (r resettingTransport) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	r.s.Reset()
+	(*reply.(**GossipReply)).VectorClock = r.clock
+	return nil
+}
+
+func TestReset(t *testing.T) {
+	transport := &resettingTransport{clock: []uint64{4, 4, 4}}
+	s := newTestServer(t, 0, 3, Config{GossipInterval: time.Hour, Transport: transport})
+	transport.s = s
+
+	write(s, 5)
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, VectorClock: []uint64{0, 2, 0}, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Data: 6},
+		{OperationType: Write, VersionVector: []uint64{0, 3, 0}, TieBreaker: 1, Data: 8},
+	}}, &GossipReply{})
+	if s.Data == 0 || len(s.PendingOperations) == 0 {
+		t.Fatalf("setup left Data %d and %d pending operations; want a write and a pending operation", s.Data, len(s.PendingOperations))
+	}
+
+	// Gossip resets the server mid-flight; the peer's reply must not be recorded afterward.
+	s.gossipOnce()
+
+	fresh := newTestServer(t, 0, 3, Config{})
+	if s.Data != fresh.Data || !reflect.DeepEqual(s.VectorClock, fresh.VectorClock) ||
+		len(s.OperationsPerformed) != 0 || len(s.MyOperations) != 0 || len(s.PendingOperations) != 0 {
+		t.Errorf("after Reset: Data %d, clock %v, %d applied, %d own, %d pending; want the state of a new server",
+			s.Data, s.VectorClock, len(s.OperationsPerformed), len(s.MyOperations), len(s.PendingOperations))
+	}
+	if len(s.peerClocks) != 0 {
+		t.Errorf("after Reset: recorded peer clocks %v from gossip sent before it", s.peerClocks)
+	}
+
+	// The server accepts the same gossip again, as a new server would.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Data: 6},
+	}}, &GossipReply{})
+	if s.Data != 6 {
+		t.Errorf("after Reset: gossiped write gave Data %d; want 6", s.Data)
+	}
+}
+
+func TestOperationSequenceNumbers(t *testing.T) {
+	servers := make([]*Server, 3)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), 3, Config{})
+	}
+	for round := 0; round < 4; round++ {
+		for i, s := range servers {
+			write(s, uint64(10*round+i))
+		}
+	}
+	servers[2].Reset()
+	write(servers[2], 99)
+
+	for i, s := range servers {
+		for j, op := range s.MyOperations {
+			if op.TieBreaker != uint64(i) || (j > 0 && op.Seq <= s.MyOperations[j-1].Seq) {
+				t.Errorf("server %d issued %+v after %+v; want strictly increasing sequence numbers", i, op, s.MyOperations[max(j-1, 0)])
+			}
+		}
+		for _, peer := range servers {
+			if peer != s {
+				s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: peer.Id, Operations: peer.MyOperations}, &GossipReply{})
+			}
+		}
+	}
+
+	ids := make(map[operationId]Operation)
+	for _, s := range servers {
+		for _, op := range append(append([]Operation(nil), s.OperationsPerformed...), s.PendingOperations...) {
+			id := operationId{Origin: op.TieBreaker, Seq: op.Seq}
+			if other, ok := ids[id]; ok && !equalOperations(op, other) {
+				t.Errorf("operations %+v and %+v share origin %d and sequence number %d", op, other, id.Origin, id.Seq)
+			}
+			ids[id] = op
+		}
+	}
+	if id := (operationId{Origin: 2, Seq: 5}); ids[id].Data != 99 {
+		t.Errorf("write after Reset has identity %+v; want sequence number 5", ids[id])
+	}
+}
+
+func TestProtocolVersionMismatchRejected(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	conn := serve(t, s)
+
+	c, err := rpc.Dial(conn.Network, conn.Address)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	write := ClientRequest{ProtocolVersion: ProtocolVersion + 1, OperationType: Write, SessionType: Causal, Data: 4, ReadVector: []uint64{0, 0, 0}, WriteVector: []uint64{0, 0, 0}}
+	err = c.Call("Server.ProcessClientRequest", &write, &ClientReply{})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("protocol version %d", ProtocolVersion+1)) {
+		t.Errorf("mismatched client request: error %v; want a protocol version rejection", err)
+	}
+
+	gossip := GossipRequest{ServerId: 1, Operations: []Operation{{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Seq: 1, Data: 5}}}
+	err = c.Call("Server.ReceiveGossip", &gossip, &GossipReply{})
+	if err == nil || !strings.Contains(err.Error(), "gossip from server 1 uses protocol version 0") {
+		t.Errorf("unversioned gossip: error %v; want a protocol version rejection", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Data != 0 || len(s.OperationsPerformed) != 0 {
+		t.Errorf("rejected messages changed the server: Data %d, log %v", s.Data, s.OperationsPerformed)
+	}
+}
+
+// deliveringTransport hands gossip straight to another server and records how many operations
+// each message carried.
+type deliveringTransport struct {
+	to       *Server
+	mu       sync.Mutex
+	sizes    []int
+	requests []*GossipRequest // As they went over the wire
+}
+
+func (d *deliveringTransport) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	request := *args.(**GossipRequest)
+	d.mu.Lock()
+	d.sizes = append(d.sizes, len(request.Operations))
+	d.requests = append(d.requests, cloneGossip(request))
+	d.mu.Unlock()
+	return d.to.ReceiveGossip(cloneGossip(request), *reply.(**GossipReply))
+}
+
+func TestPayloadLimits(t *testing.T) {
+	s := newTestServer(t, 0, 4, Config{MaxPayloadBytes: 64})
+	if _, err := write(s, 1); err == nil || !strings.Contains(err.Error(), "payload limit") {
+		t.Errorf("write with %d bytes of vectors: error %v; want a payload limit rejection", 2*wordSize*4, err)
+	}
+	if len(s.OperationsPerformed) != 0 {
+		t.Errorf("rejected write was applied: %v", s.OperationsPerformed)
+	}
+
+	gossip := &GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: history(3, 1, 4)}
+	for i := range gossip.Operations {
+		gossip.Operations[i].TieBreaker = 1
+	}
+	if err := s.ReceiveGossip(gossip, &GossipReply{}); err == nil || !strings.Contains(err.Error(), "payload limit") {
+		t.Errorf("gossip of %d operations: error %v; want a payload limit rejection", len(gossip.Operations), err)
+	}
+
+	// A sender sharing the limit splits its operations into messages the receiver accepts.
+	transport := &deliveringTransport{to: newTestServer(t, 1, 2, Config{MaxPayloadBytes: 200})}
+	sender := newTestServer(t, 0, 2, Config{Transport: transport, MaxPayloadBytes: 200, MaxGossipOperations: 3})
+	for value := uint64(1); value <= 10; value++ {
+		if _, err := write(sender, value); err != nil {
+			t.Fatalf("write(%d): %v", value, err)
+		}
+	}
+	sender.gossipOnce()
+
+	total := 0
+	for _, n := range transport.sizes {
+		if n > 3 || gossipHeaderSize(sender.VectorClock)+n*operationSize(sender.MyOperations[0]) > 200 {
+			t.Errorf("gossip message carried %d operations; want at most 3 within 200 bytes", n)
+		}
+		total += n
+	}
+	if total != 10 || len(transport.sizes) < 2 {
+		t.Errorf("gossip sent %d operations in messages of %v; want all 10 over several messages", total, transport.sizes)
+	}
+	if transport.to.Data != 10 {
+		t.Errorf("peer Data = %d after gossip; want 10", transport.to.Data)
+	}
+}
+
+func TestGossipCatchesUpInChunks(t *testing.T) {
+	const missing, chunk = 10000, 250
+	transport := &deliveringTransport{to: newTestServer(t, 1, 2, Config{})}
+	sender := newTestServer(t, 0, 2, Config{Transport: transport, MaxGossipOperations: chunk})
+	sender.stopGossipLoop() // Gossip only when the test says so
+	for value := uint64(1); value <= missing; value++ {
+		if _, err := write(sender, value); err != nil {
+			t.Fatalf("write(%d): %v", value, err)
+		}
+	}
+
+	sender.gossipOnce()
+	if len(transport.sizes) != missing/chunk {
+		t.Errorf("catch-up took %d messages; want %d", len(transport.sizes), missing/chunk)
+	}
+	for _, n := range transport.sizes {
+		if n > chunk {
+			t.Errorf("gossip message carried %d operations; want at most %d", n, chunk)
+		}
+	}
+	if peer := transport.to; peer.Data != missing || !reflect.DeepEqual(peer.VectorClock, []uint64{missing, 0}) || len(peer.PendingOperations) != 0 {
+		t.Fatalf("peer has Data %d, clock %v, %d pending; want it caught up at %d", peer.Data, peer.VectorClock, len(peer.PendingOperations), missing)
+	}
+
+	// Once the peer is caught up, only new operations are sent.
+	write(sender, missing+1)
+	transport.sizes = nil
+	sender.gossipOnce()
+	if !reflect.DeepEqual(transport.sizes, []int{1}) {
+		t.Errorf("gossip to a caught-up peer sent messages of %v operations; want just the new one", transport.sizes)
+	}
+	sender.gossipOnce()
+	if !reflect.DeepEqual(transport.sizes, []int{1, 0}) {
+		t.Errorf("gossip with nothing new sent messages of %v operations; want an empty one", transport.sizes)
+	}
+}
+
+func TestCompressedGossip(t *testing.T) {
+	const writes = 5000
+	transport := &deliveringTransport{to: newTestServer(t, 1, 2, Config{})}
+	sender := newTestServer(t, 0, 2, Config{Transport: transport, CompressGossip: true})
+	sender.stopGossipLoop() // Gossip only when the test says so
+	for value := uint64(1); value <= writes; value++ {
+		write(sender, value%7)
+	}
+
+	sender.gossipOnce()
+	if len(transport.requests) != 1 {
+		t.Fatalf("gossip took %d messages; want 1", len(transport.requests))
+	}
+	sent := transport.requests[0]
+	if len(sent.Operations) != 0 || len(sent.Compressed) == 0 {
+		t.Fatalf("gossip went out with %d plain operations and %d compressed bytes; want only compressed ones", len(sent.Operations), len(sent.Compressed))
+	}
+	ops, err := decompressOperations(sent.Compressed)
+	if err != nil {
+		t.Fatalf("decompressOperations: %v", err)
+	}
+	if !reflect.DeepEqual(ops, sender.MyOperations) {
+		t.Errorf("compressed gossip carried %d operations that differ from the %d sent", len(ops), len(sender.MyOperations))
+	}
+	if peer := transport.to; !reflect.DeepEqual(peer.OperationsPerformed, sender.OperationsPerformed) || peer.Data != sender.Data {
+		t.Errorf("peer applied %d operations with Data %d; want the sender's %d with Data %d", len(peer.OperationsPerformed), peer.Data, len(sender.OperationsPerformed), sender.Data)
+	}
+
+	if _, err := decompressOperations([]byte("not gzip")); err == nil {
+		t.Errorf("decompressOperations accepted garbage")
+	}
+	bad := &GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Compressed: []byte("not gzip")}
+	if err := sender.ReceiveGossip(bad, &GossipReply{}); err == nil {
+		t.Errorf("ReceiveGossip accepted a corrupt compressed payload")
+	}
+}
+
+// BenchmarkGossipCompression measures the CPU cost of encoding a large gossip batch with and
+// without compression, and reports the bytes each puts on the wire.
+func BenchmarkGossipCompression(b *testing.B) {
+	ops := concurrentHistory(1000, 4)
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			var size int
+			for range b.N {
+				request := &GossipRequest{ProtocolVersion: ProtocolVersion, Operations: ops}
+				if compress {
+					compressed, err := compressOperations(ops)
+					if err != nil {
+						b.Fatal(err)
+					}
+					request.Operations, request.Compressed = nil, compressed
+				}
+				var buf bytes.Buffer
+				if err := gob.NewEncoder(&buf).Encode(request); err != nil {
+					b.Fatal(err)
+				}
+				size = buf.Len()
+			}
+			b.ReportMetric(float64(size), "wire-bytes")
+		})
+	}
+}
+
+// concurrentHistory returns n writes from each of origins servers that partly see each other:
+// every third write of a server also depends on everything the next server has written so far.
+func concurrentHistory(n, origins int) []Operation {
+	clocks := make([][]uint64, origins)
+	for i := range clocks {
+		clocks[i] = make([]uint64, origins)
+	}
+	var ops []Operation
+	for round := 0; round < n; round++ {
+		for origin := range clocks {
+			clock := clocks[origin]
+			if round%3 == 2 {
+				next := clocks[(origin+1)%origins]
+				for i := range clock {
+					clock[i] = max(clock[i], next[i])
+				}
+			}
+			clock[origin]++
+			ops = append(ops, Operation{OperationType: Write, VersionVector: append([]uint64(nil), clock...), TieBreaker: uint64(origin), Seq: clock[origin], Data: uint64(len(ops))})
+		}
+	}
+	return ops
+}
+
+func TestAppliedLogStaysSorted(t *testing.T) {
+	ops := concurrentHistory(40, 3)
+	rng := rand.New(rand.NewSource(1))
+	servers := []*Server{newTestServer(t, 3, 4, Config{}), newTestServer(t, 3, 4, Config{})}
+	for _, s := range servers {
+		shuffled := make([]Operation, len(ops))
+		for i, j := range rng.Perm(len(ops)) {
+			shuffled[i] = ops[j]
+			shuffled[i].VersionVector = append(append([]uint64(nil), ops[j].VersionVector...), 0)
+		}
+		for i := 0; i < len(shuffled); i += 5 {
+			s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: uint64(i % 3), Operations: shuffled[i:min(i+5, len(shuffled))]}, &GossipReply{})
+
+			sorted := slices.Clone(s.OperationsPerformed)
+			slices.SortFunc(sorted, operationOrder)
+			if !reflect.DeepEqual(sorted, s.OperationsPerformed) {
+				t.Fatalf("after batch at %d the applied log is not in sorted order", i)
+			}
+		}
+		if len(s.OperationsPerformed) != len(ops) {
+			t.Fatalf("%d of %d operations applied", len(s.OperationsPerformed), len(ops))
+		}
+	}
+	if !reflect.DeepEqual(servers[0].OperationsPerformed, servers[1].OperationsPerformed) || servers[0].Data != servers[1].Data {
+		t.Errorf("servers that received the same operations in different orders disagree: Data %d and %d", servers[0].Data, servers[1].Data)
+	}
+
+	// The order extends causality: no operation comes after one it happened before.
+	log := servers[0].OperationsPerformed
+	for i := range log {
+		for j := i + 1; j < len(log); j++ {
+			if vectorclock.CompareVersionVector(log[i].VersionVector, log[j].VersionVector) {
+				t.Fatalf("operation %v sorts after %v, which it depends on", log[j].VersionVector, log[i].VersionVector)
+			}
+		}
+	}
+}
+
+// BenchmarkKeepLogSorted adds a concurrent operation that sorts just before the end of a long
+// applied log, by sorted insertion and by appending and re-sorting the whole log as before.
+func BenchmarkKeepLogSorted(b *testing.B) {
+	const logSize = 10000
+	log := history(logSize, 3, 4)
+	op := Operation{OperationType: Write, VersionVector: []uint64{0, 0, 0, logSize - 2}, TieBreaker: 3, Seq: 1}
+	for _, bc := range []struct {
+		name string
+		add  func([]Operation, Operation) []Operation
+	}{
+		{"insert", func(ops []Operation, op Operation) []Operation { return insertOperation(ops, op, operationOrder) }},
+		{"resort", func(ops []Operation, op Operation) []Operation {
+			ops = append(ops, op)
+			slices.SortFunc(ops, operationOrder)
+			return ops
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ops := make([]Operation, 0, logSize+1)
+			for i := 0; i < b.N; i++ {
+				ops = bc.add(append(ops[:0], log...), op)
+			}
+		})
+	}
+}
+
+func TestStartupSelfTest(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		peerSize    int
+		expectError string
+	}{
+		{"matching cluster size", 2, ""},
+		{"mismatched cluster size", 3, "cluster size of 3"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, err := NewWithConfig(0, &protocol.Connection{Network: "tcp", Address: "127.0.0.1:0"}, nil, Config{ClusterSize: tt.peerSize})
+			if err != nil {
+				t.Fatalf("NewWithConfig: %v", err)
+			}
+			go peer.Start()
+			t.Cleanup(func() { peer.Stop() })
+			peerConn := &protocol.Connection{Network: "tcp", Address: waitListening(t, peer)}
+
+			s, err := NewWithConfig(1, &protocol.Connection{Network: "tcp", Address: "127.0.0.1:0"}, []*protocol.Connection{peerConn}, Config{SelfTest: true})
+			if err != nil {
+				t.Fatalf("NewWithConfig: %v", err)
+			}
+			started := make(chan error, 1)
+			go func() { started <- s.Start() }()
+			t.Cleanup(func() { s.Stop() })
+
+			if tt.expectError != "" {
+				select {
+				case err := <-started:
+					if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+						t.Errorf("Start() = %v; want a self-test failure mentioning %q", err, tt.expectError)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("Start() kept running after a failed self-test")
+				}
+				return
+			}
+
+			conn := protocol.Connection{Network: "tcp", Address: waitListening(t, s)}
+			deadline := time.Now().Add(2 * time.Second)
+			for s.notReady.Load() && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			reply := ClientReply{}
+			request := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Causal, Data: 4, ReadVector: []uint64{0, 0}, WriteVector: []uint64{0, 0}}
+			if err := protocol.Invoke(conn, "Server.ProcessClientRequest", &request, &reply); err != nil || !reply.Succeeded {
+				t.Errorf("write after the self-test = %+v, %v; want it served", reply, err)
+			}
+			if s.Data != 4 || len(s.OperationsPerformed) != 1 {
+				t.Errorf("register holds Data %d and %d operations; want only the client's write", s.Data, len(s.OperationsPerformed))
+			}
+		})
+	}
+}
+
+func TestSelfTestHasNoSideEffects(t *testing.T) {
+	store := NewMemoryStore()
+	var hooks []string
+	replicated := make(chan Operation, 1)
+	s, err := NewWithConfig(0, &protocol.Connection{Network: "tcp", Address: "127.0.0.1:0"}, nil, Config{
+		Store:                store,
+		OnWriteApplied:       func(op Operation) { hooks = append(hooks, "OnWriteApplied") },
+		OnGossipReceived:     func(from uint64, count int) { hooks = append(hooks, "OnGossipReceived") },
+		OnDependencyRejected: func(request ClientRequest) { hooks = append(hooks, "OnDependencyRejected") },
+		Replicate:            func(op Operation) error { replicated <- op; return nil },
+	})
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+
+	if err := s.selfTest(); err != nil {
+		t.Fatalf("selfTest() = %v", err)
+	}
+	if ops, err := store.LoadAll(); err != nil || len(ops) != 0 {
+		t.Errorf("store holds %d operations after the self-test (%v); want none", len(ops), err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("self-test called %v; want no hooks called", hooks)
+	}
+	// Replicate runs on a goroutine of its own, so give it a moment to be called.
+	select {
+	case op := <-replicated:
+		t.Errorf("self-test replicated %+v; want nothing replicated", op)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	servers := make([]*Server, 3)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), 3, Config{})
+	}
+	s := servers[0]
+	for value := uint64(1); value <= 3; value++ {
+		write(s, value)
+	}
+	written := slices.Clone(s.MyOperations)
+
+	// Until every peer has reported a clock nothing is known to be stable.
+	if removed := s.GarbageCollect(); removed != 0 || len(s.OperationsPerformed) != 3 {
+		t.Fatalf("GarbageCollect() with no peer clocks removed %d, leaving %d operations", removed, len(s.OperationsPerformed))
+	}
+
+	for _, peer := range servers[1:] {
+		peer.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: written}, &GossipReply{})
+		if peer.Data != 3 {
+			t.Fatalf("peer %d has Data %d after gossip; want 3", peer.Id, peer.Data)
+		}
+	}
+	// Server 1 reports its clock; server 2 has only seen the first write as far as s knows.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, VectorClock: servers[1].VectorClock}, &GossipReply{})
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 2, VectorClock: []uint64{1, 0, 0}}, &GossipReply{})
+	if removed := s.GarbageCollect(); removed != 1 || len(s.OperationsPerformed) != 2 || len(s.MyOperations) != 2 {
+		t.Errorf("GarbageCollect() below frontier [1 0 0] removed %d, leaving %d applied and %d own operations; want 1, 2 and 2",
+			removed, len(s.OperationsPerformed), len(s.MyOperations))
+	}
+
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 2, VectorClock: servers[2].VectorClock}, &GossipReply{})
+	if removed := s.GarbageCollect(); removed != 1 || len(s.OperationsPerformed) != 1 || len(s.MyOperations) != 0 {
+		t.Errorf("GarbageCollect() with every peer caught up removed %d, leaving %d applied and %d own operations; want 1, 1 and 0",
+			removed, len(s.OperationsPerformed), len(s.MyOperations))
+	}
+
+	// The register behaves as before: the latest value is kept and re-gossip of collected
+	// operations changes nothing.
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: written}, &GossipReply{})
+	if s.Data != 3 || len(s.OperationsPerformed) != 1 || len(s.PendingOperations) != 0 {
+		t.Errorf("after re-gossip of collected operations: Data %d, %d applied, %d pending; want 3, 1 and 0",
+			s.Data, len(s.OperationsPerformed), len(s.PendingOperations))
+	}
+	reply, err := write(s, 4)
+	if err != nil || !slices.Equal(reply.WriteVector, []uint64{4, 0, 0}) || s.Data != 4 {
+		t.Errorf("write after GarbageCollect = %+v, %v with Data %d; want it ordered after the collected writes", reply, err, s.Data)
+	}
+}
+
+func TestStableFrontier(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	for value := uint64(1); value <= 4; value++ {
+		write(s, value)
+	}
+	if frontier := s.StableFrontier(); frontier != nil {
+		t.Errorf("StableFrontier() before any peer reported = %v; want nil", frontier)
+	}
+
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, VectorClock: []uint64{2, 5, 1}}, &GossipReply{})
+	if frontier := s.StableFrontier(); frontier != nil {
+		t.Errorf("StableFrontier() with server 2 unheard from = %v; want nil", frontier)
+	}
+
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 2, VectorClock: []uint64{3, 0, 6}}, &GossipReply{})
+	if frontier := s.StableFrontier(); !slices.Equal(frontier, []uint64{2, 0, 0}) {
+		t.Errorf("StableFrontier() of clocks [4 0 0], [2 5 1] and [3 0 6] = %v; want [2 0 0]", frontier)
+	}
+}
+
+func TestEventualReadsFromStaleServer(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	write(s, 6)
+	ahead := []uint64{50, 50, 50}
+
+	reply := ClientReply{}
+	request := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal, ReadVector: ahead, WriteVector: ahead}
+	if err := s.ProcessClientRequest(&request, &reply); err != nil || reply.Succeeded {
+		t.Fatalf("causal read from a stale server = %+v, %v; want it refused", reply, err)
+	}
+
+	request.SessionType = Eventual
+	if err := s.ProcessClientRequest(&request, &reply); err != nil || !reply.Succeeded || reply.Data != 6 {
+		t.Errorf("eventual read from a stale server = %+v, %v; want the server's 6", reply, err)
+	}
+	if session, err := ParseSessionType("any"); err != nil || session != Eventual {
+		t.Errorf(`ParseSessionType("any") = %v, %v; want Eventual`, session, err)
+	}
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	var applied []Operation
+	var gossip [][2]uint64
+	var rejected []ClientRequest
+	var s *Server
+	s = newTestServer(t, 0, 2, Config{
+		OnWriteApplied: func(op Operation) {
+			// Callbacks run without the lock, so they may call back into the server.
+			s.Inspect(&InspectRequest{}, &InspectReply{})
+			applied = append(applied, op)
+		},
+		OnGossipReceived:     func(from uint64, count int) { gossip = append(gossip, [2]uint64{from, uint64(count)}) },
+		OnDependencyRejected: func(request ClientRequest) { rejected = append(rejected, request) },
+	})
+
+	write(s, 5)
+	peerWrite := Operation{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Seq: 1, Data: 8}
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{peerWrite}}, &GossipReply{})
+	read := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: MonotonicReads, ReadVector: []uint64{0, 9}}
+	s.ProcessClientRequest(&read, &ClientReply{})
+
+	if len(applied) != 2 || applied[0].Data != 5 || applied[0].TieBreaker != 0 || !equalOperations(applied[1], peerWrite) {
+		t.Errorf("OnWriteApplied saw %v; want the client's write of 5, then %v", applied, peerWrite)
+	}
+	if !reflect.DeepEqual(gossip, [][2]uint64{{1, 1}}) {
+		t.Errorf("OnGossipReceived saw %v; want one operation from server 1", gossip)
+	}
+	if len(rejected) != 1 || !reflect.DeepEqual(rejected[0], read) {
+		t.Errorf("OnDependencyRejected saw %v; want the read %v", rejected, read)
+	}
+}
+
+func TestReadsDuringCompaction(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	const writes = 2000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for value := uint64(1); value <= writes; value++ {
+			reply, _ := write(s, value)
+			// Both peers report having everything, so every write soon becomes stable.
+			if value%10 == 0 {
+				for peer := uint64(1); peer <= 2; peer++ {
+					s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: peer, VectorClock: reply.WriteVector}, &GossipReply{})
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.Compact()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		last := uint64(0)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			reply := ClientReply{}
+			s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+			if reply.Data < last {
+				t.Errorf("read returned %d after %d", reply.Data, last)
+				return
+			}
+			last = reply.Data
+		}
+	}()
+	wg.Wait()
+
+	if s.Compact(); len(s.OperationsPerformed) != 0 {
+		t.Errorf("after compacting with every write stable, %d operations remain in the log", len(s.OperationsPerformed))
+	}
+	reply := ClientReply{}
+	s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+	if reply.Data != writes {
+		t.Errorf("read after compaction = %d; want %d", reply.Data, writes)
+	}
+
+	// An operation concurrent with the snapshot that sorts before it still counts: it is from a
+	// higher server, so it wins over the snapshot.
+	early := Operation{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Seq: 1, Data: 7}
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{early}}, &GossipReply{})
+	s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+	if len(s.OperationsPerformed) != 1 || reply.Data != early.Data {
+		t.Errorf("read after a late concurrent write = %d with %d operations in the log; want %d", reply.Data, len(s.OperationsPerformed), early.Data)
+	}
+}
+
+// waitParked waits until n client requests are parked on s waiting for their dependencies. The
+// count changes under s.mu, which a parked request only releases once it is waiting, so a clock
+// advance after waitParked returns wakes them.
+func waitParked(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		parked := s.dependencyWaiters
+		s.mu.Unlock()
+		if parked == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client requests waiting for their dependencies; want %d", parked, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDependencyWait(t *testing.T) {
+	s := newTestServer(t, 0, 2, Config{DependencyWaitTimeout: 2 * time.Second})
+	peerWrite := Operation{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Seq: 1, Data: 8}
+	read := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal, ReadVector: []uint64{0, 1}}
+
+	// The read arrives just before the gossip that satisfies it.
+	replied := make(chan ClientReply, 1)
+	go func() {
+		reply := ClientReply{}
+		s.ProcessClientRequest(&read, &reply)
+		replied <- reply
+	}()
+	waitParked(t, s, 1)
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{peerWrite}}, &GossipReply{})
+
+	select {
+	case reply := <-replied:
+		if !reply.Succeeded || reply.Data != 8 {
+			t.Errorf("read waiting for gossip = %+v; want it to succeed with 8", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read still waiting after the gossip it depends on was applied")
+	}
+
+	s.Config.DependencyWaitTimeout = 30 * time.Millisecond
+	start := time.Now()
+	reply := ClientReply{}
+	read.ReadVector = []uint64{0, 2}
+	s.ProcessClientRequest(&read, &reply)
+	if reply.Succeeded {
+		t.Errorf("read depending on gossip that never arrives succeeded")
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("read was rejected after %v; want it to wait %v first", waited, s.Config.DependencyWaitTimeout)
+	}
+}
+
+func TestWritesFollowReadsOrdersWriteAfterObservedWrite(t *testing.T) {
+	a, b, c := newTestServer(t, 0, 3, Config{}), newTestServer(t, 1, 3, Config{}), newTestServer(t, 2, 3, Config{})
+	servers := []*Server{a, b, c}
+	gossip := func(from, to *Server) {
+		to.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: from.Id, Operations: from.MyOperations, VectorClock: from.VectorClock}, &GossipReply{})
+	}
+
+	x, err := write(a, 10)
+	if err != nil || !x.Succeeded {
+		t.Fatalf("write of X on server A = %+v, %v", x, err)
+	}
+	gossip(a, b)
+	read := ClientReply{}
+	b.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: WritesFollowReads}, &read)
+	if !read.Succeeded || read.Data != 10 {
+		t.Fatalf("read of X on server B = %+v; want 10", read)
+	}
+
+	y := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: WritesFollowReads, Data: 20, ReadVector: read.ReadVector}
+	reply := ClientReply{}
+	c.ProcessClientRequest(&y, &reply)
+	if reply.Succeeded {
+		t.Fatalf("server C accepted Y before it had X, the write the client read")
+	}
+	gossip(a, c)
+	c.ProcessClientRequest(&y, &reply)
+	if !reply.Succeeded {
+		t.Fatalf("server C rejected Y after it had X")
+	}
+
+	for _, from := range servers {
+		for _, to := range servers {
+			if from != to {
+				gossip(from, to)
+			}
+		}
+	}
+	for _, s := range servers {
+		xAt := slices.IndexFunc(s.OperationsPerformed, func(op Operation) bool { return op.Data == 10 })
+		yAt := slices.IndexFunc(s.OperationsPerformed, func(op Operation) bool { return op.Data == 20 })
+		if xAt == -1 || yAt == -1 {
+			t.Fatalf("server %d applied %v; want both X and Y", s.Id, s.OperationsPerformed)
+		}
+		if xAt > yAt || !vectorclock.CompareVersionVector(s.OperationsPerformed[yAt].VersionVector, s.OperationsPerformed[xAt].VersionVector) {
+			t.Errorf("server %d ordered X %v at %d and Y %v at %d; want Y causally after X", s.Id, s.OperationsPerformed[xAt].VersionVector, xAt, s.OperationsPerformed[yAt].VersionVector, yAt)
+		}
+		if s.Data != 20 {
+			t.Errorf("server %d holds %d; want Y's 20", s.Id, s.Data)
+		}
+	}
+}
+
+func TestWriteDependsOnEverythingTheClientSaw(t *testing.T) {
+	a, b, c := newTestServer(t, 0, 3, Config{}), newTestServer(t, 1, 3, Config{}), newTestServer(t, 2, 3, Config{})
+	write(a, 10)
+	b.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: a.MyOperations}, &GossipReply{})
+	read := ClientReply{}
+	b.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal}, &read)
+
+	// MonotonicWrites checks only the write vector, but the write must still follow the read.
+	request := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: MonotonicWrites, Data: 20, ReadVector: read.ReadVector}
+	reply := ClientReply{}
+	c.ProcessClientRequest(&request, &reply)
+	if reply.Succeeded {
+		t.Fatalf("server C accepted a write after read %v without having what was read", read.ReadVector)
+	}
+	c.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: a.MyOperations}, &GossipReply{})
+	c.ProcessClientRequest(&request, &reply)
+	if !reply.Succeeded {
+		t.Fatalf("server C rejected the write once it had what was read")
+	}
+	written := c.MyOperations[len(c.MyOperations)-1].VersionVector
+	if !vectorclock.CompareVersionVector(written, read.ReadVector) || !slices.Equal(reply.WriteVector, written) {
+		t.Errorf("write got vector %v, reply %v; want it to dominate the read's %v", written, reply.WriteVector, read.ReadVector)
+	}
+
+	// Eventual writes record no dependencies, so any server takes them.
+	eventual := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Eventual, Data: 30, ReadVector: []uint64{5, 5, 5}}
+	b.ProcessClientRequest(&eventual, &reply)
+	if !reply.Succeeded {
+		t.Errorf("eventual write with unmet vectors was rejected")
+	}
+}
+
+func TestConcurrentWritesHighestServerWins(t *testing.T) {
+	servers := []*Server{newTestServer(t, 0, 2, Config{}), newTestServer(t, 1, 2, Config{})}
+	write(servers[0], 10)
+	write(servers[0], 11)
+	write(servers[1], 20)
+	for _, from := range servers {
+		to := servers[1-from.Id]
+		to.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: from.Id, Operations: from.MyOperations}, &GossipReply{})
+	}
+
+	// Server 0's second write has the larger vector sum, but it is concurrent with server 1's
+	// write, so the higher server wins.
+	for _, s := range servers {
+		reply := ClientReply{}
+		s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+		if s.Data != 20 || reply.Data != 20 {
+			t.Errorf("server %d holds %d and read %d; want 20", s.Id, s.Data, reply.Data)
+		}
+	}
+}
+
+func TestCustomTieBreaker(t *testing.T) {
+	lowestServerWins := func(a, b Operation) bool { return a.TieBreaker < b.TieBreaker }
+	for _, tc := range []struct {
+		name       string
+		tieBreaker func(a, b Operation) bool
+		want       []uint64 // Data of the applied operations, in order
+	}{
+		{"default", nil, []uint64{10, 20}},
+		{"highest", HighestServerWins, []uint64{10, 20}},
+		{"lowest", lowestServerWins, []uint64{20, 10}},
+	} {
+		// The two writes are concurrent with equal vector sums, so the tie-breaker orders them in
+		// the log and the last one is the value.
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{TieBreaker: tc.tieBreaker}
+			servers := []*Server{newTestServer(t, 0, 2, config), newTestServer(t, 1, 2, config)}
+			write(servers[0], 10)
+			write(servers[1], 20)
+			for _, from := range servers {
+				to := servers[1-from.Id]
+				to.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: from.Id, Operations: from.MyOperations}, &GossipReply{})
+			}
+
+			for _, s := range servers {
+				var got []uint64
+				for _, op := range s.OperationsPerformed {
+					got = append(got, op.Data)
+				}
+				if !slices.Equal(got, tc.want) || s.Data != tc.want[1] {
+					t.Errorf("server %d applied %v and holds %d; want %v and %d", s.Id, got, s.Data, tc.want, tc.want[1])
+				}
+				reply := ClientReply{}
+				s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+				if reply.Data != tc.want[1] {
+					t.Errorf("server %d read %d; want %d", s.Id, reply.Data, tc.want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestCustomTieBreakerIgnoresVectorSums(t *testing.T) {
+	lowestServerWins := func(a, b Operation) bool { return a.TieBreaker < b.TieBreaker }
+	for _, tc := range []struct {
+		name       string
+		tieBreaker func(a, b Operation) bool
+		want       uint64
+	}{
+		{"highest", HighestServerWins, 20},
+		{"lowest", lowestServerWins, 11},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{TieBreaker: tc.tieBreaker, MultiValue: true}
+			servers := []*Server{newTestServer(t, 0, 2, config), newTestServer(t, 1, 2, config)}
+			// Concurrent writes whose vectors, [2 0] and [0 1], have different sums.
+			write(servers[0], 10)
+			write(servers[0], 11)
+			write(servers[1], 20)
+			for _, from := range servers {
+				to := servers[1-from.Id]
+				to.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: from.Id, Operations: from.MyOperations}, &GossipReply{})
+			}
+
+			for _, s := range servers {
+				reply := ClientReply{}
+				s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply)
+				if reply.Data != tc.want || s.Data != tc.want {
+					t.Errorf("server %d read %d and holds %d; want %d", s.Id, reply.Data, s.Data, tc.want)
+				}
+				if !slices.Contains(reply.Siblings, 11) || !slices.Contains(reply.Siblings, 20) || len(reply.Siblings) != 2 {
+					t.Errorf("server %d reported siblings %v; want 11 and 20", s.Id, reply.Siblings)
+				}
+			}
+		})
+	}
+}
+
+func TestDependencyWaitWakesOnClockAdvance(t *testing.T) {
+	s := newTestServer(t, 0, 2, Config{DependencyWaitTimeout: 5 * time.Second})
+
+	// wait starts a read depending on clock and returns a channel that gets the time it finished.
+	wait := func(clock []uint64) chan time.Time {
+		done := make(chan time.Time, 1)
+		go func() {
+			reply := ClientReply{}
+			s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: MonotonicReads, ReadVector: clock}, &reply)
+			if !reply.Succeeded {
+				t.Errorf("read depending on %v was rejected", clock)
+			}
+			done <- time.Now()
+		}()
+		waitParked(t, s, 1)
+		return done
+	}
+	check := func(what string, done chan time.Time, advanced time.Time) {
+		t.Helper()
+		select {
+		case finished := <-done:
+			if lag := finished.Sub(advanced); lag > 50*time.Millisecond {
+				t.Errorf("read finished %v after %s", lag, what)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("read still blocked after %s", what)
+		}
+	}
+
+	done := wait([]uint64{0, 1})
+	peerWrite := Operation{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Seq: 1, Data: 8}
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{peerWrite}}, &GossipReply{})
+	check("the gossip it needed", done, time.Now())
+
+	done = wait([]uint64{1, 1})
+	write(s, 9)
+	check("the local write it needed", done, time.Now())
+}
+
+// clusterTransport delivers gossip straight to the server with the addressed connection.
+type clusterTransport map[string]*Server
+
+func (c clusterTransport) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	return c[conn.Address].ReceiveGossip(*args.(**GossipRequest), *reply.(**GossipReply))
+}
+
+func TestSyncGossip(t *testing.T) {
+	transport := clusterTransport{}
+	servers := make([]*Server, 3)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), Config{Transport: transport, SyncGossip: true, GossipInterval: time.Hour})
+		transport[servers[i].Self.Address] = servers[i]
+	}
+
+	for round, value := range []uint64{4, 7, 9} {
+		from := servers[round%len(servers)]
+		if _, err := write(from, value); err != nil {
+			t.Fatalf("write(%d): %v", value, err)
+		}
+		for _, s := range servers {
+			if s.Data != value || !reflect.DeepEqual(s.VectorClock, from.VectorClock) {
+				t.Errorf("right after server %d wrote %d, server %d has %d at %v; want it at %v", from.Id, value, s.Id, s.Data, s.VectorClock, from.VectorClock)
+			}
+		}
+	}
+}
+
+func TestInjectOperations(t *testing.T) {
+	s := newTestServer(t, 0, 3, Config{})
+	s.stopGossipLoop()
+
+	injected := []Operation{
+		{OperationType: Write, VersionVector: []uint64{0, 1, 0}, TieBreaker: 1, Seq: 1, Data: 4},
+		{OperationType: Write, VersionVector: []uint64{1, 0, 0}, TieBreaker: 0, Seq: 1, Data: 5},
+		{OperationType: Write, VersionVector: []uint64{1, 1, 1}, TieBreaker: 2, Seq: 1, Data: 6},
+	}
+	if err := s.InjectOperations(injected); err != nil {
+		t.Fatalf("InjectOperations: %v", err)
+	}
+	if want := []uint64{1, 1, 1}; s.Data != 6 || !reflect.DeepEqual(s.VectorClock, want) {
+		t.Errorf("after injecting the log the server has %d at %v; want 6 at %v", s.Data, s.VectorClock, want)
+	}
+	if len(s.OperationsPerformed) != len(injected) || s.OperationsPerformed[len(injected)-1].Data != 6 {
+		t.Errorf("log = %v; want the injected operations in order", s.OperationsPerformed)
+	}
+
+	// The injected write of server 0 counts as its own, so the next one follows it.
+	reply, err := write(s, 7)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if want := []uint64{2, 1, 1}; s.Data != 7 || !reflect.DeepEqual(reply.WriteVector, want) {
+		t.Errorf("write after injecting got %d at %v; want 7 at %v", s.Data, reply.WriteVector, want)
+	}
+
+	before := len(s.OperationsPerformed)
+	err = s.InjectOperations([]Operation{
+		{OperationType: Write, VersionVector: []uint64{3, 1, 1}, TieBreaker: 0, Seq: 3, Data: 8},
+		{OperationType: Write, VersionVector: []uint64{1, 1}, TieBreaker: 1, Seq: 2, Data: 9},
+	})
+	if err == nil {
+		t.Errorf("InjectOperations accepted a version vector of the wrong width")
+	}
+	if len(s.OperationsPerformed) != before || s.Data != 7 {
+		t.Errorf("a rejected injection changed the server to %d with %d operations", s.Data, len(s.OperationsPerformed))
+	}
+}
+
+func TestHasValue(t *testing.T) {
+	s := newTestServer(t, 0, 2, Config{})
+	s.stopGossipLoop()
+	read := func() ClientReply {
+		t.Helper()
+		reply := ClientReply{}
+		if err := s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal}, &reply); err != nil || !reply.Succeeded {
+			t.Fatalf("read = %+v, %v", reply, err)
+		}
+		return reply
+	}
+
+	if reply := read(); reply.HasValue {
+		t.Errorf("read from a never written register has a value: %+v", reply)
+	}
+	if reply, err := write(s, 0); err != nil || !reply.HasValue {
+		t.Errorf("write of 0 = %+v, %v; want it to report a value", reply, err)
+	}
+	if reply := read(); !reply.HasValue || reply.Data != 0 {
+		t.Errorf("read after writing 0 = %+v; want a value of 0", reply)
+	}
+}
+
+func TestFakeClockDrivesGossip(t *testing.T) {
+	clock := protocol.NewFakeClock(time.Unix(0, 0))
+	transport := clusterTransport{}
+	applied := make(chan Operation, 1)
+	config := Config{Transport: transport, Clock: clock, GossipInterval: time.Hour}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		c := config
+		if i == 1 {
+			c.OnWriteApplied = func(op Operation) { applied <- op }
+		}
+		servers[i] = newTestServer(t, uint64(i), len(servers), c)
+		t.Cleanup(func() { servers[i].Stop() })
+		transport[servers[i].Self.Address] = servers[i]
+	}
+
+	if _, err := write(servers[0], 5); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// Both gossip loops are waiting out their interval, which passes without any real delay.
+	clock.BlockUntil(len(servers))
+	clock.Advance(config.GossipInterval)
+
+	select {
+	case op := <-applied:
+		if op.Data != 5 {
+			t.Errorf("peer applied a write of %d; want 5", op.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer did not receive the write after the gossip interval passed")
+	}
+}
+
+func TestAdaptiveGossipInterval(t *testing.T) {
+	transport := clusterTransport{}
+	config := Config{Transport: transport, GossipInterval: 10 * time.Millisecond, MaxGossipInterval: 80 * time.Millisecond}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), config)
+		servers[i].stopGossipLoop()
+		transport[servers[i].Self.Address] = servers[i]
+	}
+	s := servers[0]
+
+	for _, want := range []time.Duration{20, 40, 80, 80} {
+		s.gossipTick()
+		if interval := s.currentGossipInterval(); interval != want*time.Millisecond {
+			t.Errorf("idle interval = %v; want %v", interval, want*time.Millisecond)
+		}
+	}
+
+	if _, err := write(s, 1); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if interval := s.currentGossipInterval(); interval != config.GossipInterval {
+		t.Errorf("interval after a write = %v; want %v", interval, config.GossipInterval)
+	}
+	s.gossipTick()
+	if interval := s.currentGossipInterval(); interval != config.GossipInterval || servers[1].Data != 1 {
+		t.Errorf("after gossiping the write the interval is %v and the peer has %d; want %v and 1", interval, servers[1].Data, config.GossipInterval)
+	}
+	s.gossipTick()
+	if interval := s.currentGossipInterval(); interval != 2*config.GossipInterval {
+		t.Errorf("interval after the next idle round = %v; want %v", interval, 2*config.GossipInterval)
+	}
+}
+
+func TestWriteWakesBackedOffGossip(t *testing.T) {
+	clock := protocol.NewFakeClock(time.Unix(0, 0))
+	transport := clusterTransport{}
+	applied := make(chan Operation, 1)
+	config := Config{Transport: transport, Clock: clock, GossipInterval: time.Second, MaxGossipInterval: time.Hour}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		c := config
+		c.OnWriteApplied = func(op Operation) { applied <- op }
+		servers[i] = newTestServer(t, uint64(i), len(servers), c)
+		transport[servers[i].Self.Address] = servers[i]
+	}
+	servers[1].stopGossipLoop()
+	s := servers[0]
+	t.Cleanup(func() { s.Stop() })
+
+	// Back the idle server off to an hour between rounds, and let its loop start waiting it out.
+	s.mu.Lock()
+	s.gossipInterval = config.MaxGossipInterval
+	s.mu.Unlock()
+	clock.BlockUntil(1)
+	clock.Advance(config.GossipInterval)
+	clock.BlockUntil(1)
+
+	if _, err := write(s, 3); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	<-applied
+	// The loop abandons its hour-long wait and waits out the base interval instead.
+	waiting := make(chan struct{})
+	go func() {
+		clock.BlockUntil(2)
+		close(waiting)
+	}()
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("gossip loop kept waiting out its backed-off interval after a write")
+	}
+	clock.Advance(config.GossipInterval)
+	select {
+	case op := <-applied:
+		if op.Data != 3 {
+			t.Errorf("peer applied a write of %d; want 3", op.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write was not gossiped within the base interval")
+	}
+}
+
+func TestWriteReportsPreviousValue(t *testing.T) {
+	s := newTestServer(t, 0, 2, Config{})
+	s.stopGossipLoop()
+	for _, tt := range []struct{ value, previous uint64 }{{4, 0}, {9, 4}, {9, 9}, {1, 9}} {
+		if reply, err := write(s, tt.value); err != nil || reply.Previous != tt.previous {
+			t.Errorf("write of %d = %+v, %v; want previous value %d", tt.value, reply, err, tt.previous)
+		}
+	}
+}
+
+func TestStopFlushesWritesToPeers(t *testing.T) {
+	transport := clusterTransport{}
+	servers := make([]*Server, 3)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), Config{Transport: transport, GossipInterval: time.Hour})
+		transport[servers[i].Self.Address] = servers[i]
+	}
+	s := servers[0]
+	for value := uint64(1); value <= 3; value++ {
+		if _, err := write(s, value); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for _, peer := range servers[1:] {
+		if peer.Data != 3 || !reflect.DeepEqual(peer.VectorClock, s.VectorClock) {
+			t.Errorf("after server 0 stopped peer %d has %d at %v; want its final write 3 at %v", peer.Id, peer.Data, peer.VectorClock, s.VectorClock)
+		}
+	}
+	if _, err := write(s, 4); err == nil {
+		t.Errorf("stopped server accepted a write")
+	}
+}
+
+func TestGossipSkipsAcknowledgedOperations(t *testing.T) {
+	receiver := newTestServer(t, 1, 2, Config{})
+	receiver.stopGossipLoop()
+	transport := &deliveringTransport{to: receiver}
+	sender := newTestServer(t, 0, 2, Config{Transport: transport})
+	sender.stopGossipLoop()
+
+	for value := uint64(1); value <= 3; value++ {
+		write(sender, value)
+	}
+	sender.gossipOnce()
+	// The reply acknowledged everything the receiver has applied.
+	acknowledged := append([]uint64(nil), receiver.VectorClock...)
+
+	for value := uint64(4); value <= 5; value++ {
+		write(sender, value)
+	}
+	sent := len(transport.requests)
+	sender.gossipOnce()
+	for _, request := range transport.requests[sent:] {
+		if len(request.Operations) != 2 {
+			t.Errorf("gossip after the acknowledgement carried %d operations; want the 2 new ones", len(request.Operations))
+		}
+		for _, op := range request.Operations {
+			if vectorclock.CompareVersionVector(acknowledged, op.VersionVector) {
+				t.Errorf("gossip re-sent operation %v, which the acknowledged clock %v covers", op.VersionVector, acknowledged)
+			}
+		}
+	}
+
+	// A peer's own gossip acknowledges what it has just as well as a reply does.
+	write(sender, 6)
+	receiver.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 0, Operations: sender.MyOperations}, &GossipReply{})
+	sender.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, VectorClock: receiver.VectorClock}, &GossipReply{})
+	sent = len(transport.requests)
+	sender.gossipOnce()
+	for _, request := range transport.requests[sent:] {
+		if len(request.Operations) != 0 {
+			t.Errorf("gossip to an up-to-date peer carried %d operations; want none", len(request.Operations))
+		}
+	}
+}
+
+func TestInitialValue(t *testing.T) {
+	transport := clusterTransport{}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), Config{Transport: transport, SyncGossip: true, GossipInterval: time.Hour, InitialValue: 42})
+		transport[servers[i].Self.Address] = servers[i]
+	}
+
+	for _, s := range servers {
+		if s.Data != 42 || !reflect.DeepEqual(s.OperationsPerformed, servers[0].OperationsPerformed) {
+			t.Fatalf("server %d before any write: Data %d, log %v; want 42 and the same genesis as server 0 (%v)",
+				s.Id, s.Data, s.OperationsPerformed, servers[0].OperationsPerformed)
+		}
+		var reply ClientReply
+		if err := s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Causal,
+			ReadVector: make([]uint64, 2), WriteVector: make([]uint64, 2)}, &reply); err != nil || reply.Data != 42 || !reply.HasValue {
+			t.Errorf("server %d read before any write: %+v, %v; want the initial value 42", s.Id, reply, err)
+		}
+	}
+
+	if _, err := write(servers[1], 7); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, s := range servers {
+		if s.Data != 7 {
+			t.Errorf("server %d after a write of 7: Data %d", s.Id, s.Data)
+		}
+	}
+
+	servers[0].Reset()
+	if servers[0].Data != 42 {
+		t.Errorf("after Reset: Data %d; want the initial value 42", servers[0].Data)
+	}
+
+	conn := &protocol.Connection{Network: "tcp", Address: "server-0"}
+	if _, err := NewWithConfig(0, conn, []*protocol.Connection{conn}, Config{InitialValue: 3, MinValue: 5}); err == nil {
+		t.Errorf("NewWithConfig accepted an initial value below MinValue")
+	}
+}
+
+func TestChecksumsRejectCorruptGossip(t *testing.T) {
+	s := newTestServer(t, 0, 2, Config{GossipInterval: time.Hour, Checksums: true})
+	s.stopGossipLoop()
+
+	write(s, 3)
+	if op := s.MyOperations[0]; op.Checksum != op.computeChecksum() {
+		t.Errorf("own write %+v carries checksum %08x; want %08x", op, op.Checksum, op.computeChecksum())
+	}
+
+	intact := Operation{OperationType: Write, VersionVector: []uint64{0, 1}, TieBreaker: 1, Seq: 1, Data: 7}
+	intact.Checksum = intact.computeChecksum()
+	corrupt := Operation{OperationType: Write, VersionVector: []uint64{0, 2}, TieBreaker: 1, Seq: 2, Data: 8}
+	corrupt.Checksum = corrupt.computeChecksum()
+	corrupt.Data = 9
+	unchecked := Operation{OperationType: Write, VersionVector: []uint64{0, 2}, TieBreaker: 1, Seq: 2, Data: 10}
+
+	// The gossip goes through gob, so the checksums travel as they would between servers.
+	request := cloneGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{intact, corrupt, unchecked}})
+	if err := s.ReceiveGossip(request, &GossipReply{}); err != nil {
+		t.Fatalf("ReceiveGossip: %v", err)
+	}
+	if !reflect.DeepEqual(s.VectorClock, []uint64{1, 1}) || len(s.PendingOperations) != 0 {
+		t.Errorf("after gossip: clock %v with %d pending; want only the intact operation applied at [1 1]", s.VectorClock, len(s.PendingOperations))
+	}
+	for _, op := range s.OperationsPerformed {
+		if op.Data == 9 || op.Data == 10 {
+			t.Errorf("applied %+v; want operations failing their checksum rejected", op)
+		}
+	}
+}
+
+func TestExpiringWrite(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// Server 1's clock lags, so only the tombstone expires the write there.
+	clocks := []*protocol.FakeClock{protocol.NewFakeClock(start), protocol.NewFakeClock(start)}
+	transport := clusterTransport{}
+	servers := make([]*Server, 2)
+	for i := range servers {
+		servers[i] = newTestServer(t, uint64(i), len(servers), Config{Transport: transport, SyncGossip: true, Clock: clocks[i]})
+		servers[i].stopGossipLoop()
+		transport[servers[i].Self.Address] = servers[i]
+	}
+	read := func(s *Server) ClientReply {
+		t.Helper()
+		var reply ClientReply
+		if err := s.ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Read, SessionType: Eventual}, &reply); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return reply
+	}
+
+	if err := servers[0].ProcessClientRequest(&ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Eventual,
+		Data: 5, ExpiresAt: start.Add(time.Second)}, &ClientReply{}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, s := range servers {
+		if reply := read(s); !reply.HasValue || reply.Data != 5 {
+			t.Errorf("server %d before expiry: read %+v; want 5", s.Id, reply)
+		}
+	}
+
+	clocks[0].Advance(2 * time.Second)
+	if reply := read(servers[0]); reply.HasValue || reply.Data != 0 {
+		t.Errorf("server 0 after expiry: read %+v; want not found", reply)
+	}
+	if reply := read(servers[1]); !reply.HasValue {
+		t.Errorf("server 1, its clock before the expiry: read %+v; want 5 until the tombstone arrives", reply)
+	}
+
+	servers[0].gossipTick()
+	for _, s := range servers {
+		if reply := read(s); reply.HasValue || reply.Data != 0 {
+			t.Errorf("server %d after the tombstone: read %+v; want not found", s.Id, reply)
+		}
+	}
+	if !reflect.DeepEqual(servers[0].VectorClock, servers[1].VectorClock) || servers[0].Data != servers[1].Data {
+		t.Errorf("servers diverged: %d at %v and %d at %v", servers[0].Data, servers[0].VectorClock, servers[1].Data, servers[1].VectorClock)
+	}
+
+	// A later write is found again, and only the expired write was swept.
+	write(servers[1], 6)
+	servers[0].gossipTick()
+	if reply := read(servers[0]); !reply.HasValue || reply.Data != 6 {
+		t.Errorf("after a new write: read %+v; want 6", reply)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/vectorclock"
+)
+
+// sessionClient tracks a session's vectors the way the client package does: each request carries
+// only the vectors its session type is checked against, and every reply is merged in.
+type sessionClient struct {
+	session     SessionType
+	readVector  []uint64
+	writeVector []uint64
+}
+
+func (c *sessionClient) do(t *testing.T, s *Server, operation OperationType, value uint64) ClientReply {
+	t.Helper()
+	request := ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: operation, SessionType: c.session, Data: value}
+	read, write := c.session.Vectors()
+	if read {
+		request.ReadVector = c.readVector
+	}
+	if write {
+		request.WriteVector = c.writeVector
+	}
+	var reply ClientReply
+	if err := s.ProcessClientRequest(&request, &reply); err != nil {
+		t.Fatalf("server %d: %v", s.Id, err)
+	}
+	if len(reply.ReadVector) == len(c.readVector) {
+		c.readVector = vectorclock.GetMaxVersionVector([][]uint64{c.readVector, reply.ReadVector})
+	}
+	if len(reply.WriteVector) == len(c.writeVector) {
+		c.writeVector = vectorclock.GetMaxVersionVector([][]uint64{c.writeVector, reply.WriteVector})
+	}
+	return reply
+}
+
+// anomaly is the canonical scenario a session guarantee rules out. Each runs against two servers
+// that don't gossip, a and b, and returns the request that would exhibit the anomaly if b served
+// it before hearing from a. Once b has a's operations the request must succeed with want.
+type anomaly struct {
+	name string
+	run  func(t *testing.T, c *sessionClient, a, b *Server) func() ClientReply
+	want uint64
+}
+
+var anomalies = []anomaly{
+	{"MonotonicReads: a read of 1 followed by a read of the initial 0", func(t *testing.T, c *sessionClient, a, b *Server) func() ClientReply {
+		write(a, 1)
+		c.do(t, a, Read, 0)
+		return func() ClientReply { return c.do(t, b, Read, 0) }
+	}, 1},
+	{"ReadYourWrites: a write of 1 followed by a read of the initial 0", func(t *testing.T, c *sessionClient, a, b *Server) func() ClientReply {
+		c.do(t, a, Write, 1)
+		return func() ClientReply { return c.do(t, b, Read, 0) }
+	}, 1},
+	{"MonotonicWrites: a write of 2 ordered without the session's earlier write of 1", func(t *testing.T, c *sessionClient, a, b *Server) func() ClientReply {
+		c.do(t, a, Write, 1)
+		return func() ClientReply { return c.do(t, b, Write, 2) }
+	}, 2},
+	{"WritesFollowReads: a write of 2 ordered without the write of 1 the session read", func(t *testing.T, c *sessionClient, a, b *Server) func() ClientReply {
+		write(a, 1)
+		c.do(t, a, Read, 0)
+		return func() ClientReply { return c.do(t, b, Write, 2) }
+	}, 2},
+}
+
+// TestSessionGuarantees runs every anomaly under every session type. A session type must prevent
+// the anomalies it promises to, by rejecting the request until the server has caught up, and
+// must allow the others, except those its vectors happen to rule out as well: the session types
+// checking the same vector prevent the same anomalies.
+func TestSessionGuarantees(t *testing.T) {
+	const (
+		monotonicReads = 1 << iota
+		readYourWrites
+		monotonicWrites
+		writesFollowReads
+	)
+	sessions := []struct {
+		name     string
+		session  SessionType
+		promises int
+		also     int // Prevented as a side effect of the vector the session is checked against
+	}{
+		{"Causal", Causal, monotonicReads | readYourWrites | monotonicWrites | writesFollowReads, 0},
+		{"MonotonicReads", MonotonicReads, monotonicReads, writesFollowReads},
+		{"MonotonicWrites", MonotonicWrites, monotonicWrites, readYourWrites},
+		{"ReadYourWrites", ReadYourWrites, readYourWrites, monotonicWrites},
+		{"WritesFollowReads", WritesFollowReads, writesFollowReads, monotonicReads},
+		{"Eventual", Eventual, 0, 0},
+	}
+
+	for _, session := range sessions {
+		for i, anomaly := range anomalies {
+			transport := clusterTransport{}
+			servers := make([]*Server, 2)
+			for j := range servers {
+				servers[j] = newTestServer(t, uint64(j), len(servers), Config{Transport: transport, GossipInterval: time.Hour})
+				servers[j].stopGossipLoop()
+				transport[servers[j].Self.Address] = servers[j]
+			}
+			a, b := servers[0], servers[1]
+			c := &sessionClient{session: session.session, readVector: make([]uint64, 2), writeVector: make([]uint64, 2)}
+
+			final := anomaly.run(t, c, a, b)
+			served := final().Succeeded
+			promised := session.promises&(1<<i) != 0
+			prevented := promised || session.also&(1<<i) != 0
+			switch {
+			case promised && served:
+				t.Errorf("%s does not keep its promise: b allowed %s", session.name, anomaly.name)
+			case prevented && served:
+				t.Errorf("%s: b allowed %s; want it prevented by the session's vector", session.name, anomaly.name)
+			case !prevented && !served:
+				t.Errorf("%s: b rejected the request of %s; the session doesn't rule it out", session.name, anomaly.name)
+			}
+			if served {
+				continue
+			}
+
+			a.gossipOnce()
+			if reply := final(); !reply.Succeeded || reply.Data != anomaly.want {
+				t.Errorf("%s, %s: after gossip b replied %+v; want success with %d", session.name, anomaly.name, reply, anomaly.want)
+			}
+		}
+	}
+}
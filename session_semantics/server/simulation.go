@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
+)
+
+// Simulation runs a cluster of servers in a single goroutine under virtual time. Gossip rounds,
+// message deliveries and client writes are events on one queue, delivered in virtual time order
+// by a scheduler driven by a seeded random source, so a run is fully determined by its seed and
+// any failure can be replayed. Messages may be delayed, reordered, duplicated or lost. Each
+// server's Clock is a FakeClock that reads the virtual time, so peer liveness, gossip fanout and
+// expiry follow the schedule rather than the wall clock.
+type Simulation struct {
+	Servers []*Server
+
+	// Loss is the probability that a gossip message is dropped.
+	Loss float64
+	// Duplication is the probability that a gossip message is delivered twice.
+	Duplication float64
+	// MaxLatency bounds the random delay of each message. Messages overtake each other freely.
+	MaxLatency time.Duration
+	// Expiry, if set, makes each client write expire that long after it is performed.
+	Expiry time.Duration
+
+	rng      *rand.Rand
+	now      time.Duration
+	events   eventQueue
+	sequence uint64
+	nodes    map[string]int
+	clocks   []*protocol.FakeClock // One per server, kept at simulationEpoch plus now
+	writes   int                   // Scheduled client writes not yet performed
+}
+
+type eventKind int
+
+const (
+	gossipTick eventKind = iota
+	delivery
+	clientWrite
+)
+
+type event struct {
+	at       time.Duration
+	sequence uint64 // Orders events scheduled for the same time
+	kind     eventKind
+	server   int
+	request  *GossipRequest
+	value    uint64
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].sequence < q[j].sequence
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// simulatedTransport queues gossip as delivery events instead of sending it. The sender gets no
+// reply, as if every reply were lost; peers still learn its clock from the gossip itself.
+type simulatedTransport struct {
+	sim *Simulation
+}
+
+func (t simulatedTransport) Invoke(conn protocol.Connection, method string, args, reply any) error {
+	to, ok := t.sim.nodes[conn.Address]
+	if !ok || method != "Server.ReceiveGossip" {
+		return fmt.Errorf("simulation cannot deliver %s to %s", method, conn.Address)
+	}
+	request := *args.(**GossipRequest)
+
+	if t.sim.rng.Float64() < t.sim.Loss {
+		return nil
+	}
+	copies := 1
+	if t.sim.rng.Float64() < t.sim.Duplication {
+		copies = 2
+	}
+	for range copies {
+		t.sim.schedule(t.sim.latency(), &event{kind: delivery, server: to, request: cloneGossip(request)})
+	}
+	return nil
+}
+
+// simulationEpoch is the wall-clock time the servers' clocks read at virtual time 0.
+var simulationEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// cloneGossip copies request through gob, as the network would, so servers never share memory.
+func cloneGossip(request *GossipRequest) *GossipRequest {
+	var buf bytes.Buffer
+	clone := &GossipRequest{}
+	if err := gob.NewEncoder(&buf).Encode(request); err != nil {
+		panic(err)
+	}
+	if err := gob.NewDecoder(&buf).Decode(clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+// NewSimulation creates a simulated cluster of size servers with the given config, seeded with
+// seed. Each server gossips every config.GossipInterval of virtual time, with random jitter.
+func NewSimulation(seed int64, size int, config Config) (*Simulation, error) {
+	sim := &Simulation{
+		MaxLatency: 100 * time.Millisecond,
+		rng:        rand.New(rand.NewSource(seed)),
+		nodes:      make(map[string]int),
+	}
+
+	conns := make([]*protocol.Connection, size)
+	for i := range conns {
+		conns[i] = &protocol.Connection{Network: "sim", Address: fmt.Sprintf("sim-%d", i)}
+		sim.nodes[conns[i].Address] = i
+	}
+	for i := range conns {
+		c := config
+		c.Transport = simulatedTransport{sim: sim}
+		c.ClusterSize = size
+		clock := protocol.NewFakeClock(simulationEpoch)
+		c.Clock = clock
+		s, err := NewWithConfig(uint64(i), conns[i], conns, c)
+		if err != nil {
+			return nil, err
+		}
+		// The scheduler drives gossip, so the server's own gossip loop must not run.
+		s.stopGossipLoop()
+		sim.Servers = append(sim.Servers, s)
+		sim.clocks = append(sim.clocks, clock)
+		sim.schedule(sim.jitter(s), &event{kind: gossipTick, server: i})
+	}
+	return sim, nil
+}
+
+func (sim *Simulation) schedule(after time.Duration, e *event) {
+	e.at = sim.now + after
+	e.sequence = sim.sequence
+	sim.sequence++
+	heap.Push(&sim.events, e)
+}
+
+func (sim *Simulation) latency() time.Duration {
+	if sim.MaxLatency <= 0 {
+		return 0
+	}
+	return time.Duration(sim.rng.Int63n(int64(sim.MaxLatency)))
+}
+
+// jitter returns a random delay of up to one gossip interval of s.
+func (sim *Simulation) jitter(s *Server) time.Duration {
+	return time.Duration(sim.rng.Int63n(int64(s.Config.GossipInterval))) + 1
+}
+
+// Write schedules writes of values 1 to n at random servers, spread at random over the next n
+// gossip intervals of virtual time.
+func (sim *Simulation) Write(n int) {
+	for value := 1; value <= n; value++ {
+		i := sim.rng.Intn(len(sim.Servers))
+		spread := int64(n) * int64(sim.Servers[i].Config.GossipInterval)
+		sim.schedule(time.Duration(sim.rng.Int63n(spread)), &event{kind: clientWrite, server: i, value: uint64(value)})
+		sim.writes++
+	}
+}
+
+// Step delivers the next event and reports whether there was one.
+func (sim *Simulation) Step() bool {
+	if sim.events.Len() == 0 {
+		return false
+	}
+	e := heap.Pop(&sim.events).(*event)
+	sim.advanceTo(e.at)
+	s := sim.Servers[e.server]
+
+	switch e.kind {
+	case gossipTick:
+		s.gossipTick()
+		sim.schedule(s.currentGossipInterval()+sim.jitter(s)/2, &event{kind: gossipTick, server: e.server})
+	case delivery:
+		s.ReceiveGossip(e.request, &GossipReply{})
+	case clientWrite:
+		sim.writes--
+		request := &ClientRequest{ProtocolVersion: ProtocolVersion, OperationType: Write, SessionType: Causal, Data: e.value}
+		if sim.Expiry > 0 {
+			request.ExpiresAt = simulationEpoch.Add(sim.now + sim.Expiry)
+		}
+		s.ProcessClientRequest(request, &ClientReply{})
+	}
+	return true
+}
+
+// RunFor delivers events until d of virtual time has passed.
+func (sim *Simulation) RunFor(d time.Duration) {
+	end := sim.now + d
+	for sim.events.Len() > 0 && sim.events[0].at <= end {
+		sim.Step()
+	}
+	sim.advanceTo(end)
+}
+
+// advanceTo moves the virtual time, and every server's clock with it, to now.
+func (sim *Simulation) advanceTo(now time.Duration) {
+	sim.now = now
+	for _, clock := range sim.clocks {
+		clock.Advance(simulationEpoch.Add(now).Sub(clock.Now()))
+	}
+}
+
+// Settle stops message loss and runs until every scheduled write is done and every server has
+// applied the same operations, or until d of virtual time has passed. It reports whether the
+// cluster converged.
+func (sim *Simulation) Settle(d time.Duration) bool {
+	sim.Loss = 0
+	end := sim.now + d
+	for sim.writes > 0 || !sim.Converged() {
+		if sim.events.Len() == 0 || sim.events[0].at > end {
+			return false
+		}
+		sim.Step()
+	}
+	return true
+}
+
+// Converged reports whether every server has the same clock and value and nothing pending.
+func (sim *Simulation) Converged() bool {
+	first := sim.Servers[0]
+	for _, s := range sim.Servers {
+		if len(s.PendingOperations) != 0 || s.Data != first.Data || !slices.Equal(s.VectorClock, first.VectorClock) {
+			return false
+		}
+	}
+	return true
+}
+
+// Now returns the current virtual time.
+func (sim *Simulation) Now() time.Duration {
+	return sim.now
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSimulationConverges(t *testing.T) {
+	const seeds, writes = 50, 30
+	for seed := int64(1); seed <= seeds; seed++ {
+		sim, err := NewSimulation(seed, 4, Config{})
+		if err != nil {
+			t.Fatalf("NewSimulation: %v", err)
+		}
+		sim.Loss, sim.Duplication = 0.3, 0.1
+		sim.Write(writes)
+		sim.RunFor(writes * defaultGossipInterval)
+
+		if !sim.Settle(time.Minute) {
+			for _, s := range sim.Servers {
+				t.Logf("server %d: Data %d, clock %v, %d pending", s.Id, s.Data, s.VectorClock, len(s.PendingOperations))
+			}
+			t.Fatalf("seed %d: cluster did not converge by %v of virtual time", seed, sim.Now())
+		}
+		var total uint64
+		for _, n := range sim.Servers[0].VectorClock {
+			total += n
+		}
+		if total != writes {
+			t.Fatalf("seed %d: converged clock %v counts %d writes; want %d", seed, sim.Servers[0].VectorClock, total, writes)
+		}
+	}
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		expiry time.Duration
+	}{
+		{name: "default"},
+		// Fanout picks peers by when they were last synced, and expiry compares write times to
+		// the server's clock, so both must follow virtual time.
+		{name: "fanout and expiry", config: Config{GossipFanout: 1}, expiry: 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := func() ([]uint64, [][]Operation, time.Duration) {
+				sim, err := NewSimulation(7, 3, tt.config)
+				if err != nil {
+					t.Fatalf("NewSimulation: %v", err)
+				}
+				sim.Loss = 0.2
+				sim.Expiry = tt.expiry
+				sim.Write(20)
+				sim.RunFor(time.Second)
+				sim.Settle(time.Minute)
+				// Give the last writes time to expire, then settle the tombstones.
+				sim.RunFor(time.Second)
+				sim.Settle(time.Minute)
+
+				var data []uint64
+				var logs [][]Operation
+				for _, s := range sim.Servers {
+					data = append(data, s.Data)
+					logs = append(logs, s.OperationsPerformed)
+				}
+				return data, logs, sim.Now()
+			}
+
+			data1, logs1, now1 := run()
+			data2, logs2, now2 := run()
+			if !reflect.DeepEqual(data1, data2) || !reflect.DeepEqual(logs1, logs2) || now1 != now2 {
+				t.Errorf("two runs with the same seed differ: Data %v and %v, settled at %v and %v", data1, data2, now1, now2)
+			}
+			if tt.expiry > 0 && !slices.ContainsFunc(logs1[0], func(op Operation) bool { return op.OperationType == Expire }) {
+				t.Errorf("no write expired in %v; the run should exercise expiry", logs1[0])
+			}
+		})
+	}
+}
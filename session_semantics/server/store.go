@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store persists the operations a server applies, so a restarted server recovers its register
+// instead of starting empty. Config.Store plugs one in; without one nothing is persisted.
+type Store interface {
+	// AppendOp durably records an applied operation.
+	AppendOp(op Operation) error
+	// LoadAll returns every operation recorded since the last snapshot, in the order appended.
+	LoadAll() ([]Operation, error)
+	// SaveSnapshot replaces everything stored with snapshot, the latest operation Compact folded
+	// away, and log, the operations still applied on top of it. A zero snapshot means none.
+	SaveSnapshot(snapshot Operation, log []Operation) error
+	// LoadSnapshot returns the last snapshot saved, and whether there is one.
+	LoadSnapshot() (Operation, bool, error)
+}
+
+// MemoryStore is a Store that keeps everything in memory. It survives a server being replaced
+// by a new one in the same process, which is what tests of recovery need.
+type MemoryStore struct {
+	mu       sync.Mutex
+	ops      []Operation
+	snapshot Operation
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) AppendOp(op Operation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops = append(m.ops, cloneOperation(op))
+	return nil
+}
+
+func (m *MemoryStore) LoadAll() ([]Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]Operation, len(m.ops))
+	for i, op := range m.ops {
+		ops[i] = cloneOperation(op)
+	}
+	return ops, nil
+}
+
+func (m *MemoryStore) SaveSnapshot(snapshot Operation, log []Operation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshot = cloneOperation(snapshot)
+	m.ops = make([]Operation, len(log))
+	for i, op := range log {
+		m.ops[i] = cloneOperation(op)
+	}
+	return nil
+}
+
+func (m *MemoryStore) LoadSnapshot() (Operation, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return cloneOperation(m.snapshot), m.snapshot.VersionVector != nil, nil
+}
+
+func cloneOperation(op Operation) Operation {
+	if op.VersionVector != nil {
+		op.VersionVector = append([]uint64(nil), op.VersionVector...)
+	}
+	return op
+}
+
+// FileStore is a Store in a directory: a log file of operations appended as they are applied,
+// and a snapshot file. Each record is a uvarint length followed by the operation's MarshalBinary
+// encoding. Every append is synced to disk before it returns.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+	log *os.File
+}
+
+const (
+	fileStoreLog      = "operations.log"
+	fileStoreSnapshot = "snapshot"
+)
+
+// maxRecordSize bounds what a corrupt record length can make LoadAll allocate.
+const maxRecordSize = 1 << 24
+
+// NewFileStore opens the store in dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+	f := &FileStore{dir: dir}
+	if err := f.openLog(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileStore) openLog() error {
+	log, err := os.OpenFile(filepath.Join(f.dir, fileStoreLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening operation log: %w", err)
+	}
+	f.log = log
+	return nil
+}
+
+func (f *FileStore) AppendOp(op Operation) error {
+	record, err := encodeRecord(op)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.log.Write(record); err != nil {
+		return fmt.Errorf("appending to operation log: %w", err)
+	}
+	if err := f.log.Sync(); err != nil {
+		return fmt.Errorf("syncing operation log: %w", err)
+	}
+	return nil
+}
+
+// LoadAll reads the log. A record cut short at the end of the log, as a crash in the middle of
+// an append leaves it, is dropped.
+func (f *FileStore) LoadAll() ([]Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return readRecords(filepath.Join(f.dir, fileStoreLog))
+}
+
+// SaveSnapshot writes the snapshot and the new log to temporary files and renames them into
+// place, so a crash leaves either the old contents or the new ones.
+func (f *FileStore) SaveSnapshot(snapshot Operation, log []Operation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ops []Operation
+	if snapshot.VersionVector != nil {
+		ops = []Operation{snapshot}
+	}
+	if err := writeRecords(filepath.Join(f.dir, fileStoreSnapshot), ops); err != nil {
+		return err
+	}
+	if err := writeRecords(filepath.Join(f.dir, fileStoreLog), log); err != nil {
+		return err
+	}
+	// The old handle still points at the replaced file.
+	f.log.Close()
+	return f.openLog()
+}
+
+func (f *FileStore) LoadSnapshot() (Operation, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops, err := readRecords(filepath.Join(f.dir, fileStoreSnapshot))
+	if err != nil || len(ops) == 0 {
+		return Operation{}, false, err
+	}
+	return ops[0], true, nil
+}
+
+// Close closes the log file.
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.Close()
+}
+
+func encodeRecord(op Operation) ([]byte, error) {
+	data, err := op.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(data))), data...), nil
+}
+
+func readRecords(path string) ([]Operation, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var ops []Operation
+	r := bufio.NewReader(file)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ops, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if size > maxRecordSize {
+			return nil, fmt.Errorf("reading %s: record %d claims %d bytes", path, len(ops), size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return ops, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		var op Operation
+		if err := op.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("reading %s: record %d: %w", path, len(ops), err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+func writeRecords(path string, ops []Operation) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, op := range ops {
+		record, err := encodeRecord(op)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(record)
+	}
+	if err := errors.Join(w.Flush(), tmp.Sync(), tmp.Close()); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
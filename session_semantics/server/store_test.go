@@ -0,0 +1,150 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoresAppendThenLoad(t *testing.T) {
+	dir := t.TempDir()
+	files, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	t.Cleanup(func() { files.Close() })
+
+	ops := history(4, 2, 3)
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": files} {
+		t.Run(name, func(t *testing.T) {
+			if loaded, err := store.LoadAll(); err != nil || len(loaded) != 0 {
+				t.Errorf("LoadAll of an empty store = %v, %v; want nothing", loaded, err)
+			}
+			if _, ok, err := store.LoadSnapshot(); err != nil || ok {
+				t.Errorf("LoadSnapshot of an empty store = %v, %v; want none", ok, err)
+			}
+
+			for _, op := range ops {
+				if err := store.AppendOp(op); err != nil {
+					t.Fatalf("AppendOp: %v", err)
+				}
+			}
+			if loaded, err := store.LoadAll(); err != nil || !reflect.DeepEqual(loaded, ops) {
+				t.Errorf("LoadAll = %v, %v; want %v", loaded, err, ops)
+			}
+
+			if err := store.SaveSnapshot(ops[1], ops[2:]); err != nil {
+				t.Fatalf("SaveSnapshot: %v", err)
+			}
+			if snapshot, ok, err := store.LoadSnapshot(); err != nil || !ok || !reflect.DeepEqual(snapshot, ops[1]) {
+				t.Errorf("LoadSnapshot = %v, %v, %v; want %v", snapshot, ok, err, ops[1])
+			}
+			next := Operation{OperationType: Write, VersionVector: []uint64{3, 2, 1}, TieBreaker: 2, Seq: 1, Data: 9}
+			if err := store.AppendOp(next); err != nil {
+				t.Fatalf("AppendOp after a snapshot: %v", err)
+			}
+			want := append(append([]Operation(nil), ops[2:]...), next)
+			if loaded, err := store.LoadAll(); err != nil || !reflect.DeepEqual(loaded, want) {
+				t.Errorf("LoadAll after a snapshot = %v, %v; want %v", loaded, err, want)
+			}
+		})
+	}
+
+	// The file store is still there when reopened, minus a record a crash cut short.
+	log, err := os.OpenFile(filepath.Join(dir, fileStoreLog), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	log.Write([]byte{20, 1, 1})
+	log.Close()
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if loaded, err := reopened.LoadAll(); err != nil || len(loaded) != 3 {
+		t.Errorf("LoadAll of the reopened store = %v, %v; want the 3 complete records", loaded, err)
+	}
+	if snapshot, ok, err := reopened.LoadSnapshot(); err != nil || !ok || !reflect.DeepEqual(snapshot, ops[1]) {
+		t.Errorf("LoadSnapshot of the reopened store = %v, %v, %v; want %v", snapshot, ok, err, ops[1])
+	}
+}
+
+func TestServerRecoversFromStore(t *testing.T) {
+	store := NewMemoryStore()
+	s := newTestServer(t, 0, 2, Config{Store: store})
+	s.stopGossipLoop()
+	write(s, 1)
+	write(s, 2)
+	s.ReceiveGossip(&GossipRequest{ProtocolVersion: ProtocolVersion, ServerId: 1, Operations: []Operation{
+		{OperationType: Write, VersionVector: []uint64{2, 1}, TieBreaker: 1, Seq: 1, Data: 7},
+	}}, &GossipReply{})
+
+	restarted := newTestServer(t, 0, 2, Config{Store: store})
+	restarted.stopGossipLoop()
+	if restarted.Data != s.Data || !reflect.DeepEqual(restarted.VectorClock, s.VectorClock) {
+		t.Errorf("restarted server has %d at %v; want %d at %v", restarted.Data, restarted.VectorClock, s.Data, s.VectorClock)
+	}
+	if !reflect.DeepEqual(restarted.OperationsPerformed, s.OperationsPerformed) || len(restarted.MyOperations) != 2 {
+		t.Errorf("restarted server has log %v with %d own writes; want %v with 2", restarted.OperationsPerformed, len(restarted.MyOperations), s.OperationsPerformed)
+	}
+
+	// New writes carry on from the recovered ones.
+	write(restarted, 3)
+	if op := restarted.MyOperations[len(restarted.MyOperations)-1]; op.Seq != 3 || !reflect.DeepEqual(op.VersionVector, []uint64{3, 1}) {
+		t.Errorf("write after recovery = %+v; want sequence number 3 at [3 1]", op)
+	}
+
+	if _, err := NewWithConfig(0, s.Self, s.Peers, Config{ClusterSize: 3, Store: store}); err == nil {
+		t.Errorf("server with a wider clock recovered operations of width 2")
+	}
+}
+
+func TestChecksumsDetectCorruptStoredOperation(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	s := newTestServer(t, 0, 2, Config{Store: store, Checksums: true})
+	s.stopGossipLoop()
+	write(s, 5)
+	write(s, 6)
+	store.Close()
+
+	// Rot the data of the first record, a single varint byte just before the 4 checksum bytes,
+	// leaving a record that still decodes.
+	path := filepath.Join(dir, "operations.log")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	length := int(data[0])
+	if data[length-4] != 5 {
+		t.Fatalf("first record %x does not end in data 5 and a checksum", data[1:1+length])
+	}
+	data[length-4] = 9
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	restarted := newTestServer(t, 0, 2, Config{Store: reopened, Checksums: true})
+	restarted.stopGossipLoop()
+	if len(restarted.OperationsPerformed) != 1 || restarted.OperationsPerformed[0].Data != 6 {
+		t.Errorf("recovered log %+v; want only the intact write of 6", restarted.OperationsPerformed)
+	}
+
+	snapshot := NewMemoryStore()
+	rotten := Operation{OperationType: Write, VersionVector: []uint64{1, 0}, TieBreaker: 0, Seq: 1, Data: 5}
+	rotten.Checksum = rotten.computeChecksum() + 1
+	snapshot.SaveSnapshot(rotten, nil)
+	if _, err := NewWithConfig(0, s.Self, s.Peers, Config{Store: snapshot, Checksums: true}); err == nil {
+		t.Errorf("server recovered from a snapshot whose checksum does not match")
+	}
+}
@@ -1,14 +1,30 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/rpc"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/alanwang67/distributed_registers/session_semantics/protocol"
 	"github.com/charmbracelet/log"
 )
 
+// Version identifies the server build. Set it at build time with
+// -ldflags "-X github.com/alanwang67/distributed_registers/session_semantics/server.Version=<version>".
+var Version = "dev"
+
+// ProtocolVersion is the version of the client and gossip messages. Bump it whenever their
+// encoding changes incompatibly, so mismatched servers reject each other's messages clearly.
+const ProtocolVersion = 3
+
+const defaultGossipInterval = 50 * time.Millisecond
+
 type RequestType uint64
 
 const (
@@ -21,6 +37,9 @@ type OperationType uint64
 const (
 	Read OperationType = iota
 	Write
+	// Expire is the tombstone a server issues once its latest write has expired, so replicas
+	// whose clocks run behind expire the write too. Its Data is 0.
+	Expire
 )
 
 type SessionType uint64
@@ -31,67 +50,439 @@ const (
 	MonotonicWrites
 	ReadYourWrites
 	WritesFollowReads
+	// Eventual reads and writes whatever the server has, with no guarantees at all.
+	Eventual
 )
 
+// Vectors reports which of a client's vectors a request under the session is checked against.
+// Clients may leave out the others.
+func (t SessionType) Vectors() (read, write bool) {
+	switch t {
+	case MonotonicReads, WritesFollowReads:
+		return true, false
+	case MonotonicWrites, ReadYourWrites:
+		return false, true
+	case Eventual:
+		return false, false
+	default:
+		return true, true
+	}
+}
+
+// ParseSessionType parses a session type from its name, e.g. "Causal" or "MonotonicReads", or from its
+// abbreviation, e.g. "MR". Matching is case-insensitive.
+func ParseSessionType(name string) (SessionType, error) {
+	switch strings.ToLower(name) {
+	case "causal":
+		return Causal, nil
+	case "monotonicreads", "mr":
+		return MonotonicReads, nil
+	case "monotonicwrites", "mw":
+		return MonotonicWrites, nil
+	case "readyourwrites", "ryw", "ryr":
+		return ReadYourWrites, nil
+	case "writesfollowreads", "wfr":
+		return WritesFollowReads, nil
+	case "eventual", "any":
+		return Eventual, nil
+	default:
+		return 0, fmt.Errorf("unknown session type %q", name)
+	}
+}
+
 type Operation struct {
 	OperationType OperationType
 	VersionVector []uint64
 	TieBreaker    uint64
+	Seq           uint64 // Position among the writes accepted by server TieBreaker, starting at 1
 	Data          uint64
+	Checksum      uint32 // CRC-32 of the other fields, set when the issuing server has Config.Checksums on
+	ExpiresAt     int64  // Unix time in nanoseconds after which a write reads as not found; 0 never expires
 }
 
 type ClientRequest struct {
-	OperationType OperationType
-	SessionType   SessionType
-	Data          uint64
-	ReadVector    []uint64
-	WriteVector   []uint64
+	ProtocolVersion uint64
+	OperationType   OperationType
+	SessionType     SessionType
+	Data            uint64
+	ReadVector      []uint64
+	WriteVector     []uint64
+	ClientId        uint64    // Identifies the sending client to the fair queue; see Config.FairQueueDepth
+	ExpiresAt       time.Time // On writes, when the value expires and reads no longer find it; zero never expires
 }
 
 type ClientReply struct {
-	Succeeded     bool
-	OperationType OperationType
-	Data          uint64
-	ReadVector    []uint64
-	WriteVector   []uint64
+	ProtocolVersion uint64
+	Succeeded       bool
+	OperationType   OperationType
+	Data            uint64
+	HasValue        bool   // Whether the register was given an InitialValue or any write was applied, and it has not expired, so a Data of 0 is a value rather than none
+	Previous        uint64 // On writes, the value the server held just before applying the write
+	ReadVector      []uint64
+	WriteVector     []uint64
+	Siblings        []uint64 // Values of concurrent latest writes, set on reads when Config.MultiValue is on and there are several
 }
 
 type GossipRequest struct {
-	ServerId   uint64
-	Operations []Operation
+	ProtocolVersion uint64
+	ServerId        uint64
+	Operations      []Operation
+	VectorClock     []uint64
+	MembershipEpoch uint64
+	Compressed      []byte // Operations, gob-encoded and gzipped, when the sender compresses gossip
 }
 
 type GossipReply struct {
+	ProtocolVersion uint64
+	ServerId        uint64
+	VectorClock     []uint64
+	MembershipEpoch uint64
+}
+
+type ServerInfoRequest struct {
+}
+
+type ServerInfoReply struct {
+	ServerId       uint64
+	Version        string
+	ClusterSize    int
+	GossipInterval time.Duration
+	PeerListHash   uint64
+}
+
+type ListPeersRequest struct {
+}
+
+type ListPeersReply struct {
+	Servers []*protocol.Connection // Every server in the cluster, indexed by server ID
+}
+
+type InspectRequest struct {
+}
+
+type InspectReply struct {
+	ServerId          uint64
+	Data              uint64
+	VectorClock       []uint64
+	PendingOperations int
+	ConvergenceLag    []uint64
+	ConcurrentWrites  uint64
+	Peers             []PeerStatus
+}
+
+// Config holds optional server settings. The zero value imposes no restrictions.
+type Config struct {
+	// ClusterSize is the number of servers in the cluster and hence the width of every vector
+	// clock. 0 derives it from the server's ID and its peers.
+	ClusterSize int
+
+	// MembershipEpoch is bumped whenever the cluster's membership, and so its clock width, changes.
+	// Gossip between different epochs has its vectors coerced to the local width.
+	MembershipEpoch uint64
+
+	// MinValue and MaxValue bound the values the register may hold. A MaxValue of 0 leaves
+	// the register unbounded above.
+	MinValue uint64
+	MaxValue uint64
+
+	// InitialValue is the value the register holds before any write. The server records it as a
+	// genesis operation with an all-zero vector, ordered before every write, so servers configured
+	// with the same InitialValue agree on the value and the log from the start. It must be the
+	// same on every server, and within MinValue and MaxValue unless it is 0.
+	InitialValue uint64
+
+	// MaxConnections bounds how many client and peer connections are served at once. Further
+	// connections wait to be accepted until a slot frees up. 0 means no limit.
+	MaxConnections int
+
+	// FairQueueDepth puts client requests in a queue per client ID and serves each client one
+	// request at a time, so a client sending a burst of requests can't starve the others.
+	// Different clients are served concurrently, so a request waiting out DependencyWaitTimeout
+	// holds up only its own client. A client with FairQueueDepth requests already waiting has
+	// further ones rejected. The OnWriteApplied and OnDependencyRejected hooks must not make
+	// client requests under the ID of the client they were called for. 0 serves requests as they
+	// arrive.
+	FairQueueDepth int
+
+	// ListenRetryTimeout is how long Start keeps retrying, with backoff, when its address is
+	// still in use. 0 fails immediately.
+	ListenRetryTimeout time.Duration
+
+	// GossipInterval is how often the server gossips its operations to peers. 0 uses 50ms.
+	GossipInterval time.Duration
+
+	// MaxGossipInterval lets an idle server gossip less often: after each round that sent no
+	// operations the interval doubles, up to MaxGossipInterval, and a local write returns it to
+	// GossipInterval. 0 keeps the interval fixed.
+	MaxGossipInterval time.Duration
+
+	// GossipFanout is how many peers the server gossips to each interval, picking the ones it
+	// synced with least recently so every peer is reached within a few intervals. 0 gossips to
+	// every peer.
+	GossipFanout int
+
+	// SuspectAfter is how many gossip rounds in a row a peer must fail before the server suspects
+	// it is down and stops gossiping to it every round. 0 uses 3.
+	SuspectAfter int
+
+	// SuspectRetryInterval is how often the server still tries to gossip to a suspected peer, to
+	// notice when it is back. 0 uses 10 gossip intervals.
+	SuspectRetryInterval time.Duration
+
+	// Transport carries the server's outgoing RPCs. nil uses protocol.DefaultTransport.
+	Transport protocol.Transport `json:"-"`
+
+	// Store persists the operations the server applies, and the server recovers its register
+	// from it when created. nil persists nothing.
+	Store Store `json:"-"`
+
+	// Clock is the server's source of time, for gossip intervals, timeouts and peer liveness.
+	// nil uses protocol.DefaultClock.
+	Clock protocol.Clock `json:"-"`
+
+	// MultiValue makes reads report every concurrent latest write as a sibling instead of only
+	// the one the tie-breaker picks, so clients can resolve the conflict themselves.
+	MultiValue bool
+
+	// MaxPayloadBytes bounds the size of a client request or gossip message, estimated from its
+	// vectors and operations. Larger ones are rejected. 0 means no limit.
+	MaxPayloadBytes int
+
+	// MaxGossipOperations caps the operations in one gossip message. Larger sets are sent in
+	// several messages. 0 means no cap.
+	MaxGossipOperations int
+
+	// SyncGossip makes every accepted write gossip to all peers before the write returns, so
+	// tests can check convergence right after a write instead of waiting for the gossip loop.
+	// A peer that can't be reached simply misses out until the next round.
+	SyncGossip bool
+
+	// Checksums makes the server stamp each write it accepts with a checksum over its fields, and
+	// verify the checksum of every operation it receives in gossip or recovers from its Store.
+	// An operation that fails verification is logged and dropped instead of being applied. It
+	// must be the same on every server, since operations without a checksum fail verification.
+	Checksums bool
+
+	// CompressGossip makes the server gzip the operations of the gossip it sends, trading CPU for
+	// bandwidth on slow links. Servers accept compressed gossip whether or not they set it.
+	CompressGossip bool
+
+	// SelfTest makes Start check the server and its first peer before serving clients: a write
+	// and read against a scratch copy of the server, and an exchange with the peer that must
+	// agree on the protocol version and cluster size. Client requests are refused until the
+	// check passes, and if it fails the server stops and Start returns the reason.
+	SelfTest bool
+
+	// DependencyWaitTimeout is how long a client request that fails the dependency check waits
+	// for gossip to bring the clock up to its dependencies before it is rejected. A server a few
+	// operations behind then serves the request a little late instead of turning it away. 0
+	// rejects immediately.
+	DependencyWaitTimeout time.Duration
+
+	// TieBreaker reports whether operation a wins over b when neither dominates the other. Of the
+	// applied operations no other one dominates, the register holds the one that wins over the
+	// rest, whatever their vector sums, so it decides which of several concurrent writes a read
+	// returns. It also orders operations of equal vector sum in the log. It must be a strict weak
+	// ordering and the same on every server. nil uses HighestServerWins.
+	TieBreaker func(a, b Operation) bool `json:"-"`
+
+	// OnWriteApplied, OnGossipReceived and OnDependencyRejected, if set, are called when a write
+	// is applied, whether from a client or from gossip, when gossip arrives, with the number of
+	// operations it carries, and when a client request fails the dependency check. They are called
+	// without the server's lock held, so they may call back into the server.
+	OnWriteApplied       func(op Operation)           `json:"-"`
+	OnGossipReceived     func(from uint64, count int) `json:"-"`
+	OnDependencyRejected func(request ClientRequest)  `json:"-"`
+
+	// Replicate, if set, is passed every operation the server applies, from a client or from
+	// gossip, once it is persisted to the Store, exactly once and in the order they were applied,
+	// e.g. to mirror the register into another system. It runs on its own goroutine, so it may
+	// be slow without holding up clients or gossip. A call that fails is retried with backoff a
+	// few times, then the operation is logged and skipped.
+	Replicate func(op Operation) error `json:"-"`
+}
+
+// operationId identifies an operation by the server that issued it and its sequence number there.
+type operationId struct {
+	Origin uint64
+	Seq    uint64
+}
+
+// dependencies are the vectors of a client request that passed the dependency check.
+type dependencies struct {
+	valid       bool
+	sessionType SessionType
+	readVector  []uint64
+	writeVector []uint64
+}
+
+// peer is a connection to another server in the cluster, tagged with that server's ID.
+type peer struct {
+	Id   uint64
+	Conn *protocol.Connection
 }
 
 type Server struct {
 	Id    uint64
 	Self  *protocol.Connection
 	Peers []*protocol.Connection
+	peers []peer
+
+	Config Config
 
 	VectorClock         []uint64
 	OperationsPerformed []Operation
 	MyOperations        []Operation
 	PendingOperations   []Operation
 	Data                uint64
+	ConcurrentWrites    uint64 // Gossiped writes that were concurrent with this server's frontier when applied
+	peerClocks          map[uint64][]uint64
+	liveness            map[uint64]*liveness     // Keyed by peer ID; see livenessOf
+	snapshot            Operation                // The latest operation Compact folded away, if any
+	seen                map[operationId]struct{} // Operations already applied or pending, so re-gossip is cheap to skip
+	lastDependencies    dependencies             // The last client dependencies the clock was found to satisfy
+	resets              uint64                   // Number of calls to Reset, so gossip in flight across one is recognized
+	seq                 uint64                   // Sequence number of the last write this server accepted; survives Reset so identities stay unique
 	mu                  sync.Mutex
+	clockAdvanced       *sync.Cond    // Signaled when VectorClock advances; see clockCond
+	dependencyWaiters   int           // Client requests parked in waitForDependencies
+	gossipInterval      time.Duration // Current interval between gossip rounds; see adaptGossipInterval
+	queue               fairQueue     // Client requests waiting to be served; see Config.FairQueueDepth
+	toReplicate         []Operation   // Applied operations not yet passed to Config.Replicate
+	replicating         bool          // Whether the goroutine calling Config.Replicate is running
+
+	listener    net.Listener
+	connections int
+	done        chan struct{}
+	wake        chan struct{} // Signaled when a write resets a backed-off gossip interval
+	stopOnce    sync.Once
+	stopped     bool // Set under mu once Stop begins; client requests are rejected from then on
+	loopOnce    sync.Once
+	loop        sync.WaitGroup // The running gossip loop, if any
+	notReady    atomic.Bool    // Set while the startup self-test is running
+	selfTestErr error
 }
 
 func (s *Server) Start() error {
 	log.Debugf("starting server %d", s.Id)
 
-	l, err := net.Listen(s.Self.Network, s.Self.Address)
+	l, err := s.listen()
 	if err != nil {
 		return err
 	}
 	defer l.Close()
-	log.Debugf("server %d listening on %s", s.Id, s.Self.Address)
+	log.Debugf("server %d listening on %s", s.Id, l.Addr())
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(s); err != nil {
+		return err
+	}
 
-	rpc.Register(s)
+	if s.Config.SelfTest {
+		s.notReady.Store(true)
+		go s.runSelfTest()
+	}
+
+	var slots chan struct{}
+	if s.Config.MaxConnections > 0 {
+		slots = make(chan struct{}, s.Config.MaxConnections)
+	}
 
 	for {
-		rpc.Accept(l)
-		// some other stuff goes here...
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-s.done:
+				return nil
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return s.selfTestErr
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+
+		go func() {
+			srv.ServeConn(conn)
 
+			s.mu.Lock()
+			s.connections--
+			s.mu.Unlock()
+			if slots != nil {
+				<-slots
+			}
+		}()
 	}
 }
+
+// listen binds the server's address, retrying with exponential backoff while the address is in use
+// for up to Config.ListenRetryTimeout.
+func (s *Server) listen() (net.Listener, error) {
+	clock := s.Config.clock()
+	deadline := clock.Now().Add(s.Config.ListenRetryTimeout)
+	backoff := 10 * time.Millisecond
+
+	for {
+		l, err := net.Listen(s.Self.Network, s.Self.Address)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || clock.Now().Add(backoff).After(deadline) {
+			return l, err
+		}
+
+		log.Debugf("server %d address %s in use, retrying in %v", s.Id, s.Self.Address, backoff)
+		clock.Sleep(backoff)
+		backoff = min(2*backoff, 500*time.Millisecond)
+	}
+}
+
+// Addr returns the address the server is listening on, which differs from the configured address
+// when binding an ephemeral port such as ":0". It is empty until the server is listening.
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stop shuts the server down so that peers are as up to date as possible when it leaves. In
+// order, it rejects further client requests, stops the gossip loop and waits out a round in
+// progress, gossips its writes to every peer it can reach one last time, and closes the listener,
+// ending Start. The loop is stopped before the final round so the two can't race.
+func (s *Server) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
+
+		s.stopGossipLoop()
+		s.gossipRound(0)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.listener != nil {
+			err = s.listener.Close()
+		}
+	})
+	return err
+}
+
+// stopGossipLoop stops the gossip loop and waits for it to return.
+func (s *Server) stopGossipLoop() {
+	s.loopOnce.Do(func() { close(s.done) })
+	s.loop.Wait()
+}